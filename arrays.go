@@ -0,0 +1,377 @@
+package nlua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Name of the metatable shared by typed array userdata in the lua registry
+const typedArrayTypeName = "nbtarray"
+
+// typedArray is the compact value of a byte (7), int (11) or long (12) array tag: a Go slice wrapped in lua userdata
+// instead of a lua table with one entry (or, for longs, one {least, most} table) per element
+type typedArray struct {
+	tagType byte
+	bytes   []int8
+	ints    []int32
+	longs   []int64
+}
+
+func newTypedArray(tagType byte, n int) (*typedArray, error) {
+	a := &typedArray{tagType: tagType}
+	switch tagType {
+	case 7:
+		a.bytes = make([]int8, n)
+	case 11:
+		a.ints = make([]int32, n)
+	case 12:
+		a.longs = make([]int64, n)
+	default:
+		return nil, fmt.Errorf("tagType %d is not an array type", tagType)
+	}
+	return a, nil
+}
+
+func (a *typedArray) len() int {
+	switch a.tagType {
+	case 7:
+		return len(a.bytes)
+	case 11:
+		return len(a.ints)
+	}
+	return len(a.longs)
+}
+
+func (a *typedArray) get(i int) int64 {
+	switch a.tagType {
+	case 7:
+		return int64(a.bytes[i])
+	case 11:
+		return int64(a.ints[i])
+	}
+	return a.longs[i]
+}
+
+// set stores n at zero-based index i, which may be one past the end to append
+func (a *typedArray) set(i int, n int64) error {
+	switch a.tagType {
+	case 7:
+		if n < math.MinInt8 || n > math.MaxInt8 {
+			return fmt.Errorf("%d is out of range for Byte in tag 7 - Byte Array", n)
+		}
+		if i == len(a.bytes) {
+			a.bytes = append(a.bytes, int8(n))
+		} else {
+			a.bytes[i] = int8(n)
+		}
+	case 11:
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return fmt.Errorf("%d is out of range for Int in tag 11 - Int Array", n)
+		}
+		if i == len(a.ints) {
+			a.ints = append(a.ints, int32(n))
+		} else {
+			a.ints[i] = int32(n)
+		}
+	default:
+		if i == len(a.longs) {
+			a.longs = append(a.longs, n)
+		} else {
+			a.longs[i] = n
+		}
+	}
+	return nil
+}
+
+// slice returns a copy of the zero-based half-open range [i, j)
+func (a *typedArray) slice(i, j int) *typedArray {
+	s := &typedArray{tagType: a.tagType}
+	switch a.tagType {
+	case 7:
+		s.bytes = append([]int8(nil), a.bytes[i:j]...)
+	case 11:
+		s.ints = append([]int32(nil), a.ints[i:j]...)
+	default:
+		s.longs = append([]int64(nil), a.longs[i:j]...)
+	}
+	return s
+}
+
+// writeTo writes the array payload, length first
+func (a *typedArray) writeTo(w io.Writer, order binary.ByteOrder) error {
+	var err error
+	switch a.tagType {
+	case 7:
+		if err = binary.Write(w, order, int32(len(a.bytes))); err == nil {
+			err = binary.Write(w, order, a.bytes)
+		}
+	case 11:
+		if err = binary.Write(w, order, int32(len(a.ints))); err == nil {
+			err = binary.Write(w, order, a.ints)
+		}
+	default:
+		if err = binary.Write(w, order, int32(len(a.longs))); err == nil {
+			err = binary.Write(w, order, a.longs)
+		}
+	}
+	return err
+}
+
+// readTypedArray reads an array payload straight into a typedArray
+func (c *codec) readTypedArray(r *bytes.Reader, tagType byte) (lua.LValue, error) {
+	var n int32
+	err := binary.Read(r, c.order, &n)
+	numRecords := int64(n)
+	if err != nil {
+		return nil, NbtParseError{fmt.Sprintf("Reading tag %d array length", tagType), err}
+	}
+	size := arrayElementSize(tagType)
+	if numRecords < 0 || numRecords > int64(r.Len())/size {
+		return nil, NbtParseError{fmt.Sprintf("Tag %d array length %d exceeds remaining data", tagType, numRecords), nil}
+	}
+	a, err := newTypedArray(tagType, int(numRecords))
+	if err != nil {
+		return nil, NbtParseError{"Reading compact array", err}
+	}
+	switch tagType {
+	case 7:
+		err = binary.Read(r, c.order, a.bytes)
+	case 11:
+		err = binary.Read(r, c.order, a.ints)
+	default:
+		err = binary.Read(r, c.order, a.longs)
+	}
+	if err != nil {
+		return nil, NbtParseError{fmt.Sprintf("Reading tag %d array", tagType), err}
+	}
+	return newTypedArrayUserData(c.L, a), nil
+}
+
+// toLua returns element n as the usual lua value: a number, or a {least, most} table for longs
+func (a *typedArray) toLua(L *lua.LState, n int64) lua.LValue {
+	if a.tagType != 12 {
+		return lua.LNumber(n)
+	}
+	least, most := longToIntPair(n)
+	lTable := L.NewTable()
+	L.RawSet(lTable, lua.LString("least"), lua.LNumber(least))
+	L.RawSet(lTable, lua.LString("most"), lua.LNumber(most))
+	return lTable
+}
+
+// fromLua converts an element value: an integer number, or for longs also a {least, most} table
+func (a *typedArray) fromLua(v lua.LValue) (int64, error) {
+	switch n := v.(type) {
+	case lua.LNumber:
+		if !isInteger(n) || math.Abs(float64(n)) > 1<<53 {
+			return 0, fmt.Errorf("'%v' is not an integer", n)
+		}
+		return int64(n), nil
+	case *lua.LTable:
+		if a.tagType == 12 {
+			return longOf(n)
+		}
+	}
+	return 0, fmt.Errorf("'%v' is not a valid element of a tag %d array", v, a.tagType)
+}
+
+func newTypedArrayUserData(L *lua.LState, a *typedArray) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = a
+	ud.Metatable = typedArrayMetatable(L)
+	return ud
+}
+
+// typedArrayOf returns the typedArray in a lua value, or nil if it is something else
+func typedArrayOf(v lua.LValue) *typedArray {
+	if ud, ok := v.(*lua.LUserData); ok {
+		if a, ok := ud.Value.(*typedArray); ok {
+			return a
+		}
+	}
+	return nil
+}
+
+func typedArrayMetatable(L *lua.LState) *lua.LTable {
+	if mt, ok := L.GetTypeMetatable(typedArrayTypeName).(*lua.LTable); ok {
+		return mt
+	}
+	mt := L.NewTypeMetatable(typedArrayTypeName)
+	mt.RawSetString("__index", L.NewFunction(typedArrayIndex))
+	mt.RawSetString("__newindex", L.NewFunction(typedArrayNewIndex))
+	mt.RawSetString("__len", L.NewFunction(typedArrayLen))
+	mt.RawSetString("__tostring", L.NewFunction(typedArrayToString))
+	mt.RawSetString("methods", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"len":     typedArrayLen,
+		"slice":   typedArraySlice,
+		"get":     typedArrayGet,
+		"set":     typedArraySet,
+		"totable": typedArrayToTable,
+	}))
+	return mt
+}
+
+func checkTypedArray(L *lua.LState, n int) *typedArray {
+	a := typedArrayOf(L.Get(n))
+	if a == nil {
+		L.ArgError(n, typedArrayTypeName+" expected")
+	}
+	return a
+}
+
+// checkRange reads optional 1-based inclusive bounds i and j at stack positions n and n+1 and returns them
+// as a zero-based half-open range
+func checkRange(L *lua.LState, a *typedArray, n int) (int, int) {
+	i := L.OptInt(n, 1)
+	j := L.OptInt(n+1, a.len())
+	if i < 1 || j > a.len() || i > j+1 {
+		L.ArgError(n, fmt.Sprintf("range %d to %d outside array of length %d", i, j, a.len()))
+	}
+	return i - 1, j
+}
+
+// a[i] returns element i; a:method(...) calls a method
+func typedArrayIndex(L *lua.LState) int {
+	a := checkTypedArray(L, 1)
+	switch k := L.Get(2).(type) {
+	case lua.LNumber:
+		i := int(k)
+		if i < 1 || i > a.len() || lua.LNumber(i) != k {
+			return 0
+		}
+		L.Push(a.toLua(L, a.get(i-1)))
+		return 1
+	case lua.LString:
+		if methods, ok := typedArrayMetatable(L).RawGetString("methods").(*lua.LTable); ok {
+			L.Push(methods.RawGet(k))
+			return 1
+		}
+	}
+	return 0
+}
+
+// a[i] = v sets element i, or appends when i is one past the end
+func typedArrayNewIndex(L *lua.LState) int {
+	a := checkTypedArray(L, 1)
+	i := L.CheckInt(2)
+	if i < 1 || i > a.len()+1 {
+		L.ArgError(2, fmt.Sprintf("index %d outside array of length %d", i, a.len()))
+	}
+	n, err := a.fromLua(L.Get(3))
+	if err == nil {
+		err = a.set(i-1, n)
+	}
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	return 0
+}
+
+func typedArrayLen(L *lua.LState) int {
+	L.Push(lua.LNumber(checkTypedArray(L, 1).len()))
+	return 1
+}
+
+func typedArrayToString(L *lua.LState) int {
+	a := checkTypedArray(L, 1)
+	L.Push(lua.LString(fmt.Sprintf("%s: tag %d, %d elements", typedArrayTypeName, a.tagType, a.len())))
+	return 1
+}
+
+// a:slice(i, j) returns a new array copied from elements i through j
+func typedArraySlice(L *lua.LState) int {
+	a := checkTypedArray(L, 1)
+	i, j := checkRange(L, a, 2)
+	L.Push(newTypedArrayUserData(L, a.slice(i, j)))
+	return 1
+}
+
+// a:get(i, j) returns elements i through j (default all) as a lua table
+func typedArrayGet(L *lua.LState) int {
+	a := checkTypedArray(L, 1)
+	i, j := checkRange(L, a, 2)
+	t := L.CreateTable(j-i, 0)
+	for k := i; k < j; k++ {
+		t.Append(a.toLua(L, a.get(k)))
+	}
+	L.Push(t)
+	return 1
+}
+
+// a:set(i, values) overwrites elements from i on with a lua table or another array, growing the array as needed
+func typedArraySet(L *lua.LState) int {
+	a := checkTypedArray(L, 1)
+	i := L.CheckInt(2) - 1
+	if i < 0 || i > a.len() {
+		L.ArgError(2, fmt.Sprintf("index %d outside array of length %d", i+1, a.len()))
+	}
+	if src := typedArrayOf(L.Get(3)); src != nil {
+		if src == a {
+			// setting an array into itself reads the elements as they were, and stops at their end
+			src = a.slice(0, a.len())
+		}
+		for k := 0; k < src.len(); k++ {
+			if err := a.set(i+k, src.get(k)); err != nil {
+				L.ArgError(3, err.Error())
+			}
+		}
+		return 0
+	}
+	values := L.CheckTable(3)
+	for k := 1; k <= values.Len(); k++ {
+		n, err := a.fromLua(values.RawGetInt(k))
+		if err == nil {
+			err = a.set(i+k-1, n)
+		}
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+	}
+	return 0
+}
+
+// a:totable() returns the whole array as a lua table in the non-compact representation
+func typedArrayToTable(L *lua.LState) int {
+	L.SetTop(1)
+	return typedArrayGet(L)
+}
+
+// nbt_array(tagType, n or table) makes a compact array of type 7, 11 or 12 with n zeroes or the table's elements
+func newArray(L *lua.LState) int {
+	a, err := newTypedArray(byte(L.CheckInt(1)), 0)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	switch v := L.Get(2).(type) {
+	case lua.LNumber:
+		// an NBT array's length is an int32
+		if !isInteger(v) || v < 0 || v > math.MaxInt32 {
+			L.ArgError(2, fmt.Sprintf("%v is not a valid array length", v))
+		}
+		// gopher-lua only notices Go memory over the limit after it's allocated, if the process survives that
+		if mb := getConfig(L).memoryLimitMb; mb > 0 && int64(v)*arrayElementSize(a.tagType) > int64(mb)<<20 {
+			L.ArgError(2, fmt.Sprintf("an array of %v elements would exceed the memory limit of %d MB", v, mb))
+		}
+		a, _ = newTypedArray(a.tagType, int(v))
+	case *lua.LTable:
+		for k := 1; k <= v.Len(); k++ {
+			n, err := a.fromLua(v.RawGetInt(k))
+			if err == nil {
+				err = a.set(k-1, n)
+			}
+			if err != nil {
+				L.ArgError(2, err.Error())
+			}
+		}
+	case *lua.LNilType:
+	default:
+		L.TypeError(2, lua.LTTable)
+	}
+	L.Push(newTypedArrayUserData(L, a))
+	return 1
+}
@@ -0,0 +1,121 @@
+package nlua
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompactArrays(t *testing.T) {
+	UseBedrockEncoding()
+	want := testNbt(t)
+
+	L := NewState(CompactArrays())
+	defer L.Close()
+	if err := Nbt2Lua(want, L); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("compact round trip: err %v\nexpected %v\ngot      %v", err, want, got)
+	}
+
+	err := L.DoString(`
+		local arrays = {}
+		for _, tag in ipairs(nbt) do
+			arrays[tag.tagType] = tag.value
+		end
+		local b, i, l = arrays[7], arrays[11], arrays[12]
+		assert(type(b) == "userdata" and #b == 4 and b[1] == 5 and b[4] == 8 and b[5] == nil)
+		assert(i:len() == 4 and i[2] == 6)
+		assert(l[1].least == 0xffffffff and l[1].most == 1 and l[3].most == 0x80000000)
+
+		local s = i:slice(2, 3)
+		assert(#s == 2 and s[1] == 6 and s[2] == 7)
+		s[1] = 60
+		assert(i[2] == 6, "slice must be a copy")
+
+		local t = b:get(3)
+		assert(#t == 2 and t[1] == 7 and t[2] == 8)
+		b:set(4, { 9, 10 })
+		assert(#b == 5 and b[4] == 9 and b[5] == 10)
+		b[6] = -1
+		assert(#b == 6)
+		assert(not pcall(function() b[1] = 128 end), "byte range not checked")
+		assert(not pcall(function() b[1] = 1.5 end), "integer not checked")
+
+		l[2] = { least = 1, most = 2 }
+		assert(l[2].least == 1 and l[2].most == 2)
+
+		local n = nbt_array(11, 3)
+		assert(#n == 3 and n[3] == 0)
+		-- setting an array into itself copies its elements as they were
+		local self = nbt_array(11, { 1, 2, 3 })
+		self:set(2, self)
+		assert(#self == 4 and self[2] == 1 and self[3] == 2 and self[4] == 3)
+		self:set(#self + 1, self)
+		assert(#self == 8 and self[5] == 1 and self[8] == 3)
+		n = nbt_array(12, { { least = 7, most = 0 } })
+		assert(n[1].least == 7)
+		assert(not pcall(nbt_array, 7, -1), "negative length not checked")
+		assert(not pcall(nbt_array, 7, 2^31), "length range not checked")
+		assert(not pcall(function() l[1] = { least = 2^32, most = 0 } end), "long half range not checked")
+		assert(not pcall(function() l[1] = { least = 0.5, most = 0 } end), "long half integer not checked")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the modified compact arrays must encode the same as the table representation of the same values
+	eager := NewState()
+	defer eager.Close()
+	if err := Nbt2Lua(want, eager); err != nil {
+		t.Fatal(err)
+	}
+	if err := eager.DoString(`
+		for _, tag in ipairs(nbt) do
+			if tag.tagType == 7 then
+				tag.value = { 5, 6, 7, 9, 10, -1 }
+			elseif tag.tagType == 12 then
+				tag.value[2] = { least = 1, most = 2 }
+			end
+		end
+	`); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := Lua2Nbt(eager)
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, expected) {
+		t.Errorf("modified compact arrays: err %v\nexpected %v\ngot      %v", err, expected, got)
+	}
+}
+
+func TestArrayOfErrors(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	for _, elements := range []string{"{2^40, 1}", "{1.5}", `{"x"}`} {
+		script := `nbt = { { tagType = 10, name = "", value = { { tagType = 11, name = "a", value = ` + elements + ` } } } }`
+		if err := L.DoString(script); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Lua2Json(L); err == nil {
+			t.Errorf("%s: expected a JSON error", elements)
+		}
+		if _, err := Lua2Snbt(L); err == nil {
+			t.Errorf("%s: expected an SNBT error", elements)
+		}
+		if _, _, err := GetPath(L, "a[0]"); err == nil {
+			t.Errorf("%s: expected a path error", elements)
+		}
+	}
+}
+
+func TestArrayMemoryLimit(t *testing.T) {
+	L := NewState(MemoryLimit(1), SharedMemoryLimit())
+	defer L.Close()
+	err := L.DoString(`
+		assert(#nbt_array(12, 2^17) == 2^17)
+		assert(not pcall(nbt_array, 12, 2^17 + 1))
+		assert(not pcall(nbt_array, 12, 2^31 - 1))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,272 @@
+package nlua
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/goleveldb/leveldb/opt"
+	"github.com/df-mc/goleveldb/leveldb/util"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Name of the metatable of world userdata in the lua registry
+const bedrockWorldTypeName = "bedrockworld"
+
+// BedrockWorld is an open Minecraft Bedrock Edition world database: the LevelDB in a world's db directory,
+// using Mojang's raw deflate block compression
+type BedrockWorld struct {
+	db *leveldb.DB
+}
+
+// OpenBedrockWorld opens the LevelDB of the world at path, which is either the world directory or its db directory.
+// Close it when done; the game must not have the world open at the same time.
+func OpenBedrockWorld(path string) (*BedrockWorld, error) {
+	if info, err := os.Stat(filepath.Join(path, "db")); err == nil && info.IsDir() {
+		path = filepath.Join(path, "db")
+	}
+	db, err := leveldb.OpenFile(path, &opt.Options{Compression: opt.FlateCompression, ErrorIfMissing: true})
+	if err != nil {
+		return nil, err
+	}
+	return &BedrockWorld{db}, nil
+}
+
+// Close closes the world database
+func (w *BedrockWorld) Close() error {
+	return w.db.Close()
+}
+
+// Keys returns all keys that start with prefix; a nil or empty prefix returns every key
+func (w *BedrockWorld) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	iter := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	return keys, iter.Error()
+}
+
+// Get returns the raw value of key, or nil if there is no such key
+func (w *BedrockWorld) Get(key []byte) ([]byte, error) {
+	value, err := w.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Put sets the raw value of key
+func (w *BedrockWorld) Put(key, value []byte) error {
+	return w.db.Put(key, value, nil)
+}
+
+// Delete removes key
+func (w *BedrockWorld) Delete(key []byte) error {
+	return w.db.Delete(key, nil)
+}
+
+// LoadNbt converts the value of key to the global `nbt` variable like Nbt2Lua, always as little endian
+func (w *BedrockWorld) LoadNbt(key []byte, L *lua.LState) error {
+	doc, err := w.loadDoc(key, L)
+	if err != nil {
+		return err
+	}
+	L.SetGlobal("nbt", doc)
+	return nil
+}
+
+// SaveNbt converts the global `nbt` variable like Lua2Nbt, always as little endian, and stores it as the value of key
+func (w *BedrockWorld) SaveNbt(key []byte, L *lua.LState) error {
+	return w.saveDoc(key, L.GetGlobal("nbt"), L)
+}
+
+func (w *BedrockWorld) loadDoc(key []byte, L *lua.LState) (*lua.LTable, error) {
+	value, err := w.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("key %x not found", key)
+	}
+	return nbtToTable(value, newBedrockCodec(L))
+}
+
+func (w *BedrockWorld) saveDoc(key []byte, doc lua.LValue, L *lua.LState) error {
+	value, err := tableToNbt(doc, newBedrockCodec(L))
+	if err != nil {
+		return err
+	}
+	return w.Put(key, value)
+}
+
+// newBedrockCodec is a codec for NBT stored in Bedrock world databases, which is little endian whatever the
+// package encoding setting, and where a value may legitimately hold several root tags
+func newBedrockCodec(L *lua.LState) *codec {
+	c := newCodec(L)
+	c.order = binary.LittleEndian
+	c.roots = RootsStream
+	return c
+}
+
+func bedrockWorldMetatable(L *lua.LState) *lua.LTable {
+	if mt, ok := L.GetTypeMetatable(bedrockWorldTypeName).(*lua.LTable); ok {
+		return mt
+	}
+	mt := L.NewTypeMetatable(bedrockWorldTypeName)
+	mt.RawSetString("__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"keys":    worldKeys,
+		"get":     worldGet,
+		"put":     worldPut,
+		"delete":  worldDelete,
+		"loadnbt": worldLoadNbt,
+		"savenbt": worldSaveNbt,
+		"close":   worldClose,
+		"chunk":   worldChunk,
+		"chunks":  worldChunks,
+	}))
+	return mt
+}
+
+func checkWorld(L *lua.LState) *BedrockWorld {
+	if ud, ok := L.Get(1).(*lua.LUserData); ok {
+		if w, ok := ud.Value.(*BedrockWorld); ok && w.db != nil {
+			return w
+		}
+	}
+	L.ArgError(1, "open "+bedrockWorldTypeName+" expected")
+	return nil
+}
+
+// openworld(path) opens a Bedrock world directory or its db directory; worlds opened before stay open, and
+// bedrock_chunk uses the latest one
+func openWorld(L *lua.LState) int {
+	cfg := getConfig(L)
+	path, err := cfg.allowedPath(L.CheckString(1))
+	if err != nil {
+		return pushError(L, "Error opening world", err)
+	}
+	w, err := OpenBedrockWorld(path)
+	if err != nil {
+		return pushError(L, "Error opening world", err)
+	}
+	cfg.worlds = append(cfg.openWorlds(), w)
+	ud := L.NewUserData()
+	ud.Value = w
+	ud.Metatable = bedrockWorldMetatable(L)
+	L.Push(ud)
+	return 1
+}
+
+// openWorlds returns the worlds openworld opened that the script hasn't closed, the latest last
+func (c *config) openWorlds() []*BedrockWorld {
+	var open []*BedrockWorld
+	for _, w := range c.worlds {
+		if w.db != nil {
+			open = append(open, w)
+		}
+	}
+	return open
+}
+
+// closeWorlds closes the worlds openworld opened, except those a script already closed
+func (c *config) closeWorlds() error {
+	var err error
+	for _, w := range c.openWorlds() {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		w.db = nil
+	}
+	c.worlds = nil
+	return err
+}
+
+// world:keys(prefix) returns a table of the keys (as strings) starting with prefix, default all
+func worldKeys(L *lua.LState) int {
+	w := checkWorld(L)
+	keys, err := w.Keys([]byte(L.OptString(2, "")))
+	if err != nil {
+		return pushError(L, "Error listing keys", err)
+	}
+	t := L.CreateTable(len(keys), 0)
+	for _, key := range keys {
+		t.Append(lua.LString(key))
+	}
+	L.Push(t)
+	return 1
+}
+
+// world:get(key) returns the raw value of key as a string, nil if there is none, or nil and an error message
+func worldGet(L *lua.LState) int {
+	w := checkWorld(L)
+	value, err := w.Get([]byte(L.CheckString(2)))
+	if err != nil {
+		return pushError(L, "Error reading key", err)
+	}
+	if value == nil {
+		return 0
+	}
+	L.Push(lua.LString(value))
+	return 1
+}
+
+// world:put(key, value) sets the raw value of key
+func worldPut(L *lua.LState) int {
+	w := checkWorld(L)
+	if err := w.Put([]byte(L.CheckString(2)), []byte(L.CheckString(3))); err != nil {
+		return pushError(L, "Error writing key", err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// world:delete(key) removes key
+func worldDelete(L *lua.LState) int {
+	w := checkWorld(L)
+	if err := w.Delete([]byte(L.CheckString(2))); err != nil {
+		return pushError(L, "Error deleting key", err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// world:loadnbt(key) returns the value of key as a table of top-level tags, like the global nbt
+func worldLoadNbt(L *lua.LState) int {
+	w := checkWorld(L)
+	doc, err := w.loadDoc([]byte(L.CheckString(2)), L)
+	if err != nil {
+		return pushError(L, "Error converting value", err)
+	}
+	L.Push(doc)
+	return 1
+}
+
+// world:savenbt(key, doc) converts doc, default the global nbt, and stores it as the value of key
+func worldSaveNbt(L *lua.LState) int {
+	w := checkWorld(L)
+	doc := L.Get(3)
+	if doc == lua.LNil {
+		doc = L.GetGlobal("nbt")
+	}
+	if err := w.saveDoc([]byte(L.CheckString(2)), doc, L); err != nil {
+		return pushError(L, "Error saving value", err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// world:close() closes the world database; the world can't be used afterwards
+func worldClose(L *lua.LState) int {
+	w := checkWorld(L)
+	err := w.Close()
+	w.db = nil
+	if err != nil {
+		return pushError(L, "Error closing world", err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
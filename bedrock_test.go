@@ -0,0 +1,176 @@
+package nlua
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/df-mc/goleveldb/leveldb"
+	"github.com/df-mc/goleveldb/leveldb/opt"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// newTestWorld makes an empty world directory with a db and returns its path
+func newTestWorld(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nlua-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := leveldb.OpenFile(filepath.Join(dir, "db"), &opt.Options{Compression: opt.FlateCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	return dir
+}
+
+func TestBedrockWorld(t *testing.T) {
+	dir := newTestWorld(t)
+	defer os.RemoveAll(dir)
+
+	// the package encoding must not matter for world values
+	UseJavaEncoding()
+	defer UseBedrockEncoding()
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("worldpath", lua.LString(dir))
+	err := L.DoString(`
+		local w = openworld(worldpath)
+		w:savenbt("~local_player", { { tagType = 10, name = "", value = { { tagType = 3, name = "PlayerGameMode", value = 1 } } } })
+		w:put("other", "raw")
+		w:put("~local_other", "x")
+
+		local keys = w:keys("~local")
+		assert(#keys == 2 and keys[1] == "~local_other" and keys[2] == "~local_player", "prefix keys")
+		assert(#w:keys() == 3)
+		assert(w:get("other") == "raw" and w:get("missing") == nil)
+
+		local doc = w:loadnbt("~local_player")
+		assert(doc[1].value[1].name == "PlayerGameMode" and doc[1].value[1].value == 1)
+		w:delete("other")
+		assert(w:get("other") == nil)
+		w:close()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := OpenBedrockWorld(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	value, err := w.Get([]byte("~local_player"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compound "" { int "PlayerGameMode" = 1 } in little endian
+	want := append([]byte{10, 0, 0, 3, 14, 0}, []byte("PlayerGameMode")...)
+	want = append(want, 1, 0, 0, 0, 0)
+	if string(value) != string(want) {
+		t.Errorf("stored value expected %v, got %v", want, value)
+	}
+}
+
+func TestWorldLifetime(t *testing.T) {
+	dir := newTestWorld(t)
+	defer os.RemoveAll(dir)
+
+	other := newTestWorld(t)
+	defer os.RemoveAll(other)
+
+	L := NewState()
+	L.SetGlobal("worldpath", lua.LString(dir))
+	L.SetGlobal("otherpath", lua.LString(other))
+	// opening another world leaves the first open, so values can be copied between them
+	err := L.DoString(`
+		local old = assert(openworld(worldpath))
+		local w = assert(openworld(otherpath))
+		old:put("k", "v")
+		w:put("k", old:get("k"))
+		assert(w:get("k") == "v")
+		assert(old:close())
+		-- the database is locked while open, so this only works because old was closed
+		w = assert(openworld(worldpath))
+		assert(w:get("k") == "v")
+
+		local missing, msg = w:loadnbt("missing")
+		assert(missing == nil and msg:find("Error converting value"), msg)
+		local none, msg = openworld(worldpath .. "/nothing/here")
+		assert(none == nil and msg:find("Error opening world"), msg)
+		assert(bedrock_chunk(0, 0) == nil)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	CloseState(L)
+	for _, path := range []string{dir, other} {
+		w, err := OpenBedrockWorld(path)
+		if err != nil {
+			t.Fatalf("a world is still open after CloseState: %v", err)
+		}
+		w.Close()
+	}
+}
+
+func TestChunkKey(t *testing.T) {
+	keys := []struct {
+		k ChunkKey
+		b []byte
+	}{
+		{ChunkKey{X: 1, Z: -1, Tag: ChunkVersion}, []byte{1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 44}},
+		{ChunkKey{X: 2, Z: 3, Tag: ChunkSubChunkPrefix, Subchunk: -4}, []byte{2, 0, 0, 0, 3, 0, 0, 0, 47, 0xfc}},
+		{ChunkKey{X: 0, Z: 0, Dimension: Nether, Tag: ChunkBlockEntity}, []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 49}},
+		{ChunkKey{X: 0, Z: 1, Dimension: TheEnd, Tag: ChunkSubChunkPrefix, Subchunk: 3}, []byte{0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 47, 3}},
+	}
+	for _, key := range keys {
+		if b := key.k.Bytes(); string(b) != string(key.b) {
+			t.Errorf("%+v: expected %v, got %v", key.k, key.b, b)
+		}
+		if k, ok := ParseChunkKey(key.b); !ok || k != key.k {
+			t.Errorf("%v: expected %+v, got %+v, %v", key.b, key.k, k, ok)
+		}
+	}
+	for _, b := range [][]byte{[]byte("~local_player"), []byte("BiomeData"), {0, 0, 0, 0, 0, 0, 0, 0, 47}, {0, 0, 0, 0, 0, 0, 0, 0, 44, 1}} {
+		if k, ok := ParseChunkKey(b); ok {
+			t.Errorf("%q is not a chunk key, parsed as %+v", b, k)
+		}
+	}
+}
+
+func TestBedrockChunk(t *testing.T) {
+	dir := newTestWorld(t)
+	defer os.RemoveAll(dir)
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("worldpath", lua.LString(dir))
+	err := L.DoString(`
+		local w = openworld(worldpath)
+		local function tag(id) return { tagType = 10, name = "", value = { { tagType = 8, name = "id", value = id } } } end
+		w:put(chunk_key(5, 6, 0, 44), "\40")
+		w:put(chunk_key(5, 6, 0, 47, -1), "subchunk")
+		w:savenbt(chunk_key(5, 6, 0, 49), { tag("Chest"), tag("Sign") })
+		w:savenbt(chunk_key(5, 6, 1, 49), { tag("Nether") })
+		w:put("digp" .. string.sub(chunk_key(5, 6, 0, 44), 1, 8), "\1\0\0\0\0\0\0\0")
+		w:savenbt("actorprefix\1\0\0\0\0\0\0\0", { tag("Cow") })
+
+		local c = bedrock_chunk(5, 6)
+		assert(c.x == 5 and c.z == 6 and c.dimension == 0)
+		assert(#c.blockEntities == 2 and c.blockEntities[2].value[1].value == "Sign")
+		assert(#c.entities == 1 and c.entities[1].value[1].value == "Cow")
+		assert(c.subchunks[-1] == "subchunk" and c.records[44] == "\40")
+		assert(w:chunk(5, 6, 1).blockEntities[1].value[1].value == "Nether")
+		assert(bedrock_chunk(w, 5, 6, 1).blockEntities[1].value[1].value == "Nether")
+		assert(w:chunk(7, 7) == nil)
+		assert(#w:chunks() == 2 and #w:chunks(1) == 1)
+
+		local k = parse_chunk_key(chunk_key(-3, 4, 2, 47, 5))
+		assert(k.x == -3 and k.z == 4 and k.dimension == 2 and k.tag == 47 and k.subchunk == 5)
+		w:close()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
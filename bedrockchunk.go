@@ -0,0 +1,320 @@
+package nlua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Record types of Bedrock chunk keys: the byte after the coordinates (and dimension)
+const (
+	ChunkData3D         byte = 43
+	ChunkVersion        byte = 44
+	ChunkData2D         byte = 45
+	ChunkData2DLegacy   byte = 46
+	ChunkSubChunkPrefix byte = 47
+	ChunkLegacyTerrain  byte = 48
+	ChunkBlockEntity    byte = 49
+	ChunkEntity         byte = 50
+	ChunkPendingTicks   byte = 51
+	ChunkBlockExtraData byte = 52
+	ChunkBiomeState     byte = 53
+	ChunkFinalizedState byte = 54
+	ChunkBorderBlocks   byte = 56
+	ChunkHardcodedSpawn byte = 57
+	ChunkRandomTicks    byte = 58
+	ChunkChecksums      byte = 59
+	ChunkVersionOld     byte = 118
+)
+
+// Bedrock dimension ids; the overworld is left out of chunk keys
+const (
+	Overworld int32 = 0
+	Nether    int32 = 1
+	TheEnd    int32 = 2
+)
+
+// Key prefixes of entities stored per entity since 1.18.30 rather than in a chunk's ChunkEntity record
+var (
+	entityDigestPrefix = []byte("digp")
+	actorPrefix        = []byte("actorprefix")
+)
+
+// ChunkKey is a decoded Bedrock chunk record key: chunk coordinates, dimension, record type and, for
+// ChunkSubChunkPrefix records only, the subchunk's y index
+type ChunkKey struct {
+	X, Z      int32
+	Dimension int32
+	Tag       byte
+	Subchunk  int8
+}
+
+// ChunkPos identifies a chunk in a Bedrock world
+type ChunkPos struct {
+	X, Z      int32
+	Dimension int32
+}
+
+// ParseChunkKey decodes a LevelDB key if it is a chunk record key
+func ParseChunkKey(key []byte) (ChunkKey, bool) {
+	var k ChunkKey
+	if len(key) < 9 {
+		return k, false
+	}
+	k.X = int32(binary.LittleEndian.Uint32(key[0:4]))
+	k.Z = int32(binary.LittleEndian.Uint32(key[4:8]))
+	rest := key[8:]
+	if len(key) == 13 || len(key) == 14 {
+		k.Dimension = int32(binary.LittleEndian.Uint32(rest[0:4]))
+		if k.Dimension != Nether && k.Dimension != TheEnd {
+			return k, false
+		}
+		rest = rest[4:]
+	}
+	k.Tag = rest[0]
+	if !knownChunkTag(k.Tag) {
+		return k, false
+	}
+	switch len(rest) {
+	case 1:
+		return k, k.Tag != ChunkSubChunkPrefix
+	case 2:
+		k.Subchunk = int8(rest[1])
+		return k, k.Tag == ChunkSubChunkPrefix
+	}
+	return k, false
+}
+
+func knownChunkTag(tag byte) bool {
+	return (tag >= ChunkData3D && tag <= ChunkChecksums && tag != 55) || tag == ChunkVersionOld
+}
+
+// Bytes encodes the key as stored in the world database
+func (k ChunkKey) Bytes() []byte {
+	b := k.Pos().prefix()
+	b = append(b, k.Tag)
+	if k.Tag == ChunkSubChunkPrefix {
+		b = append(b, byte(k.Subchunk))
+	}
+	return b
+}
+
+// Pos is the chunk the key belongs to
+func (k ChunkKey) Pos() ChunkPos {
+	return ChunkPos{k.X, k.Z, k.Dimension}
+}
+
+// prefix is the start shared by all of the chunk's record keys, and the suffix of its digp/actor digest key
+func (p ChunkPos) prefix() []byte {
+	b := make([]byte, 8, 12)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(p.X))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(p.Z))
+	if p.Dimension != Overworld {
+		b = b[:12]
+		binary.LittleEndian.PutUint32(b[8:12], uint32(p.Dimension))
+	}
+	return b
+}
+
+// ChunkKeys returns the keys of all records of one chunk
+func (w *BedrockWorld) ChunkKeys(pos ChunkPos) ([]ChunkKey, error) {
+	keys, err := w.Keys(pos.prefix())
+	if err != nil {
+		return nil, err
+	}
+	var chunkKeys []ChunkKey
+	for _, key := range keys {
+		// overworld prefixes also match other dimensions' keys of the same coordinates
+		if k, ok := ParseChunkKey(key); ok && k.Pos() == pos {
+			chunkKeys = append(chunkKeys, k)
+		}
+	}
+	return chunkKeys, nil
+}
+
+// Chunks groups the keys of every chunk record in the world by chunk
+func (w *BedrockWorld) Chunks() (map[ChunkPos][]ChunkKey, error) {
+	keys, err := w.Keys(nil)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make(map[ChunkPos][]ChunkKey)
+	for _, key := range keys {
+		if k, ok := ParseChunkKey(key); ok {
+			chunks[k.Pos()] = append(chunks[k.Pos()], k)
+		}
+	}
+	return chunks, nil
+}
+
+// EntityKeys returns the actorprefix keys of entities the chunk's digp record lists; chunks saved before 1.18.30
+// keep their entities in a ChunkEntity record instead
+func (w *BedrockWorld) EntityKeys(pos ChunkPos) ([][]byte, error) {
+	digest, err := w.Get(append(append([]byte(nil), entityDigestPrefix...), pos.prefix()...))
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for i := 0; i+8 <= len(digest); i += 8 {
+		keys = append(keys, append(append([]byte(nil), actorPrefix...), digest[i:i+8]...))
+	}
+	return keys, nil
+}
+
+// chunkToLua returns a table of one chunk: block entities and entities as tables of tags like the global nbt,
+// subchunks as raw strings by signed y index (-4 and up since 1.18, so pairs rather than ipairs reads them all),
+// and the raw value of every other record by record type. It returns nil if the chunk has no records.
+func (w *BedrockWorld) chunkToLua(pos ChunkPos, L *lua.LState) (*lua.LTable, error) {
+	keys, err := w.ChunkKeys(pos)
+	if err != nil {
+		return nil, err
+	}
+	entityKeys, err := w.EntityKeys(pos)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && len(entityKeys) == 0 {
+		return nil, nil
+	}
+	chunk := L.NewTable()
+	chunk.RawSetString("x", lua.LNumber(pos.X))
+	chunk.RawSetString("z", lua.LNumber(pos.Z))
+	chunk.RawSetString("dimension", lua.LNumber(pos.Dimension))
+	blockEntities := L.NewTable()
+	entities := L.NewTable()
+	subchunks := L.NewTable()
+	records := L.NewTable()
+	chunk.RawSetString("blockEntities", blockEntities)
+	chunk.RawSetString("entities", entities)
+	chunk.RawSetString("subchunks", subchunks)
+	chunk.RawSetString("records", records)
+
+	// appendTags adds the top-level tags of an NBT value to doc
+	appendTags := func(doc *lua.LTable, key []byte) error {
+		tags, err := w.loadDoc(key, L)
+		if err != nil {
+			return fmt.Errorf("chunk %v key %x: %s", pos, key, err.Error())
+		}
+		tags.ForEach(func(_, tag lua.LValue) {
+			doc.Append(tag)
+		})
+		return nil
+	}
+	for _, k := range keys {
+		switch k.Tag {
+		case ChunkBlockEntity:
+			err = appendTags(blockEntities, k.Bytes())
+		case ChunkEntity:
+			err = appendTags(entities, k.Bytes())
+		default:
+			var value []byte
+			if value, err = w.Get(k.Bytes()); err == nil {
+				if k.Tag == ChunkSubChunkPrefix {
+					subchunks.RawSetInt(int(k.Subchunk), lua.LString(value))
+				} else {
+					records.RawSetInt(int(k.Tag), lua.LString(value))
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range entityKeys {
+		if err = appendTags(entities, key); err != nil {
+			return nil, err
+		}
+	}
+	return chunk, nil
+}
+
+// pushChunk pushes the chunk whose x, z and optional dimension are at stack position n on, nothing if it has no
+// records, or nil and an error message
+func pushChunk(L *lua.LState, w *BedrockWorld, n int) int {
+	pos := ChunkPos{int32(L.CheckInt(n)), int32(L.CheckInt(n + 1)), int32(L.OptInt(n+2, 0))}
+	chunk, err := w.chunkToLua(pos, L)
+	if err != nil {
+		return pushError(L, "Error reading chunk", err)
+	}
+	if chunk == nil {
+		return 0
+	}
+	L.Push(chunk)
+	return 1
+}
+
+// world:chunk(x, z, dim) returns a table of the chunk at chunk coordinates x, z in dimension dim (default 0,
+// the overworld), or nil if it has no records
+func worldChunk(L *lua.LState) int {
+	return pushChunk(L, checkWorld(L), 2)
+}
+
+// world:chunks(dim) returns a table of {x, z, dimension} tables of every chunk, optionally only in dimension dim
+func worldChunks(L *lua.LState) int {
+	w := checkWorld(L)
+	onlyDim := L.GetTop() >= 2
+	dim := int32(L.OptInt(2, 0))
+	chunks, err := w.Chunks()
+	if err != nil {
+		return pushError(L, "Error listing chunks", err)
+	}
+	t := L.CreateTable(len(chunks), 0)
+	for pos := range chunks {
+		if onlyDim && pos.Dimension != dim {
+			continue
+		}
+		p := L.NewTable()
+		p.RawSetString("x", lua.LNumber(pos.X))
+		p.RawSetString("z", lua.LNumber(pos.Z))
+		p.RawSetString("dimension", lua.LNumber(pos.Dimension))
+		t.Append(p)
+	}
+	L.Push(t)
+	return 1
+}
+
+// bedrock_chunk(x, z, dim) is world:chunk(x, z, dim) on the world most recently opened with openworld that is still
+// open; bedrock_chunk(w, x, z, dim) is w:chunk(x, z, dim)
+func bedrockChunk(L *lua.LState) int {
+	if L.Get(1).Type() == lua.LTUserData {
+		return pushChunk(L, checkWorld(L), 2)
+	}
+	open := getConfig(L).openWorlds()
+	if len(open) == 0 {
+		return pushError(L, "Error reading chunk", errors.New("no world open; use openworld(path) first"))
+	}
+	return pushChunk(L, open[len(open)-1], 1)
+}
+
+// chunk_key(x, z, dim, tag, subchunk) returns the database key of a chunk record as a string
+func chunkKey(L *lua.LState) int {
+	k := ChunkKey{
+		X:         int32(L.CheckInt(1)),
+		Z:         int32(L.CheckInt(2)),
+		Dimension: int32(L.OptInt(3, 0)),
+		Tag:       byte(L.CheckInt(4)),
+		Subchunk:  int8(L.OptInt(5, 0)),
+	}
+	L.Push(lua.LString(k.Bytes()))
+	return 1
+}
+
+// parse_chunk_key(key) returns a table of x, z, dimension, tag and subchunk, or nil if key isn't a chunk key
+func parseChunkKey(L *lua.LState) int {
+	k, ok := ParseChunkKey([]byte(L.CheckString(1)))
+	if !ok {
+		return 0
+	}
+	t := L.NewTable()
+	t.RawSetString("x", lua.LNumber(k.X))
+	t.RawSetString("z", lua.LNumber(k.Z))
+	t.RawSetString("dimension", lua.LNumber(k.Dimension))
+	t.RawSetString("tag", lua.LNumber(k.Tag))
+	if k.Tag == ChunkSubChunkPrefix {
+		t.RawSetString("subchunk", lua.LNumber(k.Subchunk))
+	}
+	L.Push(t)
+	return 1
+}
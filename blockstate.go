@@ -0,0 +1,305 @@
+package nlua
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// blockState is a block name and its properties, written like "minecraft:oak_stairs[facing=north,half=bottom]"
+type blockState struct {
+	name       string
+	properties []blockProperty
+}
+
+// blockProperty is one block state property. Java Edition stores every value as a string; Bedrock Edition
+// stores them as byte (1), int (3) or string (8) tags, so tagType remembers which.
+type blockProperty struct {
+	name, value string
+	tagType     byte
+}
+
+// parseBlockState reads a block state string; a name without a namespace gets "minecraft:"
+func parseBlockState(s string) (blockState, error) {
+	var b blockState
+	s = strings.TrimSpace(s)
+	name, props := s, ""
+	if i := strings.IndexByte(s, '['); i >= 0 {
+		if !strings.HasSuffix(s, "]") {
+			return b, fmt.Errorf("block state '%s' is missing ']'", s)
+		}
+		name, props = s[:i], s[i+1:len(s)-1]
+	}
+	if name == "" {
+		return b, fmt.Errorf("block state '%s' has no name", s)
+	}
+	if !strings.Contains(name, ":") {
+		name = "minecraft:" + name
+	}
+	b.name = name
+	if props != "" {
+		for _, prop := range strings.Split(props, ",") {
+			kv := strings.SplitN(prop, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return b, fmt.Errorf("block state '%s' property '%s' is not name=value", s, prop)
+			}
+			b.properties = append(b.properties, blockProperty{strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]), 8})
+		}
+	}
+	b.sort()
+	return b, nil
+}
+
+func (b *blockState) sort() {
+	sort.Slice(b.properties, func(i, j int) bool { return b.properties[i].name < b.properties[j].name })
+}
+
+// String formats the state with properties in name order, so equal states give equal strings
+func (b blockState) String() string {
+	if len(b.properties) == 0 {
+		return b.name
+	}
+	props := make([]string, len(b.properties))
+	for i, p := range b.properties {
+		props[i] = p.name + "=" + p.value
+	}
+	return b.name + "[" + strings.Join(props, ",") + "]"
+}
+
+// property returns the value of the named property and whether it is present
+func (b blockState) property(name string) (string, bool) {
+	for _, p := range b.properties {
+		if p.name == name {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+// withProperty returns a copy of b with the named property set to value, keeping its tag type
+func (b blockState) withProperty(name, value string) blockState {
+	c := blockState{name: b.name, properties: append([]blockProperty(nil), b.properties...)}
+	for i := range c.properties {
+		if c.properties[i].name == name {
+			c.properties[i].value = value
+			return c
+		}
+	}
+	c.properties = append(c.properties, blockProperty{name, value, 8})
+	c.sort()
+	return c
+}
+
+// javaBlockState reads a Java Edition palette entry: a compound value with a Name string and a Properties compound
+func javaBlockState(L *lua.LState, entry *lua.LTable) blockState {
+	var b blockState
+	if name, ok := findValue(L, entry, "Name", 8).(lua.LString); ok {
+		b.name = string(name)
+	}
+	if props := findCompound(L, entry, "Properties"); props != nil {
+		props.ForEach(func(_, v lua.LValue) {
+			if tag, ok := v.(*lua.LTable); ok {
+				name, _ := tag.RawGetString("name").(lua.LString)
+				b.properties = append(b.properties, blockProperty{string(name), lua.LVAsString(tagValue(L, tag)), 8})
+			}
+		})
+	}
+	b.sort()
+	return b
+}
+
+// javaCompound returns b as a Java Edition palette entry compound value
+func (b blockState) javaCompound(L *lua.LState) *lua.LTable {
+	entry := L.NewTable()
+	entry.Append(newTag(L, 8, "Name", lua.LString(b.name)))
+	if len(b.properties) > 0 {
+		props := L.NewTable()
+		for _, p := range b.properties {
+			props.Append(newTag(L, 8, p.name, lua.LString(p.value)))
+		}
+		entry.Append(newTag(L, 10, "Properties", props))
+	}
+	return entry
+}
+
+// Horizontal directions in clockwise order, seen from above
+var horizontalDirections = []string{"north", "east", "south", "west"}
+
+// Bedrock Edition properties that hold a direction as a number
+var numberedDirections = map[string][]string{
+	"facing_direction": {"down", "up", "north", "south", "west", "east"},
+	"direction":        {"south", "west", "north", "east"},
+	"weirdo_direction": {"east", "west", "south", "north"},
+}
+
+func rotateDirection(d string, turns int) string {
+	for i, h := range horizontalDirections {
+		if d == h {
+			return horizontalDirections[(i+turns)&3]
+		}
+	}
+	return d
+}
+
+// mirrorDirection flips a direction across axis: "x" swaps east and west, "z" north and south
+func mirrorDirection(d, axis string) string {
+	pairs := map[string]string{"east": "west", "west": "east"}
+	if axis == "z" {
+		pairs = map[string]string{"north": "south", "south": "north"}
+	}
+	if m, ok := pairs[d]; ok {
+		return m
+	}
+	return d
+}
+
+func isHorizontal(d string) bool {
+	return d == "north" || d == "east" || d == "south" || d == "west"
+}
+
+// mapDirections applies f to each direction word of a value like "north", "ascending_east" or "south_west",
+// keeping two-direction rail shapes in their usual spelling
+func mapDirections(value string, f func(string) string) string {
+	words := strings.Split(value, "_")
+	for i := range words {
+		words[i] = f(words[i])
+	}
+	if len(words) == 2 && isHorizontal(words[0]) && isHorizontal(words[1]) {
+		ns := func(d string) bool { return d == "north" || d == "south" }
+		switch {
+		case ns(words[0]) && ns(words[1]):
+			return "north_south"
+		case !ns(words[0]) && !ns(words[1]):
+			return "east_west"
+		case !ns(words[0]):
+			words[0], words[1] = words[1], words[0]
+		}
+	}
+	return strings.Join(words, "_")
+}
+
+// transformed returns b with its directional properties changed by f: f maps direction names, swapAxes swaps
+// x and z axis values, rotation maps 0-15 sign rotations and swapHands swaps left and right
+func (b blockState) transformed(f func(string) string, swapAxes bool, rotation func(int) int, swapHands bool) blockState {
+	c := blockState{name: b.name, properties: make([]blockProperty, len(b.properties))}
+	for i, p := range b.properties {
+		n, err := strconv.Atoi(p.value)
+		switch {
+		case isHorizontal(p.name) && p.tagType == 8:
+			// fences, walls, redstone and the like name a property after each side
+			p.name = f(p.name)
+		case p.name == "axis" || p.name == "pillar_axis":
+			if swapAxes && p.value == "x" {
+				p.value = "z"
+			} else if swapAxes && p.value == "z" {
+				p.value = "x"
+			}
+		case p.name == "rotation" || p.name == "ground_sign_direction":
+			if err == nil {
+				p.value = strconv.Itoa(rotation(n) & 15)
+			}
+		case numberedDirections[p.name] != nil:
+			names := numberedDirections[p.name]
+			if err == nil && n >= 0 && n < len(names) {
+				d := f(names[n])
+				for k, name := range names {
+					if name == d {
+						p.value = strconv.Itoa(k)
+					}
+				}
+			}
+		case p.name == "hinge" || p.name == "shape":
+			if swapHands {
+				switch {
+				case strings.HasSuffix(p.value, "left"):
+					p.value = strings.TrimSuffix(p.value, "left") + "right"
+				case strings.HasSuffix(p.value, "right"):
+					p.value = strings.TrimSuffix(p.value, "right") + "left"
+				}
+			}
+			p.value = mapDirections(p.value, f)
+		default:
+			p.value = mapDirections(p.value, f)
+		}
+		c.properties[i] = p
+	}
+	c.sort()
+	return c
+}
+
+// rotated returns b turned clockwise, seen from above, by turns quarter turns
+func (b blockState) rotated(turns int) blockState {
+	turns &= 3
+	return b.transformed(func(d string) string { return rotateDirection(d, turns) }, turns&1 == 1,
+		func(r int) int { return r + 4*turns }, false)
+}
+
+// mirrored returns b flipped across axis "x" (east and west swap) or "z" (north and south swap)
+func (b blockState) mirrored(axis string) blockState {
+	return b.transformed(func(d string) string { return mirrorDirection(d, axis) }, false,
+		func(r int) int {
+			if axis == "x" {
+				return 16 - r
+			}
+			return 24 - r
+		}, true)
+}
+
+// bedrockBlockState reads a Bedrock Edition block state compound value: a name string and a states compound of
+// byte, int and string tags. Byte states are booleans and read as "true" or "false".
+func bedrockBlockState(L *lua.LState, entry *lua.LTable) blockState {
+	var b blockState
+	if name, ok := findValue(L, entry, "name", 8).(lua.LString); ok {
+		b.name = string(name)
+	}
+	if states := findCompound(L, entry, "states"); states != nil {
+		states.ForEach(func(_, v lua.LValue) {
+			if tag, ok := v.(*lua.LTable); ok {
+				name, _ := tag.RawGetString("name").(lua.LString)
+				p := blockProperty{string(name), lua.LVAsString(tagValue(L, tag)), tagType(tag)}
+				if p.tagType == 1 {
+					p.value = strconv.FormatBool(lua.LVAsNumber(tagValue(L, tag)) != 0)
+				}
+				b.properties = append(b.properties, p)
+			}
+		})
+	}
+	b.sort()
+	return b
+}
+
+// bedrockCompound returns b as a Bedrock Edition block state compound value with the given block version.
+// Properties parsed from strings become bytes if "true" or "false", ints if numbers and strings otherwise.
+func (b blockState) bedrockCompound(L *lua.LState, version int) *lua.LTable {
+	states := L.NewTable()
+	for _, p := range b.properties {
+		t := p.tagType
+		if t == 8 {
+			if p.value == "true" || p.value == "false" {
+				t = 1
+			} else if _, err := strconv.Atoi(p.value); err == nil {
+				t = 3
+			}
+		}
+		var value lua.LValue = lua.LString(p.value)
+		switch t {
+		case 1:
+			value = lua.LNumber(0)
+			if p.value == "true" || p.value == "1" {
+				value = lua.LNumber(1)
+			}
+		case 3:
+			n, _ := strconv.Atoi(p.value)
+			value = lua.LNumber(n)
+		}
+		states.Append(newTag(L, t, p.name, value))
+	}
+	entry := L.NewTable()
+	entry.Append(newTag(L, 8, "name", lua.LString(b.name)))
+	entry.Append(newTag(L, 10, "states", states))
+	entry.Append(newTag(L, 3, "version", lua.LNumber(version)))
+	return entry
+}
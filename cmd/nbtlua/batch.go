@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// batchResult is the outcome of running the script on one file
+type batchResult struct {
+	path string
+	err  error
+}
+
+// compileScript parses and compiles a script file once, so each worker can run it without reparsing
+func compileScript(path string) (*lua.FunctionProto, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(bufio.NewReader(f), path)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, path)
+}
+
+// runBatch runs the compiled script once for each file matching pattern, on the given number of workers, and
+// returns the exit status: 0 if every file succeeded. Each file gets a fresh LState made with opts, with arg set,
+// the modules required as for -l, the file loaded into nbt as by loadnbt and its path in nbt_path, so nothing a
+// script sets carries over to the next file. A line is printed per file as it finishes, then a summary.
+//
+// memMb limits the memory of the whole process, as gopher-lua measures it; when it is exceeded the scripts running
+// at the time fail instead of the process exiting.
+func runBatch(pattern string, proto *lua.FunctionProto, args []string, workers int, timeout time.Duration,
+	opts []nlua.Option, modules []string, memMb int) int {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error in -each pattern:", err)
+		return 1
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "No files match '%s'\n", pattern)
+		return 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	// each state needs its own encoding, which use_*_encoding and -auto change; the memory limit is watched once
+	// for the process rather than by every state
+	opts = append([]nlua.Option{nlua.StateEncoding(nlua.JavaEncoding)}, opts...)
+	opts = append(opts, nlua.MemoryLimit(memMb), nlua.SharedMemoryLimit())
+	watch := newMemoryWatch(memMb)
+	defer watch.close()
+	jobs := make(chan string)
+	results := make(chan batchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				results <- batchResult{path, runFile(path, proto, args, opts, modules, timeout, watch)}
+			}
+		}()
+	}
+	go func() {
+		for _, path := range paths {
+			jobs <- path
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var failed []batchResult
+	for r := range results {
+		if r.err != nil {
+			fmt.Printf("FAIL %s: %v\n", r.path, r.err)
+			failed = append(failed, r)
+		} else {
+			fmt.Printf("ok   %s\n", r.path)
+		}
+	}
+	fmt.Printf("%d files: %d succeeded, %d failed\n", len(paths), len(paths)-len(failed), len(failed))
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].path < failed[j].path })
+		for _, r := range failed {
+			fmt.Println("  failed:", r.path)
+		}
+		return 1
+	}
+	return 0
+}
+
+// runFile runs the script on path in a new LState; the timeout applies to each file separately
+func runFile(path string, proto *lua.FunctionProto, args []string, opts []nlua.Option, modules []string,
+	timeout time.Duration, watch *memoryWatch) error {
+	L := nlua.NewState(opts...)
+	defer nlua.CloseState(L)
+	argtb := L.NewTable()
+	for i, a := range args {
+		L.RawSet(argtb, lua.LNumber(i+1), lua.LString(a))
+	}
+	L.SetGlobal("arg", argtb)
+	if err := requireModules(L, modules); err != nil {
+		return err
+	}
+	data, err := nlua.ReadFile(L, path)
+	if err != nil {
+		return err
+	}
+	if err := nlua.LoadNbt(data, L); err != nil {
+		return err
+	}
+	L.SetGlobal("nbt_path", lua.LString(path))
+	L.GetGlobal("nbt").(*lua.LTable).RawSetString("path", lua.LString(path))
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, run := watch.start(ctx)
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(proto))
+	err = L.PCall(0, 0, nil)
+	if watch.stop(run) {
+		return fmt.Errorf("memory limit of %d MB exceeded", watch.mb)
+	}
+	if err == nil {
+		// a failed load or save fails the file even if the script carried on
+		err = nlua.LoadError(L)
+	}
+	if err == nil {
+		err = nlua.SaveError(L)
+	}
+	return err
+}
+
+// memoryWatch does what gopher-lua's SetMx does for a single state, polling the process's memory use, but for
+// the whole batch, cancelling the scripts running when the limit is exceeded
+type memoryWatch struct {
+	mb      int
+	mu      sync.Mutex
+	running map[*watchedRun]bool
+	done    chan struct{}
+}
+
+// watchedRun is one script run under a memoryWatch
+type watchedRun struct {
+	cancel   context.CancelFunc
+	exceeded bool
+}
+
+// newMemoryWatch starts watching for a limit of mb; 0 is no limit, and the nil watch returned does nothing
+func newMemoryWatch(mb int) *memoryWatch {
+	if mb <= 0 {
+		return nil
+	}
+	w := &memoryWatch{mb: mb, running: map[*watchedRun]bool{}, done: make(chan struct{})}
+	go w.poll()
+	return w
+}
+
+func (w *memoryWatch) poll() {
+	limit := uint64(w.mb) * 1024 * 1024
+	var s runtime.MemStats
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		runtime.ReadMemStats(&s)
+		if s.Alloc < limit {
+			continue
+		}
+		w.mu.Lock()
+		for run := range w.running {
+			run.exceeded = true
+			run.cancel()
+		}
+		w.mu.Unlock()
+		runtime.GC()
+	}
+}
+
+func (w *memoryWatch) close() {
+	if w != nil {
+		close(w.done)
+	}
+}
+
+// start returns a context for a run that the watch cancels if the limit is exceeded before stop
+func (w *memoryWatch) start(ctx context.Context) (context.Context, *watchedRun) {
+	if w == nil {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	run := &watchedRun{cancel: cancel}
+	w.mu.Lock()
+	w.running[run] = true
+	w.mu.Unlock()
+	return ctx, run
+}
+
+// stop ends a run, reporting whether the limit was exceeded during it
+func (w *memoryWatch) stop(run *watchedRun) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.running, run)
+	run.cancel()
+	return run.exceeded
+}
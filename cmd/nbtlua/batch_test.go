@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// writeBatchFiles writes a script and files holding compound "" containing int "n" = 5 into dir, returning the
+// compiled script
+func writeBatchFiles(t *testing.T, dir, script string, names ...string) *lua.FunctionProto {
+	t.Helper()
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{10, 0, 0, 3, 0, 1, 'n', 0, 0, 0, 5, 0}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "script.lua")
+	if err := ioutil.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	proto, err := compileScript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proto
+}
+
+func TestBatchSandbox(t *testing.T) {
+	allowed, err := ioutil.TempDir("", "nbtlua-allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(allowed)
+	outside, err := ioutil.TempDir("", "nbtlua-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	proto := writeBatchFiles(t, outside, `assert(nbt[1].value[1].value == 5)`, "a.dat")
+	opts := []nlua.Option{nlua.Sandbox(allowed)}
+	if status := runBatch(filepath.Join(outside, "*.dat"), proto, nil, 1, 0, opts, nil, 0); status != 1 {
+		t.Errorf("a file outside the allowed directory expected to fail the batch, got status %d", status)
+	}
+}
+
+// captureStdout returns what f prints to standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
+
+func TestBatchStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbtlua-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// globals don't carry over between files, and b.dat fails
+	proto := writeBatchFiles(t, dir, `
+		assert(seen == nil)
+		seen = true
+		if nbt_path:find("b.dat$") then error("bad file") end
+		nbt[1].value[1].value = 6
+		savenbt()
+	`, "a.dat", "b.dat", "c.dat")
+	var status int
+	out := captureStdout(t, func() {
+		status = runBatch(filepath.Join(dir, "*.dat"), proto, nil, 2, 0, nil, nil, 0)
+	})
+	if status != 1 {
+		t.Errorf("expected status 1, got %d", status)
+	}
+	for _, line := range []string{
+		"ok   " + filepath.Join(dir, "a.dat") + "\n",
+		"FAIL " + filepath.Join(dir, "b.dat") + ": ",
+		"3 files: 2 succeeded, 1 failed\n  failed: " + filepath.Join(dir, "b.dat") + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected %q in output:\n%s", line, out)
+		}
+	}
+	for name, n := range map[string]byte{"a.dat": 6, "b.dat": 5, "c.dat": 6} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, name)); len(got) != 12 || got[10] != n {
+			t.Errorf("%s: expected n = %d, got %v", name, n, got)
+		}
+	}
+
+	// every file succeeding exits with 0; a failed loadnbt or savenbt fails the file even if the script carries on
+	for script, want := range map[string]int{
+		`assert(nbt_path)`:                  0,
+		`loadnbt(nbt_path .. ".missing")`:   1,
+		`savenbt(nbt_path .. "/not/a/dir")`: 1,
+	} {
+		proto := writeBatchFiles(t, dir, script)
+		captureStdout(t, func() {
+			status = runBatch(filepath.Join(dir, "*.dat"), proto, nil, 2, 0, nil, nil, 0)
+		})
+		if status != want {
+			t.Errorf("%s: expected status %d, got %d", script, want, status)
+		}
+	}
+	if status := runBatch(filepath.Join(dir, "*.none"), proto, nil, 2, 0, nil, nil, 0); status != 1 {
+		t.Errorf("no matching files expected status 1, got %d", status)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Converters between the global nbt variable and each file format
+var decoders = map[string]func([]byte, *lua.LState) error{
+	"nbt":  nlua.Nbt2Lua,
+	"snbt": nlua.Snbt2Lua,
+	"json": nlua.Json2Lua,
+}
+
+var encoders = map[string]func(*lua.LState) ([]byte, error){
+	"nbt":  nlua.Lua2Nbt,
+	"snbt": nlua.Lua2Snbt,
+	"json": nlua.Lua2Json,
+}
+
+// parseInterspersed parses flags that may come before, between or after positional arguments, and returns the
+// positional arguments. Negative numbers are positional, so they can be values; "--" ends the flags.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var flags, positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if _, err := strconv.ParseFloat(arg, 64); len(arg) < 2 || arg[0] != '-' || err == nil {
+			positional = append(positional, arg)
+			continue
+		}
+		flags = append(flags, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := fs.Lookup(name); f != nil && i+1 < len(args) {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+				flags = append(flags, args[i])
+			}
+		}
+	}
+	return positional, fs.Parse(flags)
+}
+
+// formatOf returns format if given, otherwise the format implied by path's extension
+func formatOf(path, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".snbt":
+			return "snbt", nil
+		case ".json":
+			return "json", nil
+		}
+		return "nbt", nil
+	}
+	if decoders[format] == nil {
+		return "", fmt.Errorf("unknown format '%s'; expected nbt, snbt or json", format)
+	}
+	return format, nil
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// writeOutput writes b to path as savenbt does, keeping backups previous versions, or to standard output for "-"
+func writeOutput(path string, b []byte, backups int) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return nlua.WriteFile(path, b, backups)
+}
+
+// parseEncodingFlag reads an encoding flag's value, which may also be "auto" for detecting the encoding, which
+// is Java until then
+func parseEncodingFlag(s string) (nlua.Encoding, bool, error) {
+	if s == "auto" {
+		return nlua.JavaEncoding, true, nil
+	}
+	e, err := nlua.ParseEncoding(s)
+	return e, false, err
+}
+
+// convertMain runs `nbtlua convert [options] in out`
+func convertMain(args []string) int {
+	var opt_from, opt_to, opt_inenc, opt_outenc, opt_compress string
+	var opt_maxdepth int
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.StringVar(&opt_from, "from", "", "")
+	fs.StringVar(&opt_to, "to", "", "")
+	fs.StringVar(&opt_inenc, "in-encoding", "auto", "")
+	fs.StringVar(&opt_outenc, "out-encoding", "", "")
+	fs.StringVar(&opt_compress, "compress", "", "")
+	fs.IntVar(&opt_maxdepth, "maxdepth", nlua.MaxNbtDepth, "")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: nbtlua convert [options] in out
+Converts between binary NBT, SNBT and JSON; '-' is standard input or output.
+Available options are:
+  -from format, -to format
+           nbt, snbt or json; by default snbt for .snbt files, json for
+           .json files and nbt otherwise
+  -in-encoding encoding
+           java, bedrock or network binary NBT input, or auto to detect it,
+           preferring java when unsure (default auto)
+  -out-encoding encoding
+           java, bedrock or network binary NBT output (default the input
+           encoding)
+  -compress compression
+           gzip, zlib or none; compressed input is detected. By default
+           nbt to nbt keeps the input's compression, and anything else is
+           uncompressed
+A Bedrock level.dat header is removed from nbt input and written back to
+nbt output.
+  -maxdepth n
+           maximum compound/list nesting, 0 for none (default %d)
+`, nlua.MaxNbtDepth)
+	}
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(paths) != 2 {
+		fs.Usage()
+		return 2
+	}
+	in, out := paths[0], paths[1]
+	status, err := convert(in, out, opt_from, opt_to, opt_inenc, opt_outenc, opt_compress, opt_maxdepth)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error converting:", err)
+	}
+	return status
+}
+
+func convert(in, out, from, to, inEncoding, outEncoding, compress string, maxDepth int) (int, error) {
+	from, err := formatOf(in, from)
+	if err != nil {
+		return 2, err
+	}
+	to, err = formatOf(out, to)
+	if err != nil {
+		return 2, err
+	}
+	inEnc, auto, err := parseEncodingFlag(inEncoding)
+	if err != nil {
+		return 2, err
+	}
+	var outEnc nlua.Encoding
+	if outEncoding != "" {
+		if outEnc, err = nlua.ParseEncoding(outEncoding); err != nil {
+			return 2, err
+		}
+	}
+	var outCompression nlua.Compression
+	if compress != "" {
+		if outCompression, err = nlua.ParseCompression(compress); err != nil {
+			return 2, err
+		}
+	}
+
+	data, err := readInput(in)
+	if err != nil {
+		return 1, err
+	}
+
+	opts := []nlua.Option{nlua.MaxDepth(maxDepth), nlua.MemoryLimit(0), nlua.StateEncoding(inEnc)}
+	if auto {
+		opts = append(opts, nlua.AutoEncoding())
+	}
+	L := nlua.NewState(opts...)
+	defer L.Close()
+	if from == "nbt" {
+		// as loadnbt does, which also removes a Bedrock level.dat header, recording it in nbt.header_version
+		err = nlua.LoadNbt(data, L)
+	} else {
+		err = decoders[from](data, L)
+	}
+	if err != nil {
+		return 1, err
+	}
+	if to == "nbt" {
+		// as savenbt() does, in the output encoding and compression, putting back a level.dat header
+		doc := L.GetGlobal("nbt").(*lua.LTable)
+		if outEncoding != "" {
+			doc.RawSetString("encoding", lua.LString(outEnc.String()))
+		}
+		if compress != "" || from != "nbt" {
+			doc.RawSetString("compression", lua.LString(outCompression.String()))
+		}
+		data, err = nlua.SaveNbt(L)
+	} else if data, err = encoders[to](L); err == nil {
+		data, err = nlua.Compress(data, outCompression)
+	}
+	if err != nil {
+		return 1, err
+	}
+	if err := writeOutput(out, data, 0); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
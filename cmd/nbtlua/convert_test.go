@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+)
+
+func TestConvertLevelDat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbtlua-convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a Bedrock level.dat: storage version 10 and length header, then compound "" containing int "n" = 5
+	level := []byte{10, 0, 0, 0, 12, 0, 0, 0, 10, 0, 0, 3, 1, 0, 'n', 5, 0, 0, 0, 0}
+	in := filepath.Join(dir, "level.dat")
+	if err := ioutil.WriteFile(in, level, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snbt := filepath.Join(dir, "level.snbt")
+	if _, err := convert(in, snbt, "", "", "auto", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(snbt); !strings.Contains(string(got), "n:5") {
+		t.Errorf("expected the header removed, got %s", got)
+	}
+
+	out := filepath.Join(dir, "copy.dat")
+	if _, err := convert(in, out, "", "", "auto", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(out); !bytes.Equal(got, level) {
+		t.Errorf("expected the header written back\nexpected %v\ngot      %v", level, got)
+	}
+}
+
+func TestConvertFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbtlua-convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// compound "" containing int "n" = 5 and string "s" = "a", in Java Edition's big endian encoding
+	plain := []byte{10, 0, 0, 3, 0, 1, 'n', 0, 0, 0, 5, 8, 0, 1, 's', 0, 1, 'a', 0}
+	gzipped, err := nlua.Compress(plain, nlua.Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := filepath.Join(dir, "in.dat")
+	if err := ioutil.WriteFile(in, gzipped, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// binary NBT to SNBT to JSON and back to gzipped binary NBT
+	snbt := filepath.Join(dir, "x.snbt")
+	if _, err := convert(in, snbt, "", "", "auto", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(snbt); !strings.Contains(string(got), "n:5") || !strings.Contains(string(got), "s:a") {
+		t.Errorf("unexpected SNBT %s", got)
+	}
+	js := filepath.Join(dir, "x.json")
+	if _, err := convert(snbt, js, "", "", "auto", "", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	var doc []map[string]interface{}
+	if got, _ := ioutil.ReadFile(js); json.Unmarshal(got, &doc) != nil || len(doc) != 1 || doc[0]["tagType"] != 10.0 {
+		t.Errorf("unexpected JSON %s", got)
+	}
+	back := filepath.Join(dir, "back.dat")
+	if _, err := convert(js, back, "", "", "auto", "", "gzip", 0); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(back)
+	if b, c, err := nlua.Decompress(got); err != nil || c != nlua.Gzip || !bytes.Equal(b, plain) {
+		t.Errorf("expected gzipped %v, got %v %v, %v", plain, c, b, err)
+	}
+
+	// -to overrides the extension, and -out-encoding changes the byte order
+	bedrock := filepath.Join(dir, "bedrock.txt")
+	if _, err := convert(js, bedrock, "", "nbt", "auto", "bedrock", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{10, 0, 0, 3, 1, 0, 'n', 5, 0, 0, 0, 8, 1, 0, 's', 1, 0, 'a', 0}
+	if got, _ := ioutil.ReadFile(bedrock); !bytes.Equal(got, want) {
+		t.Errorf("expected little endian %v, got %v", want, got)
+	}
+
+	// unparsable input fails with status 1 and leaves no output
+	bad := filepath.Join(dir, "bad.snbt")
+	if err := ioutil.WriteFile(bad, []byte("{n:"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := convert(bad, filepath.Join(dir, "bad.dat"), "", "", "auto", "", "", 0); status != 1 || err == nil {
+		t.Errorf("expected status 1 and an error, got %d, %v", status, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.dat")); !os.IsNotExist(err) {
+		t.Error("a failed conversion wrote output")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// nbtFile is a binary NBT file loaded into an LState, which remembers how to save it back the same way
+type nbtFile struct {
+	L    *lua.LState
+	path string
+	// the file as read, to compare with for -dry-run
+	data []byte
+}
+
+// loadFile decodes path into a new LState's nbt global as loadnbt does, keeping any data after the root tag to
+// save back. With auto, the encoding is detected, preferring encoding.
+func loadFile(path string, encoding nlua.Encoding, auto bool) (*nbtFile, error) {
+	data, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	opts := []nlua.Option{nlua.MemoryLimit(0), nlua.Roots(nlua.RootsKeepTrailing), nlua.StateEncoding(encoding)}
+	if auto {
+		opts = append(opts, nlua.AutoEncoding())
+	}
+	f := &nbtFile{L: nlua.NewState(opts...), path: path, data: data}
+	if err := nlua.LoadNbt(data, f.L); err != nil {
+		f.L.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *nbtFile) save(backups int) error {
+	data, err := nlua.SaveNbt(f.L)
+	if err != nil {
+		return err
+	}
+	return writeOutput(f.path, data, backups)
+}
+
+// editMain runs `nbtlua get|set|delete [options] file path [value]`
+func editMain(command string, args []string) int {
+	var opt_encoding, opt_type string
+	var opt_backups int
+	var opt_dryrun bool
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.StringVar(&opt_encoding, "encoding", "auto", "")
+	fs.IntVar(&opt_backups, "backups", 0, "")
+	fs.BoolVar(&opt_dryrun, "dry-run", false, "")
+	nargs := 2
+	if command == "set" {
+		fs.StringVar(&opt_type, "type", "", "")
+		nargs = 3
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: nbtlua get [options] file path
+       nbtlua set [options] file path value
+       nbtlua delete [options] file path
+'get' prints the SNBT of the tag at 'path', 'set' changes or adds it, and
+'delete' removes it. Paths are tag names separated by dots, with [n] for list
+and array elements counting from 0, like Inventory[0].id; double quote names
+with dots or brackets. The file keeps its compression and encoding; '-' reads
+standard input and writes the changed file to standard output.
+Available options are:
+  -encoding encoding
+           java, bedrock or network, or auto to detect it, preferring java
+           when unsure (default auto)
+  -backups n
+           for 'set' and 'delete': keep the previous n versions of the
+           file as file.bak, file.bak.1, ... (default 0)
+  -dry-run for 'set' and 'delete': print the change instead of writing it
+  -type type
+           for 'set': byte, short, int, long, float, double, string,
+           byte_array, int_array, long_array, list or compound. By default
+           an existing tag keeps its type and a new one's is read from
+           'value' as SNBT`)
+	}
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(args) != nargs {
+		fs.Usage()
+		return 2
+	}
+	encoding, auto, err := parseEncodingFlag(opt_encoding)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var tagType byte
+	if opt_type != "" {
+		if tagType, err = nlua.ParseTagType(opt_type); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	f, err := loadFile(args[0], encoding, auto)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading file:", err)
+		return 1
+	}
+	defer f.L.Close()
+	switch command {
+	case "get":
+		_, snbt, err := nlua.GetPath(f.L, args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(snbt)
+		return 0
+	case "set":
+		err = nlua.SetPath(f.L, args[1], args[2], tagType)
+	case "delete":
+		err = nlua.DeletePath(f.L, args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if opt_dryrun {
+		changes, err := nlua.DiffNbt(f.L, f.data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error comparing file:", err)
+			return 1
+		}
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		return 0
+	}
+	if err := f.save(opt_backups); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing file:", err)
+		return 1
+	}
+	return 0
+}
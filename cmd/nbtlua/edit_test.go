@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+)
+
+func TestEditKeepsFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbtlua-edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []struct {
+		name        string
+		compression nlua.Compression
+		// compound "" containing int "n" = 5 and string "s" = "a" as stored, then with n = 7 and no s
+		plain, want []byte
+	}{
+		{"java.dat", nlua.Gzip,
+			[]byte{10, 0, 0, 3, 0, 1, 'n', 0, 0, 0, 5, 8, 0, 1, 's', 0, 1, 'a', 0},
+			[]byte{10, 0, 0, 3, 0, 1, 'n', 0, 0, 0, 7, 0}},
+		{"bedrock.dat", nlua.Zlib,
+			[]byte{10, 0, 0, 3, 1, 0, 'n', 5, 0, 0, 0, 8, 1, 0, 's', 1, 0, 'a', 0},
+			[]byte{10, 0, 0, 3, 1, 0, 'n', 7, 0, 0, 0, 0}},
+		// a Bedrock level.dat: storage version 10 and length header
+		{"level.dat", nlua.NoCompression,
+			[]byte{10, 0, 0, 0, 19, 0, 0, 0, 10, 0, 0, 3, 1, 0, 'n', 5, 0, 0, 0, 8, 1, 0, 's', 1, 0, 'a', 0},
+			[]byte{10, 0, 0, 0, 12, 0, 0, 0, 10, 0, 0, 3, 1, 0, 'n', 7, 0, 0, 0, 0}},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		data, err := nlua.Compress(f.plain, f.compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// a dry run and a failed edit leave the file alone
+		if status := editMain("set", []string{path, "n", "7", "-dry-run"}); status != 0 {
+			t.Errorf("%s: dry run exited with %d", f.name, status)
+		}
+		if status := editMain("delete", []string{path, "missing"}); status != 1 {
+			t.Errorf("%s: deleting a missing tag expected status 1, got %d", f.name, status)
+		}
+		if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, data) {
+			t.Errorf("%s: changed by a dry run or failed edit", f.name)
+		}
+
+		if status := editMain("set", []string{path, "n", "7"}); status != 0 {
+			t.Errorf("%s: set exited with %d", f.name, status)
+		}
+		if status := editMain("delete", []string{path, "s"}); status != 0 {
+			t.Errorf("%s: delete exited with %d", f.name, status)
+		}
+		got, _ := ioutil.ReadFile(path)
+		plain, c, err := nlua.Decompress(got)
+		if err != nil || c != f.compression || !bytes.Equal(plain, f.want) {
+			t.Errorf("%s: expected %v %v, got %v %v, %v", f.name, f.compression, f.want, c, plain, err)
+		}
+
+		if status := editMain("get", []string{path, "n"}); status != 0 {
+			t.Errorf("%s: get exited with %d", f.name, status)
+		}
+		if status := editMain("get", []string{path, "s"}); status != 1 {
+			t.Errorf("%s: getting a deleted tag expected status 1, got %d", f.name, status)
+		}
+	}
+}
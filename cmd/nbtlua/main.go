@@ -4,7 +4,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/chzyer/readline"
 	nlua "github.com/midnightfreddie/nbt-go-lua"
@@ -16,22 +21,115 @@ func main() {
 	os.Exit(mainAux())
 }
 
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 func mainAux() int {
-	var opt_e string
-	var opt_i, opt_v bool
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		return convertMain(os.Args[2:])
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "get" || os.Args[1] == "set" || os.Args[1] == "delete") {
+		return editMain(os.Args[1], os.Args[2:])
+	}
+	var opt_e, opt_roots, opt_each string
+	var opt_i, opt_v, opt_sandbox, opt_lazy, opt_compact, opt_offsets, opt_dryrun, opt_verify, opt_stdin bool
+	var opt_java, opt_bedrock, opt_network, opt_auto bool
+	var opt_allow, opt_l stringList
+	var opt_mem, opt_maxdepth, opt_j, opt_backups int
+	var opt_timeout time.Duration
 	flag.StringVar(&opt_e, "e", "", "")
-	// flag.StringVar(&opt_l, "l", "", "")
+	flag.IntVar(&opt_mem, "mem", nlua.MemoryLimitMb, "")
+	flag.IntVar(&opt_maxdepth, "maxdepth", nlua.MaxNbtDepth, "")
+	flag.DurationVar(&opt_timeout, "timeout", 0, "")
+	flag.StringVar(&opt_roots, "roots", "stream", "")
+	flag.IntVar(&opt_backups, "backups", 0, "")
+	flag.BoolVar(&opt_dryrun, "dry-run", false, "")
+	flag.BoolVar(&opt_verify, "verify", false, "")
+	flag.BoolVar(&opt_stdin, "stdin", false, "")
+	flag.BoolVar(&opt_sandbox, "sandbox", false, "")
+	flag.BoolVar(&opt_lazy, "lazy", false, "")
+	flag.BoolVar(&opt_compact, "compact", false, "")
+	flag.BoolVar(&opt_offsets, "offsets", false, "")
+	flag.Var(&opt_allow, "allow", "")
+	flag.BoolVar(&opt_java, "java", false, "")
+	flag.BoolVar(&opt_bedrock, "bedrock", false, "")
+	flag.BoolVar(&opt_network, "network", false, "")
+	flag.BoolVar(&opt_auto, "auto", true, "")
+	flag.StringVar(&opt_each, "each", "", "")
+	flag.IntVar(&opt_j, "j", runtime.NumCPU(), "")
+	flag.Var(&opt_l, "l", "")
 	// flag.StringVar(&opt_p, "p", "", "")
 	flag.BoolVar(&opt_i, "i", false, "")
 	flag.BoolVar(&opt_v, "v", false, "")
 	// flag.BoolVar(&opt_dt, "dt", false, "")
 	// flag.BoolVar(&opt_dc, "dc", false, "")
 	flag.Usage = func() {
-		fmt.Println(`Usage: luanbt [options] [script [args]].
+		fmt.Printf(`Usage: luanbt [options] [script [args]].
+       luanbt convert [options] in out (see luanbt convert -h)
+       luanbt get|set|delete [options] file path [value] (see luanbt get -h)
+When standard input is piped, nbt is loaded from it when first read, unless
+the script calls loadnbt first; loadnbt and savenbt take '-' for standard
+input and output.
 Available options are:
   -e stat  execute string 'stat'
+  -stdin   fail unless standard input is piped or redirected to load nbt from
+  -l name  require library 'name' before running anything, setting the
+           global 'name' to it (repeatable). require searches the
+           directories in NBTLUA_PATH, then the per-user library directory
+           (nbtlua/lib in the user config directory, e.g. ~/.config), then
+           the usual package.path
   -i       enter interactive mode after executing 'script'
-  -v       show version information`)
+  -v       show version information
+  -java, -bedrock, -network
+           start in Java (big endian), Bedrock (little endian) or Bedrock
+           network NBT encoding instead of detecting each loaded file's
+  -auto    detect the encoding of each file loadnbt loads, preferring Java
+           when unsure, and save in the same encoding (the default); the
+           script can read it from nbt.encoding
+  -sandbox run without os/io/dofile/loadfile/require; loadnbt and savenbt
+           are confined to directories given with -allow
+  -allow dir
+           allow sandboxed loadnbt/savenbt within 'dir' (repeatable;
+           implies -sandbox)
+  -backups n
+           keep the previous n versions of each file savenbt replaces, as
+           file.bak, file.bak.1, ... (default 0). Saves always write a
+           temporary file and rename it over the original
+  -dry-run savenbt writes nothing, printing the tags saving would add,
+           remove or change in the file instead, and returning them as a
+           table of {kind, path, old, new} tables
+  -verify  before savenbt writes, check the NBT decodes back to exactly the
+           nbt table, and refuse to write if it doesn't
+  -mem mb  memory limit of the process in MB, 0 for none (default %d)
+  -timeout duration
+           stop the script with an error after 'duration', e.g. 30s
+  -maxdepth n
+           maximum compound/list nesting when converting, 0 for none
+           (default %d)
+  -lazy    decode compounds and lists only when the script reads them
+  -compact load byte, int and long arrays as compact nbtarray userdata
+  -offsets give loaded tags their offset in the decompressed data
+  -roots mode
+           'stream' loads every concatenated root tag (default), 'first'
+           only the first, 'trailing' the first and keeps what follows in
+           nbt.trailing to be saved back
+  -each pattern
+           run 'script' once for each file matching the glob 'pattern',
+           with the file loaded into nbt and its path in nbt_path, so
+           savenbt() saves it back; prints a summary and fails if the
+           script fails for any file
+  -j n     run -each on n files at a time (default the number of CPUs);
+           -timeout applies to each file, -mem to the whole batch
+`, nlua.MemoryLimitMb, nlua.MaxNbtDepth)
 	}
 	flag.Parse()
 	if len(opt_e) == 0 && !opt_i && !opt_v && flag.NArg() == 0 {
@@ -43,9 +141,64 @@ Available options are:
 	// We'll default to Java encoding for this executable
 	nlua.UseJavaEncoding()
 
+	opts := []nlua.Option{nlua.MemoryLimit(opt_mem), nlua.MaxDepth(opt_maxdepth)}
+	switch {
+	case opt_java:
+		opts = append(opts, nlua.StateEncoding(nlua.JavaEncoding))
+	case opt_bedrock:
+		opts = append(opts, nlua.StateEncoding(nlua.BedrockEncoding))
+	case opt_network:
+		opts = append(opts, nlua.StateEncoding(nlua.NetworkEncoding))
+	case opt_auto:
+		opts = append(opts, nlua.StateEncoding(nlua.JavaEncoding), nlua.AutoEncoding())
+	}
+	roots, err := nlua.ParseRootMode(opt_roots)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	opts = append(opts, nlua.Roots(roots), nlua.Backups(opt_backups))
+	if opt_dryrun {
+		opts = append(opts, nlua.DryRun())
+	}
+	if opt_verify {
+		opts = append(opts, nlua.Verify())
+	}
+	if opt_lazy {
+		opts = append(opts, nlua.LazyDecoding())
+	}
+	if opt_compact {
+		opts = append(opts, nlua.CompactArrays())
+	}
+	if opt_offsets {
+		opts = append(opts, nlua.TagOffsets())
+	}
+	opts = append(opts, nlua.ModulePath(modulePath()...))
+	if opt_sandbox || len(opt_allow) > 0 {
+		if len(opt_l) > 0 {
+			fmt.Println("-l can't be used with -sandbox, which has no require")
+			return 1
+		}
+		// the sandboxed script may still use the pipes nbtlua was given, as "-"
+		opts = append(opts, nlua.Sandbox(opt_allow...), nlua.Stdio(os.Stdin, os.Stdout))
+	}
+
+	if opt_each != "" {
+		if flag.NArg() == 0 {
+			fmt.Println("-each needs a script")
+			return 1
+		}
+		proto, err := compileScript(flag.Arg(0))
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		return runBatch(opt_each, proto, flag.Args()[1:], opt_j, opt_timeout, opts, opt_l, opt_mem)
+	}
+
 	// Create gopher-lua environment
-	L := nlua.NewState()
-	defer L.Close()
+	L := nlua.NewState(append(opts, nlua.Timeout(opt_timeout))...)
+	defer nlua.CloseState(L)
 
 	if opt_v || opt_i {
 		fmt.Println("nbtlua early release Copyright (C) 2020 Jim Nelson")
@@ -53,11 +206,18 @@ Available options are:
 		fmt.Println(lua.PackageCopyRight)
 	}
 
-	// if len(opt_l) > 0 {
-	// 	if err := L.DoFile(opt_l); err != nil {
-	// 		fmt.Println(err.Error())
-	// 	}
-	// }
+	if err := requireModules(L, opt_l); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	// reading a terminal would wait for input the user doesn't know is wanted
+	if opt_stdin && !stdinPiped() {
+		fmt.Println("-stdin needs standard input piped or redirected from a file")
+		return 1
+	}
+	if !opt_i && stdinPiped() {
+		loadStdinOnUse(L)
+	}
 
 	if nargs := flag.NArg(); nargs > 0 {
 		script := flag.Arg(0)
@@ -82,27 +242,104 @@ Available options are:
 	if opt_i {
 		fmt.Println("\nWARNING! Early release! Back up all files before modifying!")
 		fmt.Print("Load an NBT file with loadnbt(path-to-nbt). ")
-		fmt.Print(`Try print(nbt[1].name) or tagType or value. Try changing the name or value. `)
-		fmt.Print("Save an NBT file with savenbt(path-to-modified-nbt, true), where the second parameter is whether to compress the output or not. ")
+		fmt.Print(`Try nbt[1] or get_path("Data") for a level.dat, using tab to complete names. Try changing the name or value. `)
+		fmt.Print("Save it back the way it was loaded with savenbt(), or elsewhere with savenbt(path-to-modified-nbt, compress), where compress is true for gzip or false for none. ")
 		fmt.Println("Press control-D to exit. ")
 		doREPL(L)
 	}
 
+	if err := nlua.LoadError(L); err != nil && !opt_i {
+		fmt.Println("loadnbt failed:", err)
+		status = 1
+	}
+	if err := nlua.SaveError(L); err != nil && !opt_i {
+		fmt.Println("savenbt failed:", err)
+		status = 1
+	}
 	return status
 }
 
+// stdinPiped reports whether standard input is a pipe or file rather than a terminal
+func stdinPiped() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// loadStdinOnUse makes the first read of nbt, while it is still unset, load it from standard input as
+// loadnbt("-") would, so `nbtlua -e 'print(nbt[1].name)' < level.dat` works. Once the script calls loadnbt
+// standard input is left alone, even if that fails, so it's never read when the script loads its own file.
+func loadStdinOnUse(L *lua.LState) {
+	mt := L.NewTable()
+	loadnbt := L.GetGlobal("loadnbt").(*lua.LFunction)
+	L.SetGlobal("loadnbt", L.NewFunction(func(L *lua.LState) int {
+		L.SetMetatable(L.G.Global, lua.LNil)
+		top := L.GetTop()
+		L.Insert(loadnbt, 1)
+		L.Call(top, lua.MultRet)
+		return L.GetTop()
+	}))
+	L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+		if L.Get(2) != lua.LString("nbt") {
+			return 0
+		}
+		L.SetMetatable(L.G.Global, lua.LNil)
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = nlua.LoadNbt(data, L)
+		}
+		if err != nil {
+			L.RaiseError("Error reading standard input: %v", err)
+		}
+		L.GetGlobal("nbt").(*lua.LTable).RawSetString("path", lua.LString("-"))
+		L.Push(L.GetGlobal("nbt"))
+		return 1
+	}))
+	L.SetMetatable(L.G.Global, mt)
+}
+
+// modulePath returns the directories require searches before the defaults: those in NBTLUA_PATH, then the
+// per-user library directory
+func modulePath() []string {
+	dirs := filepath.SplitList(os.Getenv("NBTLUA_PATH"))
+	if config, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(config, "nbtlua", "lib"))
+	}
+	return dirs
+}
+
+// requireModules requires each module for -l, setting a global of the module's name to its value
+func requireModules(L *lua.LState, modules []string) error {
+	for _, name := range modules {
+		if err := L.CallByParam(lua.P{Fn: L.GetGlobal("require"), NRet: 1, Protect: true}, lua.LString(name)); err != nil {
+			return err
+		}
+		value := L.Get(-1)
+		L.Pop(1)
+		if value != lua.LTrue && L.GetGlobal(name) == lua.LNil {
+			L.SetGlobal(name, value)
+		}
+	}
+	return nil
+}
+
 // do read/eval/print/loop
 func doREPL(L *lua.LState) {
-	rl, err := readline.New("> ")
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       "> ",
+		HistoryFile:  historyFile(),
+		AutoComplete: &completer{L},
+	})
 	if err != nil {
 		panic(err)
 	}
 	defer rl.Close()
 	for {
 		if str, err := loadline(rl, L); err == nil {
+			top := L.GetTop()
 			if err := L.DoString(str); err != nil {
 				fmt.Println(err)
 			}
+			printResults(L, top)
 		} else { // error on loadline
 			fmt.Println(err)
 			return
@@ -123,7 +360,7 @@ func loadline(rl *readline.Instance, L *lua.LState) (string, error) {
 	rl.SetPrompt("> ")
 	if line, err := rl.Readline(); err == nil {
 		if _, err := L.LoadString("return " + line); err == nil { // try add return <...> then compile
-			return line, nil
+			return "return " + line, nil
 		} else {
 			return multiline(line, rl, L)
 		}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+)
+
+func TestRequireModules(t *testing.T) {
+	var dirs [3]string
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "nbtlua-modules")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+	first, second, config := dirs[0], dirs[1], dirs[2]
+	files := map[string]string{
+		filepath.Join(first, "mod.lua"):                    `return { v = 1 }`,
+		filepath.Join(second, "mod.lua"):                   `return { v = 2 }`,
+		filepath.Join(second, "pkg", "init.lua"):           `return { v = 3 }`,
+		filepath.Join(second, "plain.lua"):                 `plain_loaded = true`,
+		filepath.Join(config, "nbtlua", "lib", "user.lua"): `return { v = 4 }`,
+	}
+	for path, src := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer setenv(t, "NBTLUA_PATH", first+string(filepath.ListSeparator)+second)()
+	// os.UserConfigDir on Linux, for the per-user library directory
+	defer setenv(t, "XDG_CONFIG_HOME", config)()
+
+	L := nlua.NewState(nlua.ModulePath(modulePath()...))
+	defer nlua.CloseState(L)
+	if err := requireModules(L, []string{"mod", "pkg", "plain", "user"}); err != nil {
+		t.Fatal(err)
+	}
+	// NBTLUA_PATH directories are searched in order, then the per-user one; a module returning nothing doesn't
+	// replace the globals it set
+	err := L.DoString(`
+		assert(mod.v == 1, "first NBTLUA_PATH directory")
+		assert(pkg.v == 3, "init.lua in a module directory")
+		assert(plain == nil and plain_loaded)
+		assert(user.v == 4, "per-user library directory")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := requireModules(L, []string{"missing"}); err == nil {
+		t.Error("requiring a missing module expected an error")
+	}
+}
+
+// setenv sets an environment variable for a test and returns a function restoring it
+func setenv(t *testing.T, name, value string) func() {
+	old, had := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if had {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	nlua "github.com/midnightfreddie/nbt-go-lua"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// historyFile returns where the REPL keeps its history, creating the directory, or "" for no history
+func historyFile() string {
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Join(config, "nbtlua")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "history")
+}
+
+// printResults prints the values an evaluated line left on the stack above top, then removes them
+func printResults(L *lua.LState, top int) {
+	if L.GetTop() <= top {
+		return
+	}
+	results := make([]string, 0, L.GetTop()-top)
+	for i := top + 1; i <= L.GetTop(); i++ {
+		results = append(results, nlua.FormatValue(L, L.Get(i)))
+	}
+	L.SetTop(top)
+	fmt.Println(strings.Join(results, "\t"))
+}
+
+var luaKeywords = []string{"and", "break", "do", "else", "elseif", "end", "false", "for", "function", "if", "in",
+	"local", "nil", "not", "or", "repeat", "return", "then", "true", "until", "while"}
+
+// An expression being completed: a chain of names, [n] indices, and . or : lookups, ending in the name typed so far
+var (
+	completionChain = regexp.MustCompile(`(?:[A-Za-z_]\w*(?:\[\d+\]|[.:][A-Za-z_]\w*)*[.:])?\w*$`)
+	chainStep       = regexp.MustCompile(`[A-Za-z_]\w*|\[\d+\]`)
+)
+
+// completer completes global names, fields of tables and userdata along a chain like nbt[1].value[2].na, and,
+// inside a string, paths of tags in nbt as taken by get_path, like "Data.Player.Inv
+type completer struct {
+	L *lua.LState
+}
+
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	before := string(line[:pos])
+	var typed string
+	var found []string
+	if q := openQuote(before); q >= 0 {
+		typed = before[q+1:]
+		found = nlua.CompletePath(c.L, typed)
+	} else {
+		expr := completionChain.FindString(before)
+		cut := strings.LastIndexAny(expr, ".:")
+		typed = expr[cut+1:]
+		found = c.fields(expr[:cut+1])
+	}
+	sort.Strings(found)
+	var suffixes [][]rune
+	for i, f := range found {
+		if strings.HasPrefix(f, typed) && (i == 0 || f != found[i-1]) {
+			suffixes = append(suffixes, []rune(f[len(typed):]))
+		}
+	}
+	return suffixes, len([]rune(typed))
+}
+
+// openQuote returns the position of the quote starting an unterminated string in s, or -1
+func openQuote(s string) int {
+	open := -1
+	for i := 0; i < len(s); i++ {
+		switch {
+		case open >= 0 && s[i] == '\\':
+			i++
+		case open >= 0 && s[i] == s[open]:
+			open = -1
+		case open < 0 && (s[i] == '"' || s[i] == '\''):
+			open = i
+		}
+	}
+	return open
+}
+
+// fields returns the names available after chain, such as "nbt[1]." or "", without calling anything: the
+// globals and keywords, or the string keys of the table chain leads to and of its metatable's __index table
+func (c *completer) fields(chain string) []string {
+	if chain == "" {
+		names := append([]string(nil), luaKeywords...)
+		return append(names, keysOf(c.L.G.Global)...)
+	}
+	var v lua.LValue = c.L.G.Global
+	for _, step := range chainStep.FindAllString(chain, -1) {
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			v = indexTable(c.L, v)
+			if t, ok = v.(*lua.LTable); !ok {
+				return nil
+			}
+		}
+		if strings.HasPrefix(step, "[") {
+			n, _ := strconv.Atoi(strings.Trim(step, "[]"))
+			v = t.RawGetInt(n)
+		} else if v = t.RawGetString(step); v == lua.LNil {
+			v = indexTable(c.L, t).(*lua.LTable).RawGetString(step)
+		}
+	}
+	var names []string
+	if t, ok := v.(*lua.LTable); ok {
+		names = keysOf(t)
+	}
+	if index, ok := indexTable(c.L, v).(*lua.LTable); ok {
+		names = append(names, keysOf(index)...)
+	}
+	return names
+}
+
+// indexTable returns the __index table of v's metatable, or an empty table
+func indexTable(L *lua.LState, v lua.LValue) lua.LValue {
+	if index, ok := L.GetMetaField(v, "__index").(*lua.LTable); ok {
+		return index
+	}
+	return L.NewTable()
+}
+
+// keysOf returns the string keys of t that are Lua names
+func keysOf(t *lua.LTable) []string {
+	var keys []string
+	t.ForEach(func(k, _ lua.LValue) {
+		if s, ok := k.(lua.LString); ok && chainStep.MatchString(string(s)) && !strings.HasPrefix(string(s), "[") {
+			keys = append(keys, string(s))
+		}
+	})
+	return keys
+}
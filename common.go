@@ -1,29 +1,81 @@
 package nlua
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"os"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-// NewState is called to get a Lua environment with nbt manipulation ability// lua vm memory limit; 0 is no limit
-const memoryLimitMb = 100
+// MemoryLimitMb is NewState's default lua vm memory limit in MB; see MemoryLimit
+const MemoryLimitMb = 100
 
-// Used by all converters; change with UseJavaEncoding() or UseBedrockEncoding()
-var byteOrder = binary.ByteOrder(binary.LittleEndian)
+// MaxNbtDepth is NewState's default compound/list nesting limit, the same as Minecraft Java Edition's
+const MaxNbtDepth = 512
 
 // UseJavaEncoding sets the module to decode/encode from/to big endian NBT for Minecraft Java Edition
 func UseJavaEncoding() {
-	byteOrder = binary.BigEndian
+	encoding = JavaEncoding
 }
 
 // UseBedrockEncoding sets the module to decode/encode from/to little endian NBT for Minecraft Bedrock Edition
 func UseBedrockEncoding() {
-	byteOrder = binary.LittleEndian
+	encoding = BedrockEncoding
+}
+
+// codec carries the settings of one Nbt2Lua or Lua2Nbt conversion through the recursive tag functions
+type codec struct {
+	L     *lua.LState
+	order binary.ByteOrder
+	// compound and list nesting limit, and the current nesting
+	maxDepth int
+	depth    int
+	// lazy leaves compound and list payloads undecoded until read; src is the data being decoded
+	lazy bool
+	src  []byte
+	// compact decodes byte, int and long arrays to typedArray userdata
+	compact bool
+	// roots is how many top-level tags to decode; base is the offset of src in the original data
+	roots RootMode
+	base  int
+	// network converts to/from network NBT around decoding and encoding, which use little endian NBT
+	network bool
+	// offsets records each decoded tag's offset in the original data
+	offsets bool
+}
+
+func newCodec(L *lua.LState) *codec {
+	return newEncodingCodec(L, getConfig(L).currentEncoding())
+}
+
+// newEncodingCodec is newCodec for encoding e instead of the state's
+func newEncodingCodec(L *lua.LState, e Encoding) *codec {
+	cfg := getConfig(L)
+	return &codec{L: L, order: e.order(), maxDepth: cfg.maxDepth, lazy: cfg.lazy, compact: cfg.compact,
+		roots: cfg.roots, network: e == NetworkEncoding, offsets: cfg.offsets}
+}
+
+// enter is called when descending into a compound or list; it fails past maxDepth or once the LState's context is done
+func (c *codec) enter() error {
+	if c.maxDepth > 0 && c.depth >= c.maxDepth {
+		return fmt.Errorf("nesting deeper than the maximum of %d", c.maxDepth)
+	}
+	if c.L != nil {
+		if ctx := c.L.Context(); ctx != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	c.depth++
+	return nil
+}
+
+func (c *codec) leave() {
+	c.depth--
 }
 
 // Turns an int64 (nbt long) into a least-/most- significant 32 bits pair
@@ -33,6 +85,28 @@ func longToIntPair(i int64) (least uint32, most uint32) {
 	return
 }
 
+// float32ToNumber widens a float to a lua number, keeping a NaN's payload bits, which a conversion may change
+func float32ToNumber(f float32) lua.LNumber {
+	if math.IsNaN(float64(f)) {
+		b := math.Float32bits(f)
+		return lua.LNumber(math.Float64frombits(uint64(b>>31)<<63 | 0x7ff<<52 | uint64(b&0x7fffff)<<29))
+	}
+	return lua.LNumber(f)
+}
+
+// numberToFloat32 narrows a lua number to a float, keeping as much of a NaN's payload as fits
+func numberToFloat32(n lua.LNumber) float32 {
+	if math.IsNaN(float64(n)) {
+		b := math.Float64bits(float64(n))
+		payload := uint32(b>>29) & 0x7fffff
+		if payload == 0 {
+			payload = 1 << 22
+		}
+		return math.Float32frombits(uint32(b>>63)<<31 | 0xff<<23 | payload)
+	}
+	return float32(n)
+}
+
 func intPairToLong(least uint32, most uint32) int64 {
 	var i int64
 	i = int64(least) | (int64(most) << 32)
@@ -67,106 +141,378 @@ func (e LuaNbtError) Error() string {
 	return fmt.Sprintf("Error lua nbt to native nbt: %s%s", e.s, s)
 }
 
-func NewState() *lua.LState {
-	L := lua.NewState()
+// NewState returns a Lua environment with nbt manipulation ability; pass Options such as Sandbox to restrict it
+func NewState(opts ...Option) *lua.LState {
+	c := newConfig(opts)
+	L := lua.NewState(lua.Options{SkipOpenLibs: c.sandbox})
+	if c.sandbox {
+		openSandboxLibs(L)
+	}
 	// Set memory limit of lua instance (just a safety measure)
-	if memoryLimitMb > 0 {
-		L.SetMx(memoryLimitMb)
+	if c.memoryLimitMb > 0 && !c.sharedMemoryLimit {
+		L.SetMx(c.memoryLimitMb)
 	}
+	if ctx := c.context(); ctx != nil {
+		L.SetContext(ctx)
+	}
+	c.setModulePath(L)
+	setConfig(L, c)
 	Nlua(L)
 	return L
 }
 
+// CloseState closes L along with what its scripts left open: the worlds openworld opened, and the Timeout option's
+// timer. Use it instead of L.Close for states that may open worlds.
+func CloseState(L *lua.LState) {
+	c := getConfig(L)
+	c.closeWorlds()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	L.Close()
+}
+
 // Nlua injects load and save functions into a lua environment
 func Nlua(L *lua.LState) {
 	L.SetGlobal("loadnbt", L.NewFunction(loadNbt))
 	L.SetGlobal("savenbt", L.NewFunction(saveNbt))
+	L.SetGlobal("detectnbt", L.NewFunction(detectNbt))
+	L.SetGlobal("get_path", L.NewFunction(getPathLua))
 	L.SetGlobal("use_bedrock_encoding", L.NewFunction(useBedrockEncoding))
 	L.SetGlobal("use_java_encoding", L.NewFunction(useJavaEncoding))
+	L.SetGlobal("use_network_encoding", L.NewFunction(useNetworkEncoding))
+	L.SetGlobal("use_lazy_decoding", L.NewFunction(useLazyDecoding))
+	L.SetGlobal("use_compact_arrays", L.NewFunction(useCompactArrays))
+	L.SetGlobal("use_tag_offsets", L.NewFunction(useTagOffsets))
+	L.SetGlobal("use_root_mode", L.NewFunction(useRootMode))
+	L.SetGlobal("use_backups", L.NewFunction(useBackups))
+	L.SetGlobal("use_verify", L.NewFunction(useVerify))
+	L.SetGlobal("nbt_array", L.NewFunction(newArray))
+	L.SetGlobal("openworld", L.NewFunction(openWorld))
+	L.SetGlobal("bedrock_chunk", L.NewFunction(bedrockChunk))
+	L.SetGlobal("chunk_key", L.NewFunction(chunkKey))
+	L.SetGlobal("parse_chunk_key", L.NewFunction(parseChunkKey))
+	L.SetGlobal("decode_subchunk", L.NewFunction(decodeSubChunk))
+	L.SetGlobal("encode_subchunk", L.NewFunction(encodeSubChunk))
+	L.SetGlobal("subchunk_index", L.NewFunction(subChunkIndex))
+	L.SetGlobal("get_block", L.NewFunction(getBlock))
+	L.SetGlobal("set_block", L.NewFunction(setBlock))
+	L.SetGlobal("structure", L.NewFunction(newStructureLua))
+	L.SetGlobal("schematic", L.NewFunction(newSchematicLua))
+	L.SetGlobal("mcstructure", L.NewFunction(newMcstructureLua))
+	L.SetGlobal("uuid_string", L.NewFunction(uuidString))
+	L.SetGlobal("uuid_ints", L.NewFunction(uuidInts))
+	L.SetGlobal("uuid_longs", L.NewFunction(uuidLongs))
+	L.SetGlobal("find_uuid", L.NewFunction(findUUID))
 }
 
+// loadnbt(path) loads the file at path into nbt and returns true, or returns nil and a message if it can't
 func loadNbt(L *lua.LState) int {
-	var inData []byte
-	var err error
-	path := L.ToString(1)
-	inData, err = ioutil.ReadFile(path)
+	inData, err := getConfig(L).readFile(L.ToString(1))
 	if err != nil {
-		// TODO: proper error handling inside lua?
-		fmt.Println("Error reading file:", err)
-		return 0
-	}
-	// is it gzipped?
-	if (inData[0] == 0x1f) && (inData[1] == 0x8b) {
-		var uncompressed []byte
-		buf := bytes.NewReader(inData)
-		zr, err := gzip.NewReader(buf)
-		if err != nil {
-			// TODO: proper error handling inside lua?
-			fmt.Println("Error creating gzip reader on buf:", err)
-			return 0
-		}
-		uncompressed, err = ioutil.ReadAll(zr)
-		if err != nil {
-			// TODO: proper error handling inside lua?
-			fmt.Println("Error un-gzipping file:", err)
-			return 0
+		return loadError(L, "Error reading file", err)
+	}
+	err = LoadNbt(inData, L)
+	if err != nil {
+		return loadError(L, "Error converting file", err)
+	}
+	if doc, ok := L.GetGlobal("nbt").(*lua.LTable); ok {
+		doc.RawSetString("path", lua.LString(L.ToString(1)))
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// LoadNbt does what loadnbt does with the contents of a file: it decompresses gzip or zlib data, removes a Bedrock
+// level.dat header, detects the encoding if the AutoEncoding option is set, and converts the NBT to the global
+// `nbt` variable like Nbt2Lua. It records how the file was stored, for SaveNbt to store it the same way:
+// nbt.encoding and nbt.compression are the names of the encoding and compression, and nbt.header_version is the
+// version in the level.dat header, if there was one.
+func LoadNbt(b []byte, L *lua.LState) error {
+	b, compression, err := Decompress(b)
+	if err != nil {
+		return NbtParseError{"Decompressing", err}
+	}
+	var version int32
+	header := compression == NoCompression && hasLevelHeader(b)
+	if header {
+		version = int32(binary.LittleEndian.Uint32(b[:4]))
+		b = b[8:]
+	}
+	cfg := getConfig(L)
+	if cfg.autoEncoding {
+		cfg.setEncoding(DetectEncoding(b, cfg.currentEncoding()))
+	}
+	if err := Nbt2Lua(b, L); err != nil {
+		return err
+	}
+	if doc, ok := L.GetGlobal("nbt").(*lua.LTable); ok {
+		doc.RawSetString("encoding", lua.LString(cfg.currentEncoding().String()))
+		doc.RawSetString("compression", lua.LString(compression.String()))
+		if header {
+			doc.RawSetString("header_version", lua.LNumber(version))
 		}
-		inData = uncompressed
 	}
+	return nil
+}
+
+// SaveNbt does what a savenbt() without arguments does short of writing the file: it converts lua's global nbt
+// table variable like Lua2Nbt, but in the encoding named by nbt.encoding, puts back a Bedrock level.dat header if
+// nbt.header_version is set, and compresses it as nbt.compression says. With the Verify option it checks the NBT
+// with VerifyNbt first.
+func SaveNbt(L *lua.LState) ([]byte, error) {
+	doc, _ := L.GetGlobal("nbt").(*lua.LTable)
+	return encodeFile(L, loadedFormat(doc))
+}
 
-	err = Nbt2Lua(inData, L)
+// fileFormat is how a file's NBT is stored: its encoding, nil for the state's, its compression, and whether it has
+// a Bedrock level.dat header, whose version is nbt.header_version
+type fileFormat struct {
+	encoding    *Encoding
+	compression Compression
+	header      bool
+}
+
+// loadedFormat is the format LoadNbt recorded in a document's fields
+func loadedFormat(doc *lua.LTable) fileFormat {
+	var f fileFormat
+	if loaded, err := ParseEncoding(docField(doc, "encoding")); err == nil {
+		f.encoding = &loaded
+	}
+	f.compression, _ = ParseCompression(docField(doc, "compression"))
+	if doc != nil {
+		_, f.header = doc.RawGetString("header_version").(lua.LNumber)
+	}
+	return f
+}
+
+// encodingOr is the encoding of format f, or e if f uses the state's
+func (f fileFormat) encodingOr(e Encoding) Encoding {
+	if f.encoding != nil {
+		return *f.encoding
+	}
+	return e
+}
+
+// encodeFile converts nbt to the contents of a file in format f
+func encodeFile(L *lua.LState, f fileFormat) ([]byte, error) {
+	cfg := getConfig(L)
+	// the encoding goes to the codec rather than through the state's, which may be the package-wide one
+	e := f.encodingOr(cfg.currentEncoding())
+	b, err := lua2Nbt(L, e)
 	if err != nil {
-		// TODO: proper error handling inside lua?
-		fmt.Println("Error converting file:", err)
-		return 0
+		return nil, err
 	}
-	return 0
+	if cfg.verify {
+		if err := verifyNbt(L, b, e); err != nil {
+			return nil, err
+		}
+	}
+	doc, _ := L.GetGlobal("nbt").(*lua.LTable)
+	if version, ok := doc.RawGetString("header_version").(lua.LNumber); ok && f.header {
+		header := make([]byte, 8, 8+len(b))
+		binary.LittleEndian.PutUint32(header, uint32(int32(version)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(b)))
+		b = append(header, b...)
+	}
+	return Compress(b, f.compression)
+}
+
+// pushError returns nil and an error message to lua, the way io.open reports failure
+func pushError(L *lua.LState, msg string, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(fmt.Sprintf("%s: %v", msg, err)))
+	return 2
+}
+
+// docField returns a string field of a document table such as nbt.path, or "" if it's missing
+func docField(doc *lua.LTable, name string) string {
+	if doc == nil {
+		return ""
+	}
+	s, _ := doc.RawGetString(name).(lua.LString)
+	return string(s)
 }
 
-// stub
+// savenbt(path, compress) saves nbt to path, by default as uncompressed NBT in the state's encoding. Saving back to
+// nbt.path, which is where an omitted path saves to, keeps the way the file was loaded instead.
 func saveNbt(L *lua.LState) int {
+	cfg := getConfig(L)
+	doc, _ := L.GetGlobal("nbt").(*lua.LTable)
 	path := L.ToString(1)
-	compress := L.ToBool(2)
-	outData, err := Lua2Nbt(L)
+	if path == "" {
+		if path = docField(doc, "path"); path == "" {
+			return saveError(L, "Error writing file", errors.New("nbt wasn't loaded from a file, so savenbt needs a path"))
+		}
+	}
+	var f fileFormat
+	if path == docField(doc, "path") {
+		f = loadedFormat(doc)
+	}
+	switch compress := L.Get(2).(type) {
+	case lua.LBool:
+		f.compression = NoCompression
+		if compress {
+			f.compression = Gzip
+		}
+	case lua.LString:
+		var err error
+		if f.compression, err = ParseCompression(string(compress)); err != nil {
+			L.ArgError(2, err.Error())
+		}
+	case *lua.LNilType:
+	default:
+		L.ArgError(2, "expected true, false or a compression name")
+	}
+	if cfg.dryRun {
+		return dryRunSave(L, path, f)
+	}
+	outData, err := encodeFile(L, f)
 	if err != nil {
-		// TODO: proper error handling inside lua?
-		fmt.Println("Error converting lua to nbt:", err)
-		return 0
-	}
-	if compress {
-		var buf bytes.Buffer
-		zw := gzip.NewWriter(&buf)
-		_, err := zw.Write(outData)
-		if err != nil {
-			// TODO: proper error handling inside lua?
-			fmt.Println("Error creating gzip writer on buf:", err)
-			return 0
+		return saveError(L, "Error converting lua to nbt", err)
+	}
+	err = cfg.writeFile(path, outData)
+	if err != nil {
+		return saveError(L, "Error writing file", err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// saveError is pushError for savenbt, also remembering the state's first failed save for SaveError
+func saveError(L *lua.LState, msg string, err error) int {
+	if cfg := getConfig(L); cfg.saveErr == nil {
+		cfg.saveErr = fmt.Errorf("%s: %v", msg, err)
+	}
+	return pushError(L, msg, err)
+}
+
+// loadError is pushError for loadnbt, also remembering the state's first failed load for LoadError
+func loadError(L *lua.LState, msg string, err error) int {
+	if cfg := getConfig(L); cfg.loadErr == nil {
+		cfg.loadErr = fmt.Errorf("%s: %v", msg, err)
+	}
+	return pushError(L, msg, err)
+}
+
+// LoadError returns why the first loadnbt in L that failed did so, or nil if none has, like SaveError
+func LoadError(L *lua.LState) error {
+	return getConfig(L).loadErr
+}
+
+// SaveError returns why the first savenbt in L that failed did so, or nil if none has, so a caller can tell a
+// script's save failed even when the script ignored the nil and message savenbt returned
+func SaveError(L *lua.LState) error {
+	return getConfig(L).saveErr
+}
+
+// ReadFile reads the file at path as loadnbt does: in a sandbox only within the allowed directories, and from
+// standard input if path is "-", which a sandbox only allows from the Stdio reader
+func ReadFile(L *lua.LState, path string) ([]byte, error) {
+	return getConfig(L).readFile(path)
+}
+
+// readFile reads the file at path for loadnbt, or standard input if path is "-"
+func (c *config) readFile(path string) ([]byte, error) {
+	if path == "-" {
+		if c.stdin != nil {
+			return ioutil.ReadAll(c.stdin)
 		}
-		err = zw.Close()
-		if err != nil {
-			// TODO: proper error handling inside lua?
-			fmt.Println("Error gzipping file:", err)
-			return 0
+		if c.sandbox {
+			return nil, SandboxError{path}
 		}
-		outData = buf.Bytes()
+		return ioutil.ReadAll(os.Stdin)
 	}
-	err = ioutil.WriteFile(path, outData, 0644)
+	path, err := c.allowedPath(path)
 	if err != nil {
-		// TODO: proper error handling inside lua?
-		fmt.Println("Error writing file:", err)
-		return 0
+		return nil, err
 	}
-	return 0
+	return ioutil.ReadFile(path)
+}
+
+// output is where savenbt("-") writes and dry runs report: the Stdio writer, or standard output
+func (c *config) output() io.Writer {
+	if c.stdout != nil {
+		return c.stdout
+	}
+	return os.Stdout
+}
+
+// writeFile writes b to the file at path for savenbt, or to standard output if path is "-", which a sandbox only
+// allows to the Stdio writer
+func (c *config) writeFile(path string, b []byte) error {
+	if path == "-" {
+		if c.sandbox && c.stdout == nil {
+			return SandboxError{path}
+		}
+		_, err := c.output().Write(b)
+		return err
+	}
+	path, err := c.allowedPath(path)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, b, c.backups)
 }
 
-// lua wrapper for UseBedrockEncoding()
+// lua wrapper for UseBedrockEncoding(); a state with its own encoding changes only that
 func useBedrockEncoding(L *lua.LState) int {
-	UseBedrockEncoding()
+	getConfig(L).setEncoding(BedrockEncoding)
 	return 0
 }
 
-// lua wrapper for UseJavaEncoding()
+// lua wrapper for UseJavaEncoding(); a state with its own encoding changes only that
 func useJavaEncoding(L *lua.LState) int {
-	UseJavaEncoding()
+	getConfig(L).setEncoding(JavaEncoding)
+	return 0
+}
+
+// lua wrapper for UseNetworkEncoding(); a state with its own encoding changes only that
+func useNetworkEncoding(L *lua.LState) int {
+	getConfig(L).setEncoding(NetworkEncoding)
+	return 0
+}
+
+// lua wrapper to turn lazy decoding on or off for this state
+func useLazyDecoding(L *lua.LState) int {
+	getConfig(L).lazy = L.OptBool(1, true)
+	return 0
+}
+
+// lua wrapper to turn compact array decoding on or off for this state
+func useCompactArrays(L *lua.LState) int {
+	getConfig(L).compact = L.OptBool(1, true)
+	return 0
+}
+
+// lua wrapper to turn recording tag offsets on or off for this state
+func useTagOffsets(L *lua.LState) int {
+	getConfig(L).offsets = L.OptBool(1, true)
+	return 0
+}
+
+// lua wrapper to set how many previous versions future saves keep as .bak files; 0 keeps none
+func useBackups(L *lua.LState) int {
+	n := L.CheckInt(1)
+	if n < 0 {
+		L.ArgError(1, "backups must not be negative")
+	}
+	getConfig(L).backups = n
+	return 0
+}
+
+// lua wrapper to turn verifying future saves on or off
+func useVerify(L *lua.LState) int {
+	getConfig(L).verify = L.OptBool(1, true)
+	return 0
+}
+
+// lua wrapper to choose how future loads treat data after the first top-level tag: "stream", "first" or "trailing"
+func useRootMode(L *lua.LState) int {
+	mode, err := ParseRootMode(L.CheckString(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	getConfig(L).roots = mode
 	return 0
 }
@@ -0,0 +1,93 @@
+package nlua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compression is how an NBT file is compressed
+type Compression int
+
+const (
+	// NoCompression is plain NBT, as in Bedrock Edition files and some Java Edition ones such as servers.dat
+	NoCompression Compression = iota
+	// Gzip is used by most Java Edition files such as level.dat and player data
+	Gzip
+	// Zlib is used by Java Edition region file chunks
+	Zlib
+)
+
+var compressionNames = []string{"none", "gzip", "zlib"}
+
+func (c Compression) String() string {
+	if c >= 0 && int(c) < len(compressionNames) {
+		return compressionNames[c]
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ParseCompression returns the Compression named "none", "gzip" or "zlib"
+func ParseCompression(s string) (Compression, error) {
+	for i, name := range compressionNames {
+		if s == name {
+			return Compression(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression '%s'; expected gzip, zlib or none", s)
+}
+
+// isZlib checks for a zlib header: deflate with a window of at most 32K, no preset dictionary, and a valid
+// check value. An uncompressed NBT file starts with a tag type of at most 12, so never looks like one.
+func isZlib(b []byte) bool {
+	return len(b) >= 2 && b[0]&0x0f == 8 && b[0]>>4 <= 7 && b[1]&0x20 == 0 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// Decompress returns b uncompressed, detecting gzip and zlib compression, and the compression found
+func Decompress(b []byte) ([]byte, Compression, error) {
+	switch {
+	case len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, Gzip, err
+		}
+		out, err := ioutil.ReadAll(zr)
+		return out, Gzip, err
+	case isZlib(b):
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, Zlib, err
+		}
+		out, err := ioutil.ReadAll(zr)
+		return out, Zlib, err
+	}
+	return b, NoCompression, nil
+}
+
+// Compress returns b compressed with c
+func Compress(b []byte, c Compression) ([]byte, error) {
+	var buf bytes.Buffer
+	var zw interface {
+		Write([]byte) (int, error)
+		Close() error
+	}
+	switch c {
+	case NoCompression:
+		return b, nil
+	case Gzip:
+		zw = gzip.NewWriter(&buf)
+	case Zlib:
+		zw = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unknown compression %v", c)
+	}
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,128 @@
+package nlua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// How much decompressed data DetectFormat probes
+const probeSize = 64 * 1024
+
+// Format describes an NBT file as found by DetectFormat
+type Format struct {
+	Compression Compression
+	Encoding    Encoding
+	// Header is whether the data starts with the 8 byte header of a Bedrock Edition level.dat: a little endian
+	// int32 storage version, then the little endian int32 length of the NBT that follows
+	Header        bool
+	HeaderVersion int32
+	// RootType and RootName are the tag type and name of the first root tag
+	RootType byte
+	RootName string
+}
+
+// ByteOrder is the byte order of f's encoding
+func (f Format) ByteOrder() binary.ByteOrder {
+	return f.Encoding.order()
+}
+
+// probe returns up to probeSize bytes of b decompressed, and the compression found
+func probe(b []byte) ([]byte, Compression, error) {
+	var r io.Reader
+	var c Compression
+	var err error
+	switch {
+	case len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b:
+		c = Gzip
+		r, err = gzip.NewReader(bytes.NewReader(b))
+	case isZlib(b):
+		c = Zlib
+		r, err = zlib.NewReader(bytes.NewReader(b))
+	default:
+		return b, NoCompression, nil
+	}
+	if err != nil {
+		return nil, c, err
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, probeSize))
+	if err == io.ErrUnexpectedEOF && len(out) > 0 {
+		// a truncated stream still shows the leading tags
+		err = nil
+	}
+	return out, c, err
+}
+
+// hasLevelHeader reports whether b starts with a Bedrock level.dat header. Only whole data can be checked, as
+// the header holds the length of the rest.
+func hasLevelHeader(b []byte) bool {
+	return len(b) > 8 && int(binary.LittleEndian.Uint32(b[4:8])) == len(b)-8 && b[8] > 0 && b[8] <= 12 &&
+		binary.LittleEndian.Uint32(b[:4]) < 0x10000
+}
+
+// DetectFormat finds the compression, encoding, Bedrock level.dat header, and root tag type and name of an NBT
+// file's contents by probing its first bytes, without decoding it. When the data fits several encodings, as tiny
+// documents can, Java is preferred, then Bedrock Edition. It fails if the data doesn't look like NBT at all.
+func DetectFormat(b []byte) (Format, error) {
+	var f Format
+	data, c, err := probe(b)
+	f.Compression = c
+	if err != nil {
+		return f, NbtParseError{"Decompressing", err}
+	}
+	if c == NoCompression && hasLevelHeader(data) {
+		f.Header = true
+		f.HeaderVersion = int32(binary.LittleEndian.Uint32(data[:4]))
+		data = data[8:]
+	}
+	for _, e := range []Encoding{JavaEncoding, BedrockEncoding, NetworkEncoding} {
+		if e.plausible(data) {
+			f.Encoding = e
+			f.RootType = data[0]
+			n, size := e.nameLength(data[1:])
+			f.RootName = string(data[1+size : 1+size+n])
+			return f, nil
+		}
+	}
+	return f, NbtParseError{"Detecting format", fmt.Errorf("no plausible root tag in any encoding")}
+}
+
+// detectnbt(path) returns a table describing an NBT file without loading it: compression ("gzip", "zlib" or
+// "none"), encoding ("java", "bedrock" or "network"), byte_order ("big" or "little"), header (whether it has a
+// Bedrock level.dat header) and header_version, root_type and root_name
+func detectNbt(L *lua.LState) int {
+	path, err := getConfig(L).allowedPath(L.CheckString(1))
+	if err != nil {
+		return pushError(L, "Error reading file", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return pushError(L, "Error reading file", err)
+	}
+	f, err := DetectFormat(b)
+	if err != nil {
+		return pushError(L, "Error detecting format", err)
+	}
+	order := "little"
+	if f.ByteOrder() == binary.BigEndian {
+		order = "big"
+	}
+	t := L.CreateTable(0, 7)
+	t.RawSetString("compression", lua.LString(f.Compression.String()))
+	t.RawSetString("encoding", lua.LString(f.Encoding.String()))
+	t.RawSetString("byte_order", lua.LString(order))
+	t.RawSetString("header", lua.LBool(f.Header))
+	if f.Header {
+		t.RawSetString("header_version", lua.LNumber(f.HeaderVersion))
+	}
+	t.RawSetString("root_type", lua.LNumber(f.RootType))
+	t.RawSetString("root_name", lua.LString(f.RootName))
+	L.Push(t)
+	return 1
+}
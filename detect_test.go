@@ -0,0 +1,56 @@
+package nlua
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	// compound "Data" holding int "x" = 1, in Java and Bedrock encodings
+	java := []byte{10, 0, 4, 'D', 'a', 't', 'a', 3, 0, 1, 'x', 0, 0, 0, 1, 0}
+	bedrock := []byte{10, 4, 0, 'D', 'a', 't', 'a', 3, 1, 0, 'x', 1, 0, 0, 0, 0}
+	gzipped, _ := Compress(java, Gzip)
+	zlibbed, _ := Compress(bedrock, Zlib)
+	header := make([]byte, 8, 8+len(bedrock))
+	binary.LittleEndian.PutUint32(header, 10)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(bedrock)))
+	levelDat := append(header, bedrock...)
+
+	for _, c := range []struct {
+		b           []byte
+		compression Compression
+		encoding    Encoding
+		header      bool
+	}{
+		{java, NoCompression, JavaEncoding, false},
+		{gzipped, Gzip, JavaEncoding, false},
+		{zlibbed, Zlib, BedrockEncoding, false},
+		{levelDat, NoCompression, BedrockEncoding, true},
+		{[]byte{10, 4, 'D', 'a', 't', 'a', 3, 1, 'x', 2, 0}, NoCompression, NetworkEncoding, false},
+	} {
+		f, err := DetectFormat(c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Compression != c.compression || f.Encoding != c.encoding || f.Header != c.header ||
+			f.RootType != 10 || f.RootName != "Data" {
+			t.Errorf("% x detected as %+v", c.b, f)
+		}
+		if c.header && f.HeaderVersion != 10 {
+			t.Errorf("header version %d", f.HeaderVersion)
+		}
+	}
+	if _, err := DetectFormat([]byte("hello, world")); err == nil {
+		t.Error("text detected as NBT")
+	}
+
+	// lua gets nil and a message, as from io.open
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+		local f, err = detectnbt("no such file")
+		assert(f == nil and err:find("Error reading file"), err)`)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,284 @@
+package nlua
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ChangeKind is how a tag differs between two documents
+type ChangeKind int
+
+const (
+	TagAdded ChangeKind = iota
+	TagRemoved
+	TagChanged
+	// the file's encoding, compression or level.dat header changed; Path is the nbt field holding it
+	FormatChanged
+)
+
+var changeKindNames = []string{"added", "removed", "changed", "format"}
+
+func (k ChangeKind) String() string {
+	if int(k) < len(changeKindNames) {
+		return changeKindNames[k]
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Longest value Change.String shows
+const maxChangeLength = 200
+
+// Change is one difference found by DiffNbt: the tag at Path, written as GetPath takes it, was added, removed or
+// changed. Old and New are its SNBT before and after, empty when added or removed. A FormatChanged Change is
+// instead for how the file is stored: Path is "encoding", "compression" or "header_version", and Old and New are
+// the field's values, "none" for no header.
+type Change struct {
+	Kind     ChangeKind
+	Path     string
+	Old, New string
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case TagAdded:
+		return fmt.Sprintf("+ %s: %s", c.Path, shorten(c.New))
+	case TagRemoved:
+		return fmt.Sprintf("- %s: %s", c.Path, shorten(c.Old))
+	case FormatChanged:
+		return fmt.Sprintf("~ nbt.%s: %s -> %s", c.Path, c.Old, c.New)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.Path, shorten(c.Old), shorten(c.New))
+}
+
+func shorten(s string) string {
+	if r := []rune(s); len(r) > maxChangeLength {
+		return string(r[:maxChangeLength]) + "..."
+	}
+	return s
+}
+
+// DiffNbt compares old, the contents of an NBT file, compressed or not, with what SaveNbt would write for lua's
+// global nbt table variable, and returns any change to the file's encoding, compression or level.dat header, then
+// the tags added, removed and changed. old's encoding is detected, preferring the one nbt was loaded with. A nil
+// old is a missing file, so every tag is added. Compound children are matched by name, and list elements by index.
+func DiffNbt(L *lua.LState, old []byte) ([]Change, error) {
+	doc, _ := L.GetGlobal("nbt").(*lua.LTable)
+	return diffFile(L, old, loadedFormat(doc))
+}
+
+// diffFile is DiffNbt for saving in format f, decoding what encodeFile writes the way loadnbt would read it back
+func diffFile(L *lua.LState, old []byte, f fileFormat) ([]Change, error) {
+	cfg := getConfig(L)
+	b, err := encodeFile(L, f)
+	if err != nil {
+		return nil, err
+	}
+	e := f.encodingOr(cfg.currentEncoding())
+	scratch := NewState(StateEncoding(e), AutoEncoding(), MemoryLimit(0), MaxDepth(cfg.maxDepth), Roots(cfg.roots))
+	defer scratch.Close()
+	oldDoc := scratch.NewTable()
+	if old != nil {
+		if err := LoadNbt(old, scratch); err != nil {
+			return nil, err
+		}
+		oldDoc = scratch.GetGlobal("nbt").(*lua.LTable)
+		getConfig(scratch).setEncoding(e)
+	}
+	if err := LoadNbt(b, scratch); err != nil {
+		return nil, err
+	}
+	d := &differ{L: scratch, c: newCodec(scratch)}
+	if old != nil {
+		d.format(oldDoc, scratch.GetGlobal("nbt").(*lua.LTable))
+	}
+	d.compound(nil, diffRoot(scratch, oldDoc), diffRoot(scratch, scratch.GetGlobal("nbt").(*lua.LTable)))
+	return d.changes, nil
+}
+
+// diffRoot is the compound whose children a document's paths start from: as for GetPath when there is one root
+// tag, else the document itself, so each root is a child
+func diffRoot(L *lua.LState, doc *lua.LTable) *lua.LTable {
+	if doc.Len() == 1 {
+		return rootCompound(L, doc)
+	}
+	return doc
+}
+
+type differ struct {
+	L       *lua.LState
+	c       *codec
+	changes []Change
+}
+
+func (d *differ) add(kind ChangeKind, path []pathStep, old, new string) {
+	d.changes = append(d.changes, Change{kind, pathString(path), old, new})
+}
+
+// format compares how LoadNbt found two documents stored
+func (d *differ) format(old, new *lua.LTable) {
+	for _, field := range []string{"encoding", "compression"} {
+		if o, n := docField(old, field), docField(new, field); o != n {
+			d.changes = append(d.changes, Change{FormatChanged, field, o, n})
+		}
+	}
+	header := func(doc *lua.LTable) string {
+		if version, ok := doc.RawGetString("header_version").(lua.LNumber); ok {
+			return version.String()
+		}
+		return "none"
+	}
+	if o, n := header(old), header(new); o != n {
+		d.changes = append(d.changes, Change{FormatChanged, "header_version", o, n})
+	}
+}
+
+func (d *differ) snbt(v lua.LValue, t byte) string {
+	w := &snbtWriter{L: d.L, c: d.c}
+	if err := w.value(v, t); err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return w.b.String()
+}
+
+// compound compares two compound value tables, matching the nth tag of each name in old with the nth in new
+func (d *differ) compound(path []pathStep, old, new *lua.LTable) {
+	type key struct {
+		name string
+		n    int
+	}
+	children := func(compound *lua.LTable) ([]key, map[key]*lua.LTable) {
+		var keys []key
+		tags := map[key]*lua.LTable{}
+		seen := map[string]int{}
+		for i := 1; i <= compound.Len(); i++ {
+			if tag, ok := compound.RawGetInt(i).(*lua.LTable); ok && tagType(tag) != 0 {
+				name := lua.LVAsString(tag.RawGetString("name"))
+				k := key{name, seen[name]}
+				seen[name]++
+				keys = append(keys, k)
+				tags[k] = tag
+			}
+		}
+		return keys, tags
+	}
+	oldKeys, oldTags := children(old)
+	newKeys, newTags := children(new)
+	for _, k := range newKeys {
+		tag, childPath := newTags[k], append(path, pathStep{name: k.name})
+		if o := oldTags[k]; o != nil {
+			d.tag(childPath, o, tag)
+		} else {
+			d.add(TagAdded, childPath, "", d.snbt(tagValue(d.L, tag), tagType(tag)))
+		}
+	}
+	for _, k := range oldKeys {
+		if tag := oldTags[k]; newTags[k] == nil {
+			d.add(TagRemoved, append(path, pathStep{name: k.name}), d.snbt(tagValue(d.L, tag), tagType(tag)), "")
+		}
+	}
+}
+
+func (d *differ) tag(path []pathStep, old, new *lua.LTable) {
+	if ot, nt := tagType(old), tagType(new); ot != nt {
+		d.add(TagChanged, path, d.snbt(tagValue(d.L, old), ot), d.snbt(tagValue(d.L, new), nt))
+		return
+	}
+	d.value(path, tagValue(d.L, old), tagValue(d.L, new), tagType(new))
+}
+
+// value compares two values of tag type t, going into compounds and lists of the same element type
+func (d *differ) value(path []pathStep, old, new lua.LValue, t byte) {
+	switch t {
+	case 10:
+		o, oldOk := old.(*lua.LTable)
+		n, newOk := new.(*lua.LTable)
+		if oldOk && newOk {
+			d.compound(path, o, n)
+			return
+		}
+	case 9:
+		oldElems, oldType := listOf(old)
+		newElems, newType := listOf(new)
+		if oldElems != nil && newElems != nil && (oldType == newType || oldElems.Len() == 0 || newElems.Len() == 0) {
+			for i := 1; i <= oldElems.Len() || i <= newElems.Len(); i++ {
+				childPath := append(path, pathStep{index: i - 1, isIdx: true})
+				switch {
+				case i > newElems.Len():
+					d.add(TagRemoved, childPath, d.snbt(oldElems.RawGetInt(i), oldType), "")
+				case i > oldElems.Len():
+					d.add(TagAdded, childPath, "", d.snbt(newElems.RawGetInt(i), newType))
+				default:
+					d.value(childPath, oldElems.RawGetInt(i), newElems.RawGetInt(i), newType)
+				}
+			}
+			return
+		}
+	}
+	if o, n := d.snbt(old, t), d.snbt(new, t); o != n {
+		d.add(TagChanged, path, o, n)
+	}
+}
+
+// listOf returns a list value's element table and element type
+func listOf(v lua.LValue) (*lua.LTable, byte) {
+	list, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, 0
+	}
+	elements, _ := list.RawGetString("list").(*lua.LTable)
+	listType, _ := list.RawGetString("tagListType").(lua.LNumber)
+	return elements, byte(listType)
+}
+
+// changeReport is the report of the changes a dry run found for path, as one string so that it can be printed in
+// one write without interleaving with other states' output
+func changeReport(path string, changes []Change) string {
+	plural := "s"
+	if len(changes) == 1 {
+		plural = ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dry run, not saving %s: %d change%s\n", path, len(changes), plural)
+	for _, c := range changes {
+		b.WriteString("  " + c.String() + "\n")
+	}
+	return b.String()
+}
+
+// dryRunSave is savenbt in a dry run: instead of writing path in format f it prints and returns the changes saving
+// would make
+func dryRunSave(L *lua.LState, path string, f fileFormat) int {
+	var old []byte
+	if path != "-" {
+		var err error
+		if old, err = getConfig(L).readFile(path); os.IsNotExist(err) {
+			old = nil
+		} else if err != nil {
+			return saveError(L, "Error reading file", err)
+		}
+	}
+	changes, err := diffFile(L, old, f)
+	if err != nil {
+		return saveError(L, "Error comparing file", err)
+	}
+	io.WriteString(getConfig(L).output(), changeReport(path, changes))
+	t := L.CreateTable(len(changes), 0)
+	for _, c := range changes {
+		change := L.CreateTable(0, 4)
+		change.RawSetString("kind", lua.LString(c.Kind.String()))
+		change.RawSetString("path", lua.LString(c.Path))
+		if c.Kind != TagAdded {
+			change.RawSetString("old", lua.LString(c.Old))
+		}
+		if c.Kind != TagRemoved {
+			change.RawSetString("new", lua.LString(c.New))
+		}
+		t.Append(change)
+	}
+	L.Push(t)
+	return 1
+}
@@ -0,0 +1,115 @@
+package nlua
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestDiffNbt(t *testing.T) {
+	L := NewState(StateEncoding(JavaEncoding))
+	defer L.Close()
+	if err := L.DoString(textDoc); err != nil {
+		t.Fatal(err)
+	}
+	old, err := Lua2Nbt(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := DiffNbt(L, old); err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes, got %v, %v", changes, err)
+	}
+	for _, set := range [][2]string{{"Count", "2"}, {"Pos[1]", "4"}, {"new", "{a:1b}"}} {
+		if err := SetPath(L, set[0], set[1], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeletePath(L, "Pos[2]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeletePath(L, `"display name"`); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := DiffNbt(L, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{TagChanged, "Count", "1b", "2b"},
+		{TagChanged, "Pos[1]", "-2d", "4d"},
+		{TagRemoved, "Pos[2]", "3d", ""},
+		{TagAdded, "new", "", "{a:1b}"},
+		{TagRemoved, `"display name"`, "{n:-7}", ""},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("expected %v, got %v", want, changes)
+	}
+	report := "Dry run, not saving x.dat: 2 changes\n  ~ Count: 1b -> 2b\n  ~ Pos[1]: -2d -> 4d\n"
+	if r := changeReport("x.dat", changes[:2]); r != report {
+		t.Errorf("expected report %q, got %q", report, r)
+	}
+
+	// a dry run writes nothing and returns the changes
+	dir, err := ioutil.TempDir("", "nlua-dry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "new.dat")
+	var out bytes.Buffer
+	dry := NewState(StateEncoding(JavaEncoding), DryRun(), Stdio(nil, &out))
+	defer dry.Close()
+	if err := dry.DoString(textDoc + "\nchanges = savenbt(\"" + filepath.ToSlash(path) + "\")"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("dry run wrote the file")
+	}
+	if n := dry.GetGlobal("changes").(*lua.LTable).Len(); n != 10 {
+		t.Errorf("expected 10 added tags, got %d", n)
+	}
+	if !strings.HasPrefix(out.String(), "Dry run, not saving ") {
+		t.Errorf("expected the report written to the Stdio writer, got %q", out.String())
+	}
+}
+
+func TestDryRunFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nlua-dry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "level.dat")
+	// a Bedrock level.dat: storage version 10 and length header, then compound "" containing int "n" = 5
+	level := []byte{10, 0, 0, 0, 12, 0, 0, 0, 10, 0, 0, 3, 1, 0, 'n', 5, 0, 0, 0, 0}
+	if err := ioutil.WriteFile(path, level, 0644); err != nil {
+		t.Fatal(err)
+	}
+	L := NewState(StateEncoding(JavaEncoding), AutoEncoding(), DryRun())
+	defer L.Close()
+	L.SetGlobal("path", lua.LString(path))
+	err = L.DoString(`
+		loadnbt(path)
+		nbt.encoding, nbt.compression, nbt.header_version = "java", "gzip", nil
+		changes = savenbt()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := L.GetGlobal("changes").(*lua.LTable)
+	var got []string
+	for i := 1; i <= changes.Len(); i++ {
+		c := changes.RawGetInt(i).(*lua.LTable)
+		got = append(got, lua.LVAsString(c.RawGetString("kind"))+" "+lua.LVAsString(c.RawGetString("path"))+" "+
+			lua.LVAsString(c.RawGetString("old"))+" "+lua.LVAsString(c.RawGetString("new")))
+	}
+	want := []string{"format encoding bedrock java", "format compression none gzip", "format header_version 10 none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,338 @@
+package nlua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Encoding is how binary NBT stores numbers and lengths
+type Encoding int
+
+const (
+	// BedrockEncoding is little endian, as in Bedrock Edition files and world databases
+	BedrockEncoding Encoding = iota
+	// JavaEncoding is big endian, as in Java Edition files
+	JavaEncoding
+	// NetworkEncoding is Bedrock Edition's network protocol NBT: little endian, with ints, longs and lengths as
+	// varints
+	NetworkEncoding
+)
+
+var encodingNames = []string{"bedrock", "java", "network"}
+
+func (e Encoding) String() string {
+	if e >= 0 && int(e) < len(encodingNames) {
+		return encodingNames[e]
+	}
+	return fmt.Sprintf("Encoding(%d)", int(e))
+}
+
+// ParseEncoding returns the Encoding named "java", "bedrock" or "network"
+func ParseEncoding(s string) (Encoding, error) {
+	for i, name := range encodingNames {
+		if s == name {
+			return Encoding(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encoding '%s'; expected java, bedrock or network", s)
+}
+
+// order is the byte order of fixed size numbers; network encoding's are little endian
+func (e Encoding) order() binary.ByteOrder {
+	if e == JavaEncoding {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// Used by all converters; change with UseJavaEncoding(), UseBedrockEncoding() or UseNetworkEncoding()
+var encoding = BedrockEncoding
+
+// UseEncoding sets the module to decode/encode from/to NBT in encoding e
+func UseEncoding(e Encoding) {
+	encoding = e
+}
+
+// UseNetworkEncoding sets the module to decode/encode from/to the NBT of the Bedrock Edition network protocol
+func UseNetworkEncoding() {
+	encoding = NetworkEncoding
+}
+
+// Network NBT is converted to and from little endian NBT at the byte level, so the codec only ever deals in
+// fixed size numbers.
+
+// transcoder copies NBT from r to w, reading and writing ints, longs and lengths as varints or little endian
+type transcoder struct {
+	r               *bytes.Reader
+	w               *bytes.Buffer
+	fromNet, toNet  bool
+	maxDepth, depth int
+}
+
+func (t *transcoder) readInt32() (int32, error) {
+	if t.fromNet {
+		v, err := binary.ReadUvarint(t.r)
+		if v > 0xffffffff {
+			return 0, fmt.Errorf("varint %d is too big for an int", v)
+		}
+		u := uint32(v)
+		return int32(u>>1) ^ -int32(u&1), err
+	}
+	var n int32
+	err := binary.Read(t.r, binary.LittleEndian, &n)
+	return n, err
+}
+
+func (t *transcoder) writeInt32(n int32) {
+	if t.toNet {
+		var b [binary.MaxVarintLen32]byte
+		t.w.Write(b[:binary.PutUvarint(b[:], uint64(uint32(n<<1^n>>31)))])
+		return
+	}
+	binary.Write(t.w, binary.LittleEndian, n)
+}
+
+func (t *transcoder) int32() (int32, error) {
+	n, err := t.readInt32()
+	if err == nil {
+		t.writeInt32(n)
+	}
+	return n, err
+}
+
+func (t *transcoder) int64() error {
+	var n int64
+	var err error
+	if t.fromNet {
+		n, err = binary.ReadVarint(t.r)
+	} else {
+		err = binary.Read(t.r, binary.LittleEndian, &n)
+	}
+	if err != nil {
+		return err
+	}
+	if t.toNet {
+		var b [binary.MaxVarintLen64]byte
+		t.w.Write(b[:binary.PutVarint(b[:], n)])
+	} else {
+		binary.Write(t.w, binary.LittleEndian, n)
+	}
+	return nil
+}
+
+// length copies a length and checks that at least n * size bytes follow
+func (t *transcoder) length(size int) (int, error) {
+	n, err := t.int32()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || int64(n)*int64(size) > int64(t.r.Len()) {
+		return 0, fmt.Errorf("length %d exceeds remaining data", n)
+	}
+	return int(n), nil
+}
+
+// string copies a string: a varint length in network NBT, a 16 bit one otherwise
+func (t *transcoder) string() error {
+	var n uint64
+	var err error
+	if t.fromNet {
+		n, err = binary.ReadUvarint(t.r)
+	} else {
+		var l uint16
+		err = binary.Read(t.r, binary.LittleEndian, &l)
+		n = uint64(l)
+	}
+	if err != nil {
+		return err
+	}
+	if n > 0xffff || n > uint64(t.r.Len()) {
+		return fmt.Errorf("string length %d is too long", n)
+	}
+	if t.toNet {
+		var b [binary.MaxVarintLen32]byte
+		t.w.Write(b[:binary.PutUvarint(b[:], n)])
+	} else {
+		binary.Write(t.w, binary.LittleEndian, uint16(n))
+	}
+	_, err = io.CopyN(t.w, t.r, int64(n))
+	return err
+}
+
+func (t *transcoder) copy(n int64) error {
+	_, err := io.CopyN(t.w, t.r, n)
+	return err
+}
+
+func (t *transcoder) tag() (byte, error) {
+	tagType, err := t.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	t.w.WriteByte(tagType)
+	if tagType == 0 {
+		return 0, nil
+	}
+	if err := t.string(); err != nil {
+		return 0, err
+	}
+	return tagType, t.payload(tagType)
+}
+
+func (t *transcoder) payload(tagType byte) error {
+	switch tagType {
+	case 1:
+		return t.copy(1)
+	case 2:
+		return t.copy(2)
+	case 3:
+		_, err := t.int32()
+		return err
+	case 4:
+		return t.int64()
+	case 5:
+		return t.copy(4)
+	case 6:
+		return t.copy(8)
+	case 7:
+		n, err := t.length(1)
+		if err != nil {
+			return err
+		}
+		return t.copy(int64(n))
+	case 8:
+		return t.string()
+	case 9, 10:
+		if t.maxDepth > 0 && t.depth >= t.maxDepth {
+			return fmt.Errorf("nesting deeper than the maximum of %d", t.maxDepth)
+		}
+		t.depth++
+		defer func() { t.depth-- }()
+		if tagType == 10 {
+			for {
+				childType, err := t.tag()
+				if err != nil || childType == 0 {
+					return err
+				}
+			}
+		}
+		listType, err := t.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		t.w.WriteByte(listType)
+		n, err := t.length(1)
+		for i := 0; i < n && err == nil; i++ {
+			err = t.payload(listType)
+		}
+		return err
+	case 11, 12:
+		n, err := t.length(1)
+		for i := 0; i < n && err == nil; i++ {
+			if tagType == 11 {
+				_, err = t.int32()
+			} else {
+				err = t.int64()
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("TagType %d not recognized", tagType)
+}
+
+// transcode converts every top-level tag of b between network and little endian NBT. Anything after the last
+// tag that can't be converted is copied as is, to be dealt with as trailing data.
+func transcode(b []byte, fromNet bool, maxDepth int) ([]byte, error) {
+	t := &transcoder{r: bytes.NewReader(b), w: new(bytes.Buffer), fromNet: fromNet, toNet: !fromNet, maxDepth: maxDepth}
+	for t.r.Len() > 0 {
+		start, written := len(b)-t.r.Len(), t.w.Len()
+		if _, err := t.tag(); err != nil {
+			if written == 0 {
+				return nil, NbtParseError{"Converting network NBT", err}
+			}
+			t.w.Truncate(written)
+			t.w.Write(b[start:])
+			break
+		}
+	}
+	return t.w.Bytes(), nil
+}
+
+// Detection reads the chain of tag headers at the start of the data, the root tag and, while they're compounds,
+// each first child, in each encoding. In the wrong one, name lengths come out as huge or the names as binary.
+
+// headersToCheck is how many nested tag headers are checked
+const headersToCheck = 4
+
+// nameLength reads a tag name length at the start of b in encoding e, returning it and the bytes it takes
+func (e Encoding) nameLength(b []byte) (int, int) {
+	switch e {
+	case NetworkEncoding:
+		n, size := binary.Uvarint(b)
+		if size <= 0 || n > 0xffff {
+			return -1, 0
+		}
+		return int(n), size
+	case JavaEncoding:
+		if len(b) < 2 {
+			return -1, 0
+		}
+		return int(binary.BigEndian.Uint16(b)), 2
+	}
+	if len(b) < 2 {
+		return -1, 0
+	}
+	return int(binary.LittleEndian.Uint16(b)), 2
+}
+
+// plausibleName reports whether name looks like a tag name: valid UTF-8 without control characters
+func plausibleName(name []byte) bool {
+	for _, r := range string(name) {
+		if r < ' ' || r == 0x7f || r == utf8.RuneError {
+			return false
+		}
+	}
+	return true
+}
+
+// plausible reports whether b's leading tag headers make sense in encoding e
+func (e Encoding) plausible(b []byte) bool {
+	p := 0
+	for depth := 0; depth < headersToCheck && p < len(b); depth++ {
+		t := b[p]
+		if t > 12 || (t == 0 && depth == 0) {
+			return false
+		}
+		if t == 0 {
+			// an empty root compound is only plausible at the end of the data
+			return p+1 == len(b)
+		}
+		n, size := e.nameLength(b[p+1:])
+		if n < 0 || p+1+size+n > len(b) || !plausibleName(b[p+1+size:p+1+size+n]) {
+			return false
+		}
+		p += 1 + size + n
+		if t != 10 {
+			return true
+		}
+	}
+	return p <= len(b)
+}
+
+// DetectEncoding guesses the encoding of uncompressed NBT from the names of its leading tags. When several
+// encodings fit, as with tiny documents, fallback is preferred if it is one of them, then Java, then Bedrock
+// Edition. If none fit, fallback is returned and decoding will report the error.
+func DetectEncoding(b []byte, fallback Encoding) Encoding {
+	if fallback.plausible(b) {
+		return fallback
+	}
+	for _, e := range []Encoding{JavaEncoding, BedrockEncoding, NetworkEncoding} {
+		if e.plausible(b) {
+			return e
+		}
+	}
+	return fallback
+}
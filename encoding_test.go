@@ -0,0 +1,100 @@
+package nlua
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNetworkEncoding(t *testing.T) {
+	defer UseBedrockEncoding()
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(textDoc); err != nil {
+		t.Fatal(err)
+	}
+	UseBedrockEncoding()
+	le, err := Lua2Nbt(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseNetworkEncoding()
+	net, err := Lua2Nbt(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compound, empty name as a one byte varint, then byte tag "Count"
+	if !bytes.HasPrefix(net, []byte{10, 0, 1, 5, 'C', 'o', 'u', 'n', 't', 1}) || len(net) >= len(le) {
+		t.Fatalf("unexpected network NBT % x", net)
+	}
+	if err := Nbt2Lua(net, L); err != nil {
+		t.Fatal(err)
+	}
+	UseBedrockEncoding()
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, le) {
+		t.Errorf("network round trip changed the NBT: %v", err)
+	}
+
+	UseNetworkEncoding()
+	// int -1 is zigzag 1; an int list of 2 is zigzag 4
+	if err := Nbt2Lua([]byte{3, 1, 'i', 1, 9, 0, 3, 4, 2, 3}, L); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(nbt[1].value == -1 and nbt[2].value.list[1] == 1 and nbt[2].value.list[2] == -2)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	data := []byte{10, 0, 0, 0}
+	for _, c := range []Compression{NoCompression, Gzip, Zlib} {
+		compressed, err := Compress(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, found, err := Decompress(compressed)
+		if err != nil || found != c || !bytes.Equal(got, data) {
+			t.Errorf("%v: got % x, %v, %v", c, got, found, err)
+		}
+	}
+}
+
+func TestDetectEncoding(t *testing.T) {
+	defer UseBedrockEncoding()
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(textDoc); err != nil {
+		t.Fatal(err)
+	}
+	encoded := map[Encoding][]byte{}
+	for _, e := range []Encoding{JavaEncoding, BedrockEncoding, NetworkEncoding} {
+		UseEncoding(e)
+		b, err := Lua2Nbt(L)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded[e] = b
+		for _, fallback := range []Encoding{JavaEncoding, BedrockEncoding, NetworkEncoding} {
+			if got := DetectEncoding(b, fallback); got != e {
+				t.Errorf("%v NBT detected as %v with fallback %v", e, got, fallback)
+			}
+		}
+	}
+	// an empty unnamed compound is the same in every encoding
+	if got := DetectEncoding([]byte{10, 0, 0, 0}, BedrockEncoding); got != BedrockEncoding {
+		t.Errorf("ambiguous NBT detected as %v", got)
+	}
+
+	UseBedrockEncoding()
+	auto := NewState(AutoEncoding())
+	defer auto.Close()
+	compressed, _ := Compress(encoded[JavaEncoding], Gzip)
+	if err := LoadNbt(compressed, auto); err != nil {
+		t.Fatal(err)
+	}
+	if err := auto.DoString(`assert(nbt.encoding == "java" and nbt[1].value[1].value == 1)`); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := Lua2Nbt(auto); err != nil || !bytes.Equal(b, encoded[JavaEncoding]) {
+		t.Errorf("auto detected state didn't save back as Java: %v", err)
+	}
+}
@@ -4,5 +4,6 @@ go 1.13
 
 require (
 	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e
+	github.com/df-mc/goleveldb v1.1.9
 	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb
 )
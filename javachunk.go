@@ -0,0 +1,267 @@
+package nlua
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Data versions where Java Edition changed how chunk block states are packed
+const (
+	// 20w17a (1.16): block indices no longer span two longs
+	dataVersionNoSpanning = 2529
+	// 21w43a (1.18): sections moved to the root as "sections" with a "block_states" compound
+	dataVersionSections = 2844
+)
+
+// Blocks in a Java chunk section: 16 * 16 * 16
+const sectionBlocks = 4096
+
+// javaSection is the block state storage of one Java Edition chunk section
+type javaSection struct {
+	// states holds the palette and packed data: the section itself before 1.18, its block_states compound after
+	states   *lua.LTable
+	palette  *lua.LTable
+	dataName string
+	data     lua.LValue
+	// bits per index; 0 means a single-entry palette with no data
+	bits     int
+	spanning bool
+	// 1.18+ sections drop data when the palette has one entry
+	omitSingle bool
+}
+
+// findJavaSection returns the section of chunk holding block y, or an error if the chunk has no such section
+func findJavaSection(L *lua.LState, chunk *lua.LTable, y int) (*javaSection, error) {
+	root := rootCompound(L, chunk)
+	dataVersion := -1
+	if v, ok := findValue(L, root, "DataVersion", 3).(lua.LNumber); ok {
+		dataVersion = int(v)
+	}
+	s := &javaSection{}
+	sections, _ := findList(L, root, "sections")
+	if sections != nil {
+		s.omitSingle = true
+	} else {
+		level := findCompound(L, root, "Level")
+		if level == nil {
+			return nil, fmt.Errorf("no sections or Level compound; not a Java chunk")
+		}
+		sections, _ = findList(L, level, "Sections")
+		if sections == nil {
+			return nil, fmt.Errorf("no Level.Sections list")
+		}
+		s.spanning = dataVersion < dataVersionNoSpanning
+	}
+	sectionY := y >> 4
+	for i := 1; i <= sections.Len(); i++ {
+		section, ok := sections.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		if sy, ok := findValue(L, section, "Y", 1).(lua.LNumber); !ok || int(sy) != sectionY {
+			continue
+		}
+		if s.omitSingle {
+			s.states = findCompound(L, section, "block_states")
+			s.dataName = "data"
+			s.palette, _ = findList(L, s.states, "palette")
+		} else {
+			s.states = section
+			s.dataName = "BlockStates"
+			s.palette, _ = findList(L, section, "Palette")
+		}
+		if s.states == nil || s.palette == nil || s.palette.Len() == 0 {
+			// pre-1.13 sections have Blocks instead and 1.14-1.17 air-only sections have no palette
+			return nil, fmt.Errorf("section %d has no block state palette", sectionY)
+		}
+		s.data = findValue(L, s.states, s.dataName, 12)
+		s.bits = s.bitsFor(s.palette.Len())
+		if s.data == lua.LNil && s.bits != 0 {
+			return nil, fmt.Errorf("section %d has a palette of %d but no %s", sectionY, s.palette.Len(), s.dataName)
+		}
+		if n := longsLen(s.data); s.bits != 0 && n != s.numLongs() {
+			return nil, fmt.Errorf("section %d %s has %d longs; a palette of %d needs %d", sectionY, s.dataName, n, s.palette.Len(), s.numLongs())
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("no section for y %d", y)
+}
+
+// bitsFor is the number of bits per index for a palette size: at least 4, or 0 for one entry in 1.18+ sections
+func (s *javaSection) bitsFor(paletteSize int) int {
+	if paletteSize <= 1 && s.omitSingle {
+		return 0
+	}
+	bits := 4
+	for 1<<uint(bits) < paletteSize {
+		bits++
+	}
+	return bits
+}
+
+// numLongs is the length of the packed data for the section's bits per index
+func (s *javaSection) numLongs() int {
+	if s.bits == 0 {
+		return 0
+	}
+	if s.spanning {
+		return (sectionBlocks*s.bits + 63) / 64
+	}
+	perLong := 64 / s.bits
+	return (sectionBlocks + perLong - 1) / perLong
+}
+
+// location returns which long holds index i, at which bit offset; a spanning index continues in the next long
+func (s *javaSection) location(i int) (int, uint) {
+	if s.spanning {
+		return i * s.bits / 64, uint(i * s.bits % 64)
+	}
+	perLong := 64 / s.bits
+	return i / perLong, uint(i % perLong * s.bits)
+}
+
+func (s *javaSection) index(i int) int {
+	if s.bits == 0 {
+		return 0
+	}
+	k, offset := s.location(i)
+	mask := uint64(1)<<uint(s.bits) - 1
+	v := uint64(longAt(s.data, k)) >> offset
+	if int(offset)+s.bits > 64 {
+		v |= uint64(longAt(s.data, k+1)) << (64 - offset)
+	}
+	return int(v & mask)
+}
+
+func (s *javaSection) setIndex(L *lua.LState, i, n int) {
+	if s.bits == 0 {
+		return
+	}
+	k, offset := s.location(i)
+	mask := uint64(1)<<uint(s.bits) - 1
+	v := uint64(longAt(s.data, k))
+	v = v&^(mask<<offset) | uint64(n)<<offset
+	setLongAt(L, s.data, k, int64(v))
+	if int(offset)+s.bits > 64 {
+		shift := 64 - offset
+		v = uint64(longAt(s.data, k+1))
+		v = v&^(mask>>shift) | uint64(n)>>shift
+		setLongAt(L, s.data, k+1, int64(v))
+	}
+}
+
+// repack re-encodes every index with the bits needed for the current palette
+func (s *javaSection) repack(L *lua.LState) {
+	indices := make([]int, sectionBlocks)
+	for i := range indices {
+		indices[i] = s.index(i)
+	}
+	old := s.data
+	s.bits = s.bitsFor(s.palette.Len())
+	s.data = longsValue(L, make([]int64, s.numLongs()), old)
+	for i, n := range indices {
+		s.setIndex(L, i, n)
+	}
+	setTag(L, s.states, 12, s.dataName, s.data)
+}
+
+// blockIndex is the position of block x, y, z within its section
+func blockIndex(x, y, z int) int {
+	return (y&15)<<8 | (z&15)<<4 | x&15
+}
+
+func (s *javaSection) get(L *lua.LState, x, y, z int) blockState {
+	entry, _ := s.palette.RawGetInt(s.index(blockIndex(x, y, z)) + 1).(*lua.LTable)
+	if entry == nil {
+		return blockState{}
+	}
+	return javaBlockState(L, entry)
+}
+
+func (s *javaSection) set(L *lua.LState, x, y, z int, b blockState) {
+	want := b.String()
+	n := -1
+	for i := 1; i <= s.palette.Len(); i++ {
+		if entry, ok := s.palette.RawGetInt(i).(*lua.LTable); ok && javaBlockState(L, entry).String() == want {
+			n = i - 1
+			break
+		}
+	}
+	if n < 0 {
+		s.palette.Append(b.javaCompound(L))
+		n = s.palette.Len() - 1
+		if s.bitsFor(s.palette.Len()) != s.bits {
+			s.repack(L)
+		}
+	}
+	s.setIndex(L, blockIndex(x, y, z), n)
+}
+
+// longsLen returns the length of a long array value in either representation
+func longsLen(v lua.LValue) int {
+	if a := typedArrayOf(v); a != nil {
+		return a.len()
+	}
+	if t, ok := v.(*lua.LTable); ok {
+		return t.Len()
+	}
+	return 0
+}
+
+// longAt returns element k (zero-based) of a long array value in either representation, or 0 past its end
+func longAt(v lua.LValue, k int) int64 {
+	if k < 0 || k >= longsLen(v) {
+		return 0
+	}
+	if a := typedArrayOf(v); a != nil {
+		return a.get(k)
+	}
+	if t, ok := v.(*lua.LTable); ok {
+		n, _ := (&typedArray{tagType: 12}).fromLua(t.RawGetInt(k + 1))
+		return n
+	}
+	return 0
+}
+
+func setLongAt(L *lua.LState, v lua.LValue, k int, n int64) {
+	if k < 0 || k >= longsLen(v) {
+		return
+	}
+	if a := typedArrayOf(v); a != nil {
+		a.longs[k] = n
+	} else if t, ok := v.(*lua.LTable); ok {
+		t.RawSetInt(k+1, (&typedArray{tagType: 12}).toLua(L, n))
+	}
+}
+
+// get_block(chunk, x, y, z) returns the block state string of a Java chunk's block; x and z may be world or
+// chunk-relative coordinates
+func getBlock(L *lua.LState) int {
+	chunk := L.CheckTable(1)
+	x, y, z := L.CheckInt(2), L.CheckInt(3), L.CheckInt(4)
+	s, err := findJavaSection(L, chunk, y)
+	if err != nil {
+		return pushError(L, "Error getting block", err)
+	}
+	L.Push(lua.LString(s.get(L, x, y, z).String()))
+	return 1
+}
+
+// set_block(chunk, x, y, z, state) sets a Java chunk's block to a block state string like
+// "minecraft:oak_stairs[facing=north]", adding it to the section palette if needed
+func setBlock(L *lua.LState) int {
+	chunk := L.CheckTable(1)
+	x, y, z := L.CheckInt(2), L.CheckInt(3), L.CheckInt(4)
+	b, err := parseBlockState(L.CheckString(5))
+	if err != nil {
+		L.ArgError(5, err.Error())
+	}
+	s, err := findJavaSection(L, chunk, y)
+	if err != nil {
+		return pushError(L, "Error setting block", err)
+	}
+	s.set(L, x, y, z, b)
+	L.Push(lua.LTrue)
+	return 1
+}
@@ -0,0 +1,116 @@
+package nlua
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJavaChunkBlocks(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		L := NewState()
+		defer L.Close()
+		getConfig(L).compact = compact
+		err := L.DoString(`
+			-- 1.18+ chunk with one all-air section at y 0-15
+			nbt = { { tagType = 10, name = "", value = {
+				{ tagType = 3, name = "DataVersion", value = 3120 },
+				{ tagType = 9, name = "sections", value = { tagListType = 10, list = {
+					{
+						{ tagType = 1, name = "Y", value = 0 },
+						{ tagType = 10, name = "block_states", value = {
+							{ tagType = 9, name = "palette", value = { tagListType = 10, list = {
+								{ { tagType = 8, name = "Name", value = "minecraft:air" } },
+							} } },
+						} },
+					},
+				} } },
+			} } }
+
+			assert(get_block(nbt, 3, 4, 5) == "minecraft:air")
+			assert(set_block(nbt, 3, 4, 5, "stone"))
+			assert(get_block(nbt, 3, 4, 5) == "minecraft:stone")
+			assert(get_block(nbt, 3, 4, 6) == "minecraft:air")
+			-- world coordinates work too
+			assert(get_block(nbt, 19, 4, -11) == "minecraft:stone")
+			set_block(nbt, 0, 15, 0, "minecraft:oak_stairs[half=bottom,facing=north]")
+			assert(get_block(nbt, 0, 15, 0) == "minecraft:oak_stairs[facing=north,half=bottom]")
+			assert(get_block(nbt, 0, 16, 0) == nil)
+
+			-- grow the palette past 16 entries so indices need 5 bits
+			for i = 0, 20 do
+				set_block(nbt, i % 16, 8, math.floor(i / 16), "minecraft:wool_" .. i)
+			end
+			for i = 0, 20 do
+				assert(get_block(nbt, i % 16, 8, math.floor(i / 16)) == "minecraft:wool_" .. i, "block " .. i)
+			end
+			assert(get_block(nbt, 3, 4, 5) == "minecraft:stone")
+			assert(get_block(nbt, 0, 15, 0) == "minecraft:oak_stairs[facing=north,half=bottom]")
+		`)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("compact %v: ", compact), err)
+		}
+		if _, err := Lua2Nbt(L); err != nil {
+			t.Errorf("compact %v: edited chunk doesn't convert: %v", compact, err)
+		}
+	}
+}
+
+func TestJavaSectionSpanning(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	for _, spanning := range []bool{false, true} {
+		s := &javaSection{bits: 5, spanning: spanning}
+		numLongs := 4096 * 5 / 64
+		if !spanning {
+			numLongs = (4096 + 11) / 12
+		}
+		s.data = longsValue(L, make([]int64, numLongs), nil)
+		for i := 0; i < sectionBlocks; i++ {
+			s.setIndex(L, i, i%31)
+		}
+		for i := 0; i < sectionBlocks; i++ {
+			if n := s.index(i); n != i%31 {
+				t.Fatalf("spanning %v: index %d expected %d, got %d", spanning, i, i%31, n)
+			}
+		}
+	}
+	// pre-1.16 packing: 5-bit index 12 starts at bit 60 and continues in the second long
+	s := &javaSection{bits: 5, spanning: true}
+	s.data = longsValue(L, make([]int64, 2), nil)
+	s.setIndex(L, 12, 0x1f)
+	if longAt(s.data, 0) != -1<<60 || longAt(s.data, 1) != 1 {
+		t.Errorf("spanning index stored as %x %x", longAt(s.data, 0), longAt(s.data, 1))
+	}
+}
+
+func TestJavaSectionDataLength(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+		-- a two-entry palette needs 256 longs of 4-bit indices, but data holds one
+		for _, data in ipairs({ { 0 }, nbt_array(12, 1) }) do
+			nbt = { { tagType = 10, name = "", value = {
+				{ tagType = 3, name = "DataVersion", value = 3120 },
+				{ tagType = 9, name = "sections", value = { tagListType = 10, list = {
+					{
+						{ tagType = 1, name = "Y", value = 0 },
+						{ tagType = 10, name = "block_states", value = {
+							{ tagType = 9, name = "palette", value = { tagListType = 10, list = {
+								{ { tagType = 8, name = "Name", value = "minecraft:air" } },
+								{ { tagType = 8, name = "Name", value = "minecraft:stone" } },
+							} } },
+							{ tagType = 12, name = "data", value = data },
+						} },
+					},
+				} } },
+			} } }
+			local b, msg = get_block(nbt, 255, 0, 0)
+			assert(b == nil and msg:find("has 1 longs"), msg)
+			b, msg = set_block(nbt, 0, 0, 0, "stone")
+			assert(b == nil and msg:find("has 1 longs"), msg)
+		end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
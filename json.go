@@ -0,0 +1,244 @@
+package nlua
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The JSON form mirrors the lua table form, so it keeps every tag type and root name: a document is an array of
+// {"tagType", "name", "value"} objects, compound values are arrays of tags, list values are
+// {"tagListType", "list"} objects, longs are {"least", "most"} objects, and NaN floats are null.
+
+type jsonTag struct {
+	TagType byte            `json:"tagType"`
+	Name    string          `json:"name"`
+	Value   json.RawMessage `json:"value"`
+}
+
+type jsonList struct {
+	TagListType byte              `json:"tagListType"`
+	List        []json.RawMessage `json:"list"`
+}
+
+type jsonLong struct {
+	Least uint32 `json:"least"`
+	Most  uint32 `json:"most"`
+}
+
+// Lua2Json converts lua's global nbt table variable to JSON
+func Lua2Json(L *lua.LState) ([]byte, error) {
+	doc, ok := L.GetGlobal("nbt").(*lua.LTable)
+	if !ok {
+		return nil, LuaNbtError{fmt.Sprintf("Global nbt type, expected %T, got %T", lua.LTable{}, L.GetGlobal("nbt")), nil}
+	}
+	if doc.RawGetString("trailing") != lua.LNil {
+		return nil, LuaNbtError{"trailing data can't be written as JSON", nil}
+	}
+	c := newCodec(L)
+	tags, err := jsonTags(doc, c)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, tags, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// jsonTags converts a compound value or document table to a JSON array of tags
+func jsonTags(t *lua.LTable, c *codec) (json.RawMessage, error) {
+	tags := []jsonTag{}
+	for i := 1; i <= t.Len(); i++ {
+		tag, ok := t.RawGetInt(i).(*lua.LTable)
+		if !ok || tagType(tag) == 0 {
+			continue
+		}
+		value, err := jsonValue(tagValue(c.L, tag), tagType(tag), c)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, jsonTag{tagType(tag), lua.LVAsString(tag.RawGetString("name")), value})
+	}
+	return json.Marshal(tags)
+}
+
+func jsonValue(v lua.LValue, t byte, c *codec) (json.RawMessage, error) {
+	switch t {
+	case 1, 2, 3, 5, 6:
+		n, ok := v.(lua.LNumber)
+		if !ok && t < 5 {
+			return nil, LuaNbtError{fmt.Sprintf("Tag %d value field '%v' not a number", t, v), nil}
+		}
+		if f := float64(n); !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+			return json.RawMessage("null"), nil
+		}
+		return json.Marshal(float64(n))
+	case 4:
+		n, err := (&typedArray{tagType: 12}).fromLua(v)
+		if err != nil {
+			return nil, LuaNbtError{"Tag 4 Long value", err}
+		}
+		least, most := longToIntPair(n)
+		return json.Marshal(jsonLong{least, most})
+	case 7, 11, 12:
+		a, err := arrayOf(v, t)
+		if err != nil {
+			return nil, LuaNbtError{fmt.Sprintf("Tag %d array value", t), err}
+		}
+		elements := make([]interface{}, a.len())
+		for i := range elements {
+			if t == 12 {
+				least, most := longToIntPair(a.get(i))
+				elements[i] = jsonLong{least, most}
+			} else {
+				elements[i] = a.get(i)
+			}
+		}
+		return json.Marshal(elements)
+	case 8:
+		s, ok := v.(lua.LString)
+		if !ok {
+			return nil, LuaNbtError{fmt.Sprintf("Tag 8 String value field '%v' not a string", v), nil}
+		}
+		return json.Marshal(string(s))
+	case 9:
+		list, ok := v.(*lua.LTable)
+		if !ok {
+			return nil, LuaNbtError{fmt.Sprintf("Tag 9 List value field '%v' not a table", v), nil}
+		}
+		if err := c.enter(); err != nil {
+			return nil, LuaNbtError{"Writing list tag", err}
+		}
+		defer c.leave()
+		listType, _ := list.RawGetString("tagListType").(lua.LNumber)
+		elements, _ := list.RawGetString("list").(*lua.LTable)
+		out := jsonList{byte(listType), []json.RawMessage{}}
+		for i := 1; elements != nil && i <= elements.Len(); i++ {
+			e, err := jsonValue(elements.RawGetInt(i), byte(listType), c)
+			if err != nil {
+				return nil, err
+			}
+			out.List = append(out.List, e)
+		}
+		return json.Marshal(out)
+	case 10:
+		compound, ok := v.(*lua.LTable)
+		if !ok {
+			return nil, LuaNbtError{fmt.Sprintf("Tag 10 Compound value field '%v' not a table", v), nil}
+		}
+		if err := c.enter(); err != nil {
+			return nil, LuaNbtError{"Writing compound tag", err}
+		}
+		defer c.leave()
+		return jsonTags(compound, c)
+	}
+	return nil, LuaNbtError{fmt.Sprintf("TagType %d not recognized", t), nil}
+}
+
+// Json2Lua converts the JSON form written by Lua2Json to the global `nbt` variable of a github.com/yuin/gopher-lua
+// LState
+func Json2Lua(b []byte, L *lua.LState) error {
+	doc, err := luaTags(json.RawMessage(b), newCodec(L))
+	if err != nil {
+		return err
+	}
+	L.SetGlobal("nbt", doc)
+	return nil
+}
+
+func luaTags(b json.RawMessage, c *codec) (*lua.LTable, error) {
+	var tags []jsonTag
+	if err := json.Unmarshal(b, &tags); err != nil {
+		return nil, NbtParseError{"Reading JSON tags", err}
+	}
+	t := c.L.CreateTable(len(tags), 0)
+	for _, tag := range tags {
+		value, err := luaValue(tag.Value, tag.TagType, c)
+		if err != nil {
+			return nil, err
+		}
+		t.Append(newTag(c.L, tag.TagType, tag.Name, value))
+	}
+	return t, nil
+}
+
+func luaValue(b json.RawMessage, t byte, c *codec) (lua.LValue, error) {
+	switch t {
+	case 1, 2, 3, 5, 6:
+		var n *float64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return nil, NbtParseError{fmt.Sprintf("Reading JSON tag %d", t), err}
+		}
+		if n == nil {
+			return lua.LNumber(math.NaN()), nil
+		}
+		return lua.LNumber(*n), nil
+	case 4:
+		var n jsonLong
+		if err := json.Unmarshal(b, &n); err != nil {
+			return nil, NbtParseError{"Reading JSON long", err}
+		}
+		return (&typedArray{tagType: 12}).toLua(c.L, intPairToLong(n.Least, n.Most)), nil
+	case 7, 11, 12:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(b, &elements); err != nil {
+			return nil, NbtParseError{fmt.Sprintf("Reading JSON tag %d array", t), err}
+		}
+		a, _ := newTypedArray(t, 0)
+		for i, e := range elements {
+			var n int64
+			var err error
+			if t == 12 {
+				var l jsonLong
+				err = json.Unmarshal(e, &l)
+				n = intPairToLong(l.Least, l.Most)
+			} else {
+				err = json.Unmarshal(e, &n)
+			}
+			if err == nil {
+				err = a.set(i, n)
+			}
+			if err != nil {
+				return nil, NbtParseError{fmt.Sprintf("Reading JSON tag %d array", t), err}
+			}
+		}
+		return arrayValue(c.L, a, lua.LNil), nil
+	case 8:
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, NbtParseError{"Reading JSON string", err}
+		}
+		return lua.LString(s), nil
+	case 9:
+		if err := c.enter(); err != nil {
+			return nil, NbtParseError{"Reading JSON list", err}
+		}
+		defer c.leave()
+		var list jsonList
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil, NbtParseError{"Reading JSON list", err}
+		}
+		elements := c.L.CreateTable(len(list.List), 0)
+		for _, e := range list.List {
+			v, err := luaValue(e, list.TagListType, c)
+			if err != nil {
+				return nil, err
+			}
+			elements.Append(v)
+		}
+		return newList(c.L, list.TagListType, elements), nil
+	case 10:
+		if err := c.enter(); err != nil {
+			return nil, NbtParseError{"Reading JSON compound", err}
+		}
+		defer c.leave()
+		return luaTags(b, c)
+	}
+	return nil, NbtParseError{fmt.Sprintf("TagType %d not recognized", t), nil}
+}
@@ -0,0 +1,192 @@
+package nlua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Metatable field of a lazy tag that holds its *lazyPayload userdata
+const lazyMetaField = "lazy"
+
+// lazyPayload is the still-encoded payload of a compound or list tag read in lazy mode
+type lazyPayload struct {
+	raw     []byte
+	tagType byte
+	order   binary.ByteOrder
+	// nesting depth of the tag, so the depth limit still applies once decoded
+	depth int
+	// offset of raw in the originally decoded data
+	base int
+}
+
+// setLazy skips over the payload of tag instead of decoding it, and gives tag a metatable that decodes
+// the payload into tag.value the first time a script reads it
+func (c *codec) setLazy(tag *lua.LTable, r *bytes.Reader, tagType byte) error {
+	start := len(c.src) - r.Len()
+	if err := c.skipPayload(r, tagType); err != nil {
+		return err
+	}
+	L := c.L
+	ud := L.NewUserData()
+	ud.Value = &lazyPayload{
+		raw:     c.src[start : len(c.src)-r.Len()],
+		tagType: tagType,
+		order:   c.order,
+		depth:   c.depth,
+		base:    c.base + start,
+	}
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(lazyIndex))
+	mt.RawSetString(lazyMetaField, ud)
+	tag.Metatable = mt
+	return nil
+}
+
+// lazyPayloadOf returns the undecoded payload of a lazy tag which hasn't been read yet, or nil
+func lazyPayloadOf(tag *lua.LTable) *lazyPayload {
+	if mt, ok := tag.Metatable.(*lua.LTable); ok {
+		if ud, ok := mt.RawGetString(lazyMetaField).(*lua.LUserData); ok {
+			if p, ok := ud.Value.(*lazyPayload); ok {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// decode converts the payload to lua, leaving any compound/list tags inside it lazy
+func (p *lazyPayload) decode(L *lua.LState) (lua.LValue, error) {
+	c := newCodec(L)
+	c.order = p.order
+	c.lazy = true
+	c.src = p.raw
+	c.depth = p.depth
+	c.base = p.base
+	return getPayload(bytes.NewReader(p.raw), p.tagType, c)
+}
+
+// lazyIndex is the __index metamethod of lazy tags; only "value" is ever missing from a tag
+func lazyIndex(L *lua.LState) int {
+	tag := L.CheckTable(1)
+	if L.Get(2) != lua.LString("value") {
+		return 0
+	}
+	p := lazyPayloadOf(tag)
+	if p == nil {
+		return 0
+	}
+	value, err := p.decode(L)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	tag.RawSetString("value", value)
+	tag.Metatable = lua.LNil
+	L.Push(value)
+	return 1
+}
+
+// write writes the payload of a lazy tag that was never read: verbatim if the encoding is unchanged,
+// otherwise by decoding and re-encoding it
+func (p *lazyPayload) write(w io.Writer, tagType lua.LNumber, c *codec) error {
+	if byte(tagType) != p.tagType {
+		return LuaNbtError{fmt.Sprintf("tagType changed from %d to %v without reading the value", p.tagType, tagType), nil}
+	}
+	if p.order == c.order {
+		_, err := w.Write(p.raw)
+		if err != nil {
+			return LuaNbtError{"Error writing unread payload", err}
+		}
+		return nil
+	}
+	value, err := p.decode(c.L)
+	if err != nil {
+		return err
+	}
+	return writePayload(w, value, tagType, c)
+}
+
+// skipPayload advances r past a payload without converting it
+func (c *codec) skipPayload(r *bytes.Reader, tagType byte) error {
+	var err error
+	skip := func(n int64) error {
+		if n < 0 || n > int64(r.Len()) {
+			return NbtParseError{fmt.Sprintf("Skipping %d bytes of tag type %d with %d remaining", n, tagType, r.Len()), nil}
+		}
+		_, err := r.Seek(n, io.SeekCurrent)
+		return err
+	}
+	switch tagType {
+	case 0:
+		// the payload of an End tag, as in a list of them, is empty
+		return nil
+	case 1:
+		return skip(1)
+	case 2:
+		return skip(2)
+	case 3, 5:
+		return skip(4)
+	case 4, 6:
+		return skip(8)
+	case 7, 11, 12:
+		var numRecords int32
+		if err = binary.Read(r, c.order, &numRecords); err != nil {
+			return NbtParseError{"Reading array tag length", err}
+		}
+		return skip(arrayElementSize(tagType) * int64(numRecords))
+	case 8:
+		var strLen uint16
+		if err = binary.Read(r, c.order, &strLen); err != nil {
+			return NbtParseError{"Reading string tag length", err}
+		}
+		return skip(int64(strLen))
+	case 9:
+		if err = c.enter(); err != nil {
+			return NbtParseError{"Skipping list tag", err}
+		}
+		defer c.leave()
+		var tagListType byte
+		if err = binary.Read(r, c.order, &tagListType); err != nil {
+			return NbtParseError{"Reading TagType", err}
+		}
+		var numRecords int32
+		if err = binary.Read(r, c.order, &numRecords); err != nil {
+			return NbtParseError{"Reading list tag length", err}
+		}
+		for i := int32(1); i <= numRecords; i++ {
+			if err = c.skipPayload(r, tagListType); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 10:
+		if err = c.enter(); err != nil {
+			return NbtParseError{"Skipping compound tag", err}
+		}
+		defer c.leave()
+		for {
+			var childType byte
+			if err = binary.Read(r, c.order, &childType); err != nil {
+				return NbtParseError{"compound: reading next tag type", err}
+			}
+			if childType == 0 {
+				return nil
+			}
+			var nameLen uint16
+			if err = binary.Read(r, c.order, &nameLen); err != nil {
+				return NbtParseError{"Reading Name length", err}
+			}
+			if err = skip(int64(nameLen)); err != nil {
+				return err
+			}
+			if err = c.skipPayload(r, childType); err != nil {
+				return err
+			}
+		}
+	default:
+		return NbtParseError{fmt.Sprintf("TagType %d not recognized", tagType), nil}
+	}
+}
@@ -0,0 +1,91 @@
+package nlua
+
+import (
+	"bytes"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// testNbt returns the NBT made from test_data/testnbt.lua in the current encoding
+func testNbt(t *testing.T) []byte {
+	L := NewState()
+	defer L.Close()
+	_, filename, _, _ := runtime.Caller(0)
+	if err := L.DoFile(filepath.Dir(filename) + "/test_data/testnbt.lua"); err != nil {
+		t.Fatal("Error running lua script: ", err)
+	}
+	b, err := Lua2Nbt(L)
+	if err != nil {
+		t.Fatal("Error converting test nbt: ", err)
+	}
+	return b
+}
+
+func TestLazyDecoding(t *testing.T) {
+	UseBedrockEncoding()
+	want := testNbt(t)
+
+	L := NewState(LazyDecoding())
+	defer L.Close()
+	if err := Nbt2Lua(want, L); err != nil {
+		t.Fatal(err)
+	}
+	// nothing read: written back verbatim
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("unread lazy round trip: err %v\nexpected %v\ngot      %v", err, want, got)
+	}
+
+	if err := L.DoString(`
+		for _, tag in ipairs(nbt) do
+			if tag.tagType == 10 then
+				assert(rawget(tag, "value") == nil, "compound decoded before use")
+				assert(tag.value[3].value == 5)
+				tag.value[3].value = 6
+			end
+		end
+	`); err != nil {
+		t.Fatal(err)
+	}
+	eager := NewState()
+	defer eager.Close()
+	if err := Nbt2Lua(want, eager); err != nil {
+		t.Fatal(err)
+	}
+	if err := eager.DoString(`nbt[10].value[3].value = 6`); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := Lua2Nbt(eager)
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, expected) {
+		t.Errorf("modified lazy round trip: err %v\nexpected %v\ngot      %v", err, expected, got)
+	}
+
+	// switching encodings re-encodes unread payloads
+	if err := Nbt2Lua(want, L); err != nil {
+		t.Fatal(err)
+	}
+	UseJavaEncoding()
+	defer UseBedrockEncoding()
+	java := testNbt(t)
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, java) {
+		t.Errorf("lazy re-encode to java: err %v\nexpected %v\ngot      %v", err, java, got)
+	}
+	if tag, ok := L.GetGlobal("nbt").(*lua.LTable).RawGetInt(10).(*lua.LTable); !ok || lazyPayloadOf(tag) == nil {
+		t.Error("writing an unread tag should leave it lazy")
+	}
+}
+
+func TestLazyEndList(t *testing.T) {
+	// compound "" containing a list "l" of three End tags, which have no payload, then int "n" = 5
+	b := []byte{10, 0, 0, 9, 1, 0, 'l', 0, 3, 0, 0, 0, 3, 1, 0, 'n', 5, 0, 0, 0, 0}
+	L := NewState(StateEncoding(BedrockEncoding), LazyDecoding())
+	defer L.Close()
+	if err := Nbt2Lua(b, L); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(nbt[1].value[1].name == "l" and nbt[1].value[2].value == 5)`); err != nil {
+		t.Error("lazy list of End tags: ", err)
+	}
+}
@@ -12,16 +12,30 @@ import (
 )
 
 // Lua2Nbt converts lua's global nbt table variable to uncompressed NBT byte array
-//   Note: arrays/lists will iterate all keys in the table, even non-numeric even though Nbt2Lua will not make those
+//   Note: array and list tables must be sequences; holes or non-numeric keys are an error
 //   Note: A nil lua nbt will return an error, but an nbt empty table will return an empty byte array
 func Lua2Nbt(L *lua.LState) ([]byte, error) {
+	return lua2Nbt(L, getConfig(L).currentEncoding())
+}
+
+// lua2Nbt is Lua2Nbt in encoding e instead of the state's
+func lua2Nbt(L *lua.LState, e Encoding) ([]byte, error) {
+	c := newEncodingCodec(L, e)
+	b, err := tableToNbt(L.GetGlobal("nbt"), c)
+	if err != nil || !c.network {
+		return b, err
+	}
+	return transcode(b, false, c.maxDepth)
+}
+
+// tableToNbt converts a table of top-level tags, the form of the global `nbt` variable, to uncompressed NBT
+func tableToNbt(nbtArray lua.LValue, c *codec) ([]byte, error) {
 	nbtOut := new(bytes.Buffer)
-	nbtArray := L.GetGlobal("nbt")
 	var forEachErr error
 	if nbtLuaTable, ok := nbtArray.(*lua.LTable); ok {
 		nbtLuaTable.ForEach(func(_ lua.LValue, v lua.LValue) {
 			if nbtLuaTag, ok := v.(*lua.LTable); ok {
-				err := writeTag(nbtOut, nbtLuaTag, L)
+				err := writeTag(nbtOut, nbtLuaTag, c)
 				if err != nil {
 					if forEachErr == nil {
 						forEachErr = err
@@ -29,6 +43,10 @@ func Lua2Nbt(L *lua.LState) ([]byte, error) {
 				}
 			}
 		})
+		// bytes kept from after the first root tag
+		if trailing, ok := nbtLuaTable.RawGetString("trailing").(lua.LString); ok {
+			nbtOut.WriteString(string(trailing))
+		}
 	} else {
 		return nil, LuaNbtError{fmt.Sprintf("Global nbt type, expected %T, got %T", lua.LTable{}, nbtArray), nil}
 	}
@@ -36,7 +54,7 @@ func Lua2Nbt(L *lua.LState) ([]byte, error) {
 }
 
 // called by Lua2Nbt for each LTable representing an nbt tag; also called from writePayload for compound tags
-func writeTag(w io.Writer, nbtLuaTag *lua.LTable, L *lua.LState) error {
+func writeTag(w io.Writer, nbtLuaTag *lua.LTable, c *codec) error {
 	var err error
 	var lValue lua.LValue
 	lValue = nbtLuaTag.RawGet(lua.LString("tagType"))
@@ -45,17 +63,20 @@ func writeTag(w io.Writer, nbtLuaTag *lua.LTable, L *lua.LState) error {
 			// not expecting a 0 tag, but if it occurs just ignore it
 			return nil
 		}
-		err = binary.Write(w, byteOrder, byte(tagType))
+		err = binary.Write(w, c.order, byte(tagType))
 		if err != nil {
 			return LuaNbtError{"Error writing tagType" + string(byte(tagType)), err}
 		}
 		lValue = nbtLuaTag.RawGet(lua.LString("name"))
 		if name, ok := lValue.(lua.LString); ok {
-			err = binary.Write(w, byteOrder, int16(len(name)))
+			if len(name) > math.MaxUint16 {
+				return LuaNbtError{fmt.Sprintf("%d byte name is too long for a tag name", len(name)), nil}
+			}
+			err = binary.Write(w, c.order, uint16(len(name)))
 			if err != nil {
 				return LuaNbtError{"Error writing name length", err}
 			}
-			err = binary.Write(w, byteOrder, []byte(name))
+			err = binary.Write(w, c.order, []byte(name))
 			if err != nil {
 				return LuaNbtError{"Error converting name", err}
 			}
@@ -63,7 +84,10 @@ func writeTag(w io.Writer, nbtLuaTag *lua.LTable, L *lua.LState) error {
 			return LuaNbtError{fmt.Sprintf("name field '%v' not a string", lValue), err}
 		}
 		lValue = nbtLuaTag.RawGet(lua.LString("value"))
-		err = writePayload(w, lValue, tagType, L)
+		if p := lazyPayloadOf(nbtLuaTag); lValue == lua.LNil && p != nil {
+			return p.write(w, tagType, c)
+		}
+		err = writePayload(w, lValue, tagType, c)
 		if err != nil {
 			return err
 		}
@@ -75,16 +99,30 @@ func writeTag(w io.Writer, nbtLuaTag *lua.LTable, L *lua.LState) error {
 }
 
 // called by writeTag to return the value (v) field for the given tag type
-func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState) error {
+func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, c *codec) error {
+	L := c.L
 	var err error
 
+	if a := typedArrayOf(v); a != nil {
+		if lua.LNumber(a.tagType) != tagType {
+			return LuaNbtError{fmt.Sprintf("compact array of tag %d in a tag %v value", a.tagType, tagType), nil}
+		}
+		if err = a.writeTo(w, c.order); err != nil {
+			return LuaNbtError{"Error writing compact array", err}
+		}
+		return nil
+	}
+
 	switch tagType {
 	case 1:
 		if i, ok := v.(lua.LNumber); ok {
+			if !isInteger(i) {
+				return LuaNbtError{fmt.Sprintf("%v is not an integer for tag 1 - Byte", i), nil}
+			}
 			if i < math.MinInt8 || i > math.MaxInt8 {
 				return LuaNbtError{fmt.Sprintf("%v is out of range for tag 1 - Byte", i), nil}
 			}
-			err = binary.Write(w, byteOrder, int8(i))
+			err = binary.Write(w, c.order, int8(i))
 			if err != nil {
 				return LuaNbtError{"Error writing byte payload", err}
 			}
@@ -93,10 +131,13 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 		}
 	case 2:
 		if i, ok := v.(lua.LNumber); ok {
+			if !isInteger(i) {
+				return LuaNbtError{fmt.Sprintf("%v is not an integer for tag 2 - Short", i), nil}
+			}
 			if i < math.MinInt16 || i > math.MaxInt16 {
 				return LuaNbtError{fmt.Sprintf("%v is out of range for tag 2 - Short", i), nil}
 			}
-			err = binary.Write(w, byteOrder, int16(i))
+			err = binary.Write(w, c.order, int16(i))
 			if err != nil {
 				return LuaNbtError{"Error writing short payload", err}
 			}
@@ -105,10 +146,13 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 		}
 	case 3:
 		if i, ok := v.(lua.LNumber); ok {
+			if !isInteger(i) {
+				return LuaNbtError{fmt.Sprintf("%v is not an integer for tag 3 - Int", i), nil}
+			}
 			if i < math.MinInt32 || i > math.MaxInt32 {
 				return LuaNbtError{fmt.Sprintf("%v is out of range for tag 3 - Int", i), nil}
 			}
-			err = binary.Write(w, byteOrder, int32(i))
+			err = binary.Write(w, c.order, int32(i))
 			if err != nil {
 				return LuaNbtError{"Error writing int32 payload", err}
 			}
@@ -117,17 +161,11 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 		}
 	case 4:
 		if lValue, ok := v.(*lua.LTable); ok {
-			var vl, vm lua.LNumber
-			var lv lua.LValue
-			lv = L.RawGet(lValue, lua.LString("least"))
-			if vl, ok = lv.(lua.LNumber); !ok {
-				return LuaNbtError{fmt.Sprintf("Error reading valueLeast of '%v'", lv), nil}
-			}
-			lv = L.RawGet(lValue, lua.LString("most"))
-			if vm, ok = lv.(lua.LNumber); !ok {
-				return LuaNbtError{fmt.Sprintf("Error reading valueMost of '%v'", lv), nil}
+			i, err := longOf(lValue)
+			if err != nil {
+				return err
 			}
-			err = binary.Write(w, byteOrder, int64(intPairToLong(uint32(vl), uint32(vm))))
+			err = binary.Write(w, c.order, i)
 			if err != nil {
 				return LuaNbtError{"Error writing int64 (from uint32 pair) payload:", err}
 			}
@@ -139,50 +177,54 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 			if f != 0 && (math.Abs(float64(f)) < math.SmallestNonzeroFloat32 || math.Abs(float64(f)) > math.MaxFloat32) {
 				return LuaNbtError{fmt.Sprintf("%g is out of range for tag 5 - Float", f), nil}
 			}
-			err = binary.Write(w, byteOrder, float32(f))
+			err = binary.Write(w, c.order, numberToFloat32(f))
 			if err != nil {
 				return LuaNbtError{"Error writing float32 payload", err}
 			}
 		} else {
 			// will write NaN which is needed for true NaN
-			err = binary.Write(w, byteOrder, float32(math.NaN()))
+			err = binary.Write(w, c.order, float32(math.NaN()))
 			if err != nil {
 				return LuaNbtError{"Error writing float64 payload", err}
 			}
 		}
 	case 6:
 		if f, ok := v.(lua.LNumber); ok {
-			err = binary.Write(w, byteOrder, f)
+			err = binary.Write(w, c.order, f)
 			if err != nil {
 				return LuaNbtError{"Error writing float64 payload", err}
 			}
 		} else {
 			// will write NaN which is needed for true NaN
-			err = binary.Write(w, byteOrder, math.NaN())
+			err = binary.Write(w, c.order, math.NaN())
 			if err != nil {
 				return LuaNbtError{"Error writing float64 payload", err}
 			}
 		}
 	case 7:
 		if values, ok := v.(*lua.LTable); ok {
-			err = binary.Write(w, byteOrder, int32(values.Len()))
+			if err = checkSequence(values); err != nil {
+				return LuaNbtError{"Tag 7 Byte Array", err}
+			}
+			err = binary.Write(w, c.order, int32(values.Len()))
 			if err != nil {
 				return LuaNbtError{"Error writing byte array length", err}
 			}
 			var forEachErr error
-			values.ForEach(func(_ lua.LValue, n lua.LValue) {
-				if i, ok := n.(lua.LNumber); ok {
-					if i < math.MinInt8 || i > math.MaxInt8 && forEachErr == nil {
-						forEachErr = LuaNbtError{fmt.Sprintf("%v is out of range for Byte in tag 7 - Byte Array", i), nil}
+			for j := 1; j <= values.Len() && forEachErr == nil; j++ {
+				if i, ok := values.RawGetInt(j).(lua.LNumber); ok {
+					if !isInteger(i) || i < math.MinInt8 || i > math.MaxInt8 {
+						forEachErr = LuaNbtError{fmt.Sprintf("%v is not an integer in range for Byte in tag 7 - Byte Array", i), nil}
+						break
 					}
-					err = binary.Write(w, byteOrder, int8(i))
-					if err != nil && forEachErr == nil {
+					err = binary.Write(w, c.order, int8(i))
+					if err != nil {
 						forEachErr = LuaNbtError{"Error writing element of byte array", err}
 					}
-				} else if forEachErr == nil {
-					forEachErr = LuaNbtError{fmt.Sprintf("Tag 7 Byte Array element value field '%v' not an integer", v), err}
+				} else {
+					forEachErr = LuaNbtError{fmt.Sprintf("Tag 7 Byte Array element value field '%v' not an integer", values.RawGetInt(j)), nil}
 				}
-			})
+			}
 			if forEachErr != nil {
 				return LuaNbtError{"Error in byte array loop:", forEachErr}
 			}
@@ -191,11 +233,14 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 		}
 	case 8:
 		if s, ok := v.(lua.LString); ok {
-			err = binary.Write(w, byteOrder, int16(len([]byte(s))))
+			if len(s) > math.MaxUint16 {
+				return LuaNbtError{fmt.Sprintf("%d byte string is too long for tag 8 - String", len(s)), nil}
+			}
+			err = binary.Write(w, c.order, uint16(len(s)))
 			if err != nil {
 				return LuaNbtError{"Error writing string length", err}
 			}
-			err = binary.Write(w, byteOrder, []byte(s))
+			err = binary.Write(w, c.order, []byte(s))
 			if err != nil {
 				return LuaNbtError{"Error writing string payload", err}
 			}
@@ -203,30 +248,39 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 			return LuaNbtError{fmt.Sprintf("Tag 8 String value field '%v' not a string", v), err}
 		}
 	case 9:
+		if err = c.enter(); err != nil {
+			return LuaNbtError{"While writing tag 9 list", err}
+		}
+		defer c.leave()
 		// important: tagListType needs to be in scope to be passed to writePayload
 		var tagListType lua.LNumber
 		var lv lua.LValue
 		if lTable, ok := v.(*lua.LTable); ok {
 			lv = L.RawGet(lTable, lua.LString("tagListType"))
-			if tagListType, ok = lv.(lua.LNumber); ok {
-				err = binary.Write(w, byteOrder, byte(tagListType))
-				if err != nil {
-					return LuaNbtError{"While writing tag 9 list type", err}
-				}
+			if tagListType, ok = lv.(lua.LNumber); !ok || tagListType < 0 || tagListType > 12 ||
+				tagListType != lua.LNumber(int(tagListType)) {
+				return LuaNbtError{"While writing tag 9 list type", fmt.Errorf("tagListType '%v' is not a tag type 0-12", lv)}
+			}
+			err = binary.Write(w, c.order, byte(tagListType))
+			if err != nil {
+				return LuaNbtError{"While writing tag 9 list type", err}
 			}
 			lv = L.RawGet(lTable, lua.LString("list"))
 			if values, ok := lv.(*lua.LTable); ok {
-				err = binary.Write(w, byteOrder, int32(values.Len()))
+				if err = checkSequence(values); err != nil {
+					return LuaNbtError{"Tag 9 List", err}
+				}
+				err = binary.Write(w, c.order, int32(values.Len()))
 				if err != nil {
 					return LuaNbtError{"While writing tag 9 list size", err}
 				}
 				var forEachErr error
-				values.ForEach(func(_ lua.LValue, n lua.LValue) {
-					err = writePayload(w, n, tagListType, L)
-					if err != nil && forEachErr == nil {
+				for j := 1; j <= values.Len() && forEachErr == nil; j++ {
+					err = writePayload(w, values.RawGetInt(j), tagListType, c)
+					if err != nil {
 						forEachErr = LuaNbtError{"While writing tag 9 list of type " + strconv.Itoa(int(tagListType)), err}
 					}
-				})
+				}
 				if forEachErr != nil {
 					return forEachErr
 				}
@@ -238,11 +292,15 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 			return LuaNbtError{fmt.Sprintf("Tag 9 List value field '%v' not an object", v), err}
 		}
 	case 10:
+		if err = c.enter(); err != nil {
+			return LuaNbtError{"While writing Compound tags", err}
+		}
+		defer c.leave()
 		if values, ok := v.(*lua.LTable); ok {
 			var forEachErr error
 			values.ForEach(func(_ lua.LValue, t lua.LValue) {
 				if tag, ok := t.(*lua.LTable); ok {
-					err = writeTag(w, tag, L)
+					err = writeTag(w, tag, c)
 					if err != nil && forEachErr == nil {
 						forEachErr = LuaNbtError{"While writing Compound tags", err}
 					}
@@ -251,63 +309,70 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 				}
 			})
 			// write the end tag which is just a single byte 0
-			err = binary.Write(w, byteOrder, byte(0))
+			err = binary.Write(w, c.order, byte(0))
 			if err != nil {
 				return LuaNbtError{"Writing End tag", err}
 			}
+			if forEachErr != nil {
+				return forEachErr
+			}
 		} else {
 			return LuaNbtError{fmt.Sprintf("Tag 10 Compound value field '%v' not an array", v), err}
 		}
 	case 11:
 		if values, ok := v.(*lua.LTable); ok {
-			err = binary.Write(w, byteOrder, int32(values.Len()))
+			if err = checkSequence(values); err != nil {
+				return LuaNbtError{"Tag 11 Int Array", err}
+			}
+			err = binary.Write(w, c.order, int32(values.Len()))
 			if err != nil {
 				return LuaNbtError{"Error writing int32 array length", err}
 			}
 			var forEachErr error
-			values.ForEach(func(_ lua.LValue, n lua.LValue) {
-				if i, ok := n.(lua.LNumber); ok {
-					if i < math.MinInt32 || i > math.MaxInt32 && forEachErr == nil {
-						forEachErr = LuaNbtError{fmt.Sprintf("%v is out of range for Int in tag 11 - Int Array", i), nil}
+			for j := 1; j <= values.Len() && forEachErr == nil; j++ {
+				if i, ok := values.RawGetInt(j).(lua.LNumber); ok {
+					if !isInteger(i) || i < math.MinInt32 || i > math.MaxInt32 {
+						forEachErr = LuaNbtError{fmt.Sprintf("%v is not an integer in range for Int in tag 11 - Int Array", i), nil}
+						break
 					}
-					err = binary.Write(w, byteOrder, int32(i))
-					if err != nil && forEachErr == nil {
+					err = binary.Write(w, c.order, int32(i))
+					if err != nil {
 						forEachErr = LuaNbtError{"Error writing element of int32 array", err}
 					}
-				} else if forEachErr == nil {
-					forEachErr = LuaNbtError{fmt.Sprintf("Tag 11 Int Array element value field '%v' not a number", n), err}
+				} else {
+					forEachErr = LuaNbtError{fmt.Sprintf("Tag 11 Int Array element value field '%v' not a number", values.RawGetInt(j)), nil}
 				}
-			})
+			}
+			if forEachErr != nil {
+				return forEachErr
+			}
 		} else {
 			return LuaNbtError{fmt.Sprintf("Tag Int Array value field '%v' not an array", v), err}
 		}
 	case 12:
 		if values, ok := v.(*lua.LTable); ok {
-			err = binary.Write(w, byteOrder, int64(values.Len()))
+			if err = checkSequence(values); err != nil {
+				return LuaNbtError{"Tag 12 Long Array", err}
+			}
+			err = binary.Write(w, c.order, int32(values.Len()))
 			if err != nil {
 				return LuaNbtError{"Error writing int64 array length", err}
 			}
 			var forEachErr error
-			values.ForEach(func(_ lua.LValue, n lua.LValue) {
-				if li, ok := n.(*lua.LTable); ok {
-					var vl, vm lua.LNumber
-					var lv lua.LValue
-					lv = L.RawGet(li, lua.LString("least"))
-					if vl, ok = lv.(lua.LNumber); !ok && forEachErr == nil {
-						forEachErr = LuaNbtError{fmt.Sprintf("Error reading valueLeast of '%v'", lv), nil}
-					}
-					lv = L.RawGet(li, lua.LString("most"))
-					if vm, ok = lv.(lua.LNumber); !ok && forEachErr == nil {
-						forEachErr = LuaNbtError{fmt.Sprintf("Error reading valueMost of '%v'", lv), nil}
+			for j := 1; j <= values.Len() && forEachErr == nil; j++ {
+				if li, ok := values.RawGetInt(j).(*lua.LTable); ok {
+					var i int64
+					if i, forEachErr = longOf(li); forEachErr != nil {
+						break
 					}
-					err = binary.Write(w, byteOrder, int64(intPairToLong(uint32(vl), uint32(vm))))
-					if err != nil && forEachErr == nil {
+					err = binary.Write(w, c.order, i)
+					if err != nil {
 						forEachErr = LuaNbtError{"Error writing int64 (from uint32 pair) payload:", err}
 					}
 				} else {
-					forEachErr = LuaNbtError{fmt.Sprintf("Tag 4 Long value element field '%v' not a table", v), err}
+					forEachErr = LuaNbtError{fmt.Sprintf("Tag 4 Long value element field '%v' not a table", values.RawGetInt(j)), nil}
 				}
-			})
+			}
 			if forEachErr != nil {
 				return forEachErr
 			}
@@ -319,3 +384,37 @@ func writePayload(w io.Writer, v lua.LValue, tagType lua.LNumber, L *lua.LState)
 	}
 	return err
 }
+
+// isInteger reports whether n has no fractional part; NaN and infinities don't
+func isInteger(n lua.LNumber) bool {
+	return float64(n) == math.Trunc(float64(n)) && !math.IsInf(float64(n), 0)
+}
+
+// checkSequence fails if an array or list table has holes or keys other than 1..n, which the element count
+// written before the elements wouldn't cover
+func checkSequence(t *lua.LTable) error {
+	count := 0
+	t.ForEach(func(_, _ lua.LValue) { count++ })
+	if count != t.Len() {
+		return fmt.Errorf("table has %d entries but %d in sequence; holes and non-index keys can't be written", count, t.Len())
+	}
+	return nil
+}
+
+// longOf reads a long tag value table of least and most significant 32 bit halves, each an integer either
+// unsigned or two's complement
+func longOf(t *lua.LTable) (int64, error) {
+	var halves [2]uint32
+	for i, key := range []string{"least", "most"} {
+		lv := t.RawGetString(key)
+		n, ok := lv.(lua.LNumber)
+		if !ok {
+			return 0, LuaNbtError{fmt.Sprintf("Error reading %s of long '%v'", key, lv), nil}
+		}
+		if !isInteger(n) || n < math.MinInt32 || n > math.MaxUint32 {
+			return 0, LuaNbtError{fmt.Sprintf("%v is not a 32 bit integer for the %s half of a long", n, key), nil}
+		}
+		halves[i] = uint32(int64(n))
+	}
+	return intPairToLong(halves[0], halves[1]), nil
+}
@@ -0,0 +1,325 @@
+package nlua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Bedrock Edition .mcstructure files, as saved by structure blocks: little endian NBT with a size, the world
+// position the structure was saved from, two layers of palette indices (-1 for structure void) ordered by x,
+// then y, then z, and a palette of block states with block entity data by block index.
+
+// Block version written with new palette entries, 1.20.80
+const defaultBlockVersion = 0x01145000
+
+// Stair facings as numbered by Bedrock Edition's weirdo_direction
+var weirdoDirections = numberedDirections["weirdo_direction"]
+
+func isBedrockFormat(format string) bool {
+	return format == "mcstructure"
+}
+
+// mcPos is the position of the i-th block index of an .mcstructure
+func (s *structure) mcPos(i int) [3]int {
+	return [3]int{i / (s.size[1] * s.size[2]), i / s.size[2] % s.size[1], i % s.size[2]}
+}
+
+func (s *structure) mcIndex(pos [3]int) int {
+	return (pos[0]*s.size[1]+pos[1])*s.size[2] + pos[2]
+}
+
+// readMcstructure reads a Bedrock .mcstructure document, its root tag or the root tag's value
+func readMcstructure(L *lua.LState, doc *lua.LTable) (*structure, error) {
+	root := rootCompound(L, doc)
+	s := newStructure([3]int{})
+	s.doc, s.format, s.version = doc, "mcstructure", 1
+	var ok bool
+	if s.size, ok = intTriple(L, root, "size"); !ok {
+		return nil, fmt.Errorf("no size list of 3 ints; not a structure")
+	}
+	if v, ok := findValue(L, root, "format_version", 3).(lua.LNumber); ok {
+		s.version = int(v)
+	}
+	s.offset, _ = intTriple(L, root, "structure_world_origin")
+	st := findCompound(L, root, "structure")
+	if st == nil {
+		return nil, fmt.Errorf("no structure compound; not an .mcstructure")
+	}
+	var palette *lua.LTable
+	if palettes := findCompound(L, st, "palette"); palettes != nil {
+		palette = findCompound(L, palettes, "default")
+	}
+	if palette == nil {
+		return nil, fmt.Errorf("no palette.default compound")
+	}
+	blockPalette, _ := findList(L, palette, "block_palette")
+	for i := 1; blockPalette != nil && i <= blockPalette.Len(); i++ {
+		entry, _ := blockPalette.RawGetInt(i).(*lua.LTable)
+		if entry == nil {
+			entry = L.NewTable()
+		}
+		if v, ok := findValue(L, entry, "version", 3).(lua.LNumber); ok && i == 1 {
+			s.blockVersion = int(v)
+		}
+		s.palettes[0] = append(s.palettes[0], bedrockBlockState(L, entry))
+	}
+	layers, _ := findList(L, st, "block_indices")
+	n := s.size[0] * s.size[1] * s.size[2]
+	for layer := 1; layers != nil && layer <= 2 && layer <= layers.Len(); layer++ {
+		list, _ := layers.RawGetInt(layer).(*lua.LTable)
+		var indices []float64
+		if list != nil {
+			elements, _ := list.RawGetString("list").(*lua.LTable)
+			indices = numbersOf(elements)
+		}
+		if len(indices) != n {
+			return nil, fmt.Errorf("block layer %d has %d indices, expected %d", layer, len(indices), n)
+		}
+		for i, v := range indices {
+			state := int(v)
+			if state < 0 {
+				continue
+			}
+			if state >= len(s.palettes[0]) {
+				return nil, fmt.Errorf("block %d of layer %d has index %d, which isn't in the palette", i, layer, state)
+			}
+			if layer == 1 {
+				s.put(s.mcPos(i), state, nil)
+			} else {
+				s.layer2[s.mcPos(i)] = state
+			}
+		}
+	}
+	if positionData := findCompound(L, palette, "block_position_data"); positionData != nil {
+		positionData.ForEach(func(_, v lua.LValue) {
+			tag, ok := v.(*lua.LTable)
+			if !ok {
+				return
+			}
+			i, err := strconv.Atoi(lua.LVAsString(tag.RawGetString("name")))
+			data, _ := tagValue(L, tag).(*lua.LTable)
+			if err != nil || data == nil || i < 0 || i >= n {
+				return
+			}
+			if b := s.get(s.mcPos(i)); b != nil {
+				b.nbt = findCompound(L, data, "block_entity_data")
+			}
+		})
+	}
+	entities, _ := findList(L, st, "entities")
+	for i := 1; entities != nil && i <= entities.Len(); i++ {
+		entity, ok := entities.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		list, _ := findList(L, entity, "Pos")
+		if pos := numbersOf(list); len(pos) == 3 {
+			s.addEntity([3]float64{
+				pos[0] - float64(s.offset[0]), pos[1] - float64(s.offset[1]), pos[2] - float64(s.offset[2]),
+			}, entity)
+		}
+	}
+	return s, nil
+}
+
+// writeMcstructure stores s as .mcstructure tags in root, a compound value, keeping root's other tags
+func (s *structure) writeMcstructure(L *lua.LState, root *lua.LTable) {
+	version := s.blockVersion
+	if version == 0 {
+		version = defaultBlockVersion
+	}
+	if s.version == 0 {
+		s.version = 1
+	}
+	setTag(L, root, 3, "format_version", lua.LNumber(s.version))
+	setTag(L, root, 9, "size", numberList(L, 3, float64(s.size[0]), float64(s.size[1]), float64(s.size[2])))
+	setTag(L, root, 9, "structure_world_origin",
+		numberList(L, 3, float64(s.offset[0]), float64(s.offset[1]), float64(s.offset[2])))
+
+	n := s.size[0] * s.size[1] * s.size[2]
+	layer1, layer2 := make([]float64, n), make([]float64, n)
+	for i := range layer1 {
+		layer1[i], layer2[i] = -1, -1
+	}
+	positionData := L.NewTable()
+	for _, b := range s.blocks {
+		i := s.mcIndex(b.pos)
+		layer1[i] = float64(b.state)
+		if b.nbt == nil {
+			continue
+		}
+		// block entity data holds its world position
+		for k, name := range []string{"x", "y", "z"} {
+			if findTag(b.nbt, name) != nil {
+				setTag(L, b.nbt, 3, name, lua.LNumber(b.pos[k]+s.offset[k]))
+			}
+		}
+		data := L.NewTable()
+		data.Append(newTag(L, 10, "block_entity_data", b.nbt))
+		positionData.Append(newTag(L, 10, strconv.Itoa(i), data))
+	}
+	for pos, state := range s.layer2 {
+		layer2[s.mcIndex(pos)] = float64(state)
+	}
+	layers := L.CreateTable(2, 0)
+	layers.Append(numberList(L, 3, layer1...))
+	layers.Append(numberList(L, 3, layer2...))
+
+	entities := L.CreateTable(len(s.entities), 0)
+	for _, e := range s.entities {
+		entity := L.NewTable()
+		if e.nbt != nil {
+			entity = e.nbt
+		}
+		setTag(L, entity, 9, "Pos", numberList(L, 5,
+			e.pos[0]+float64(s.offset[0]), e.pos[1]+float64(s.offset[1]), e.pos[2]+float64(s.offset[2])))
+		entities.Append(entity)
+	}
+
+	blockPalette := L.CreateTable(len(s.palettes[0]), 0)
+	for _, b := range s.palettes[0] {
+		blockPalette.Append(b.bedrockCompound(L, version))
+	}
+	palette := L.NewTable()
+	palette.Append(newTag(L, 9, "block_palette", newList(L, 10, blockPalette)))
+	palette.Append(newTag(L, 10, "block_position_data", positionData))
+	palettes := L.NewTable()
+	palettes.Append(newTag(L, 10, "default", palette))
+
+	st := L.NewTable()
+	st.Append(newTag(L, 9, "block_indices", newList(L, 9, layers)))
+	st.Append(newTag(L, 9, "entities", newList(L, 10, entities)))
+	st.Append(newTag(L, 10, "palette", palettes))
+	setTag(L, root, 10, "structure", st)
+}
+
+// forFormat returns s ready to be written as format: s itself if format is of the same edition, otherwise a
+// copy with its block states converted to the other edition. Block entity and entity data differ too much
+// between editions to convert and are dropped.
+func (s *structure) forFormat(format string) *structure {
+	toBedrock := isBedrockFormat(format)
+	if toBedrock == isBedrockFormat(s.format) {
+		return s
+	}
+	c := newStructure(s.size)
+	c.offset, c.dataVersion, c.blockVersion = s.offset, s.dataVersion, s.blockVersion
+	dropped := len(s.entities)
+	water, _ := parseBlockState("minecraft:water[liquid_depth=0]")
+	for _, b := range s.blocks {
+		if b.state < 0 {
+			continue
+		}
+		if b.nbt != nil {
+			dropped++
+		}
+		if toBedrock {
+			state, waterlogged := javaToBedrock(s.palettes[0][b.state])
+			c.put(b.pos, c.stateIndex(state), nil)
+			if waterlogged {
+				c.layer2[b.pos] = c.stateIndex(water)
+			}
+			continue
+		}
+		state, wet := s.layer2[b.pos]
+		wet = wet && s.palettes[0][state].name == water.name
+		c.put(b.pos, c.stateIndex(bedrockToJava(s.palettes[0][b.state], wet)), nil)
+	}
+	if dropped > 0 {
+		c.warnings = append(c.warnings, fmt.Sprintf("%d block entities and entities not converted between editions", dropped))
+	}
+	return c
+}
+
+func isSlab(name string) bool {
+	return strings.HasSuffix(name, "_slab")
+}
+
+// javaToBedrock converts the Java Edition block state properties that have Bedrock Edition equivalents, and
+// drops the rest; the block name is kept. It also returns whether the block was waterlogged.
+func javaToBedrock(b blockState) (blockState, bool) {
+	c := blockState{name: b.name}
+	waterlogged := false
+	stairs := strings.HasSuffix(b.name, "_stairs")
+	add := func(name, value string, t byte) {
+		c.properties = append(c.properties, blockProperty{name, value, t})
+	}
+	for _, p := range b.properties {
+		switch {
+		case p.name == "waterlogged":
+			waterlogged = p.value == "true"
+		case p.name == "axis":
+			add("pillar_axis", p.value, 8)
+		case stairs && p.name == "facing":
+			for i, d := range weirdoDirections {
+				if d == p.value {
+					add("weirdo_direction", strconv.Itoa(i), 3)
+				}
+			}
+		case stairs && p.name == "half":
+			add("upside_down_bit", strconv.FormatBool(p.value == "top"), 1)
+		case isSlab(b.name) && p.name == "type":
+			if p.value == "double" {
+				c.name = strings.TrimSuffix(b.name, "_slab") + "_double_slab"
+				add("minecraft:vertical_half", "bottom", 8)
+			} else {
+				add("minecraft:vertical_half", p.value, 8)
+			}
+		case p.name == "facing" && isHorizontal(p.value):
+			add("minecraft:cardinal_direction", p.value, 8)
+		}
+	}
+	c.sort()
+	return c, waterlogged
+}
+
+// bedrockToJava is the reverse of javaToBedrock; waterlogged adds waterlogged=true
+func bedrockToJava(b blockState, waterlogged bool) blockState {
+	c := blockState{name: b.name}
+	add := func(name, value string) {
+		c.properties = append(c.properties, blockProperty{name, value, 8})
+	}
+	if strings.HasSuffix(b.name, "_double_slab") {
+		c.name = strings.TrimSuffix(b.name, "_double_slab") + "_slab"
+		add("type", "double")
+	}
+	for _, p := range b.properties {
+		switch p.name {
+		case "pillar_axis":
+			add("axis", p.value)
+		case "weirdo_direction":
+			if n, err := strconv.Atoi(p.value); err == nil && n >= 0 && n < len(weirdoDirections) {
+				add("facing", weirdoDirections[n])
+			}
+		case "upside_down_bit":
+			half := "bottom"
+			if p.value == "true" {
+				half = "top"
+			}
+			add("half", half)
+		case "minecraft:vertical_half":
+			if isSlab(c.name) && !strings.HasSuffix(b.name, "_double_slab") {
+				add("type", p.value)
+			}
+		case "minecraft:cardinal_direction":
+			add("facing", p.value)
+		}
+	}
+	if waterlogged {
+		add("waterlogged", "true")
+	}
+	c.sort()
+	return c
+}
+
+// mcstructure(doc) reads a Bedrock .mcstructure document, its root tag or the root tag's value into a
+// structure object
+func newMcstructureLua(L *lua.LState) int {
+	s, err := readMcstructure(L, L.CheckTable(1))
+	if err != nil {
+		return pushError(L, "Error reading mcstructure", err)
+	}
+	return pushStructure(L, s)
+}
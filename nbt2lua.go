@@ -4,51 +4,82 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"math"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
 // Nbt2Lua converts uncompressed NBT byte array to the global `nbt` variable of a github.com/yuin/gopher-lua LState
 func Nbt2Lua(b []byte, L *lua.LState) error {
-	lTable := L.NewTable()
+	c := newCodec(L)
+	if c.network {
+		var err error
+		if b, err = transcode(b, true, c.maxDepth); err != nil {
+			return err
+		}
+	}
+	lTable, err := nbtToTable(b, c)
+	if err != nil {
+		return err
+	}
+	L.SetGlobal("nbt", lTable)
+	return nil
+}
+
+// nbtToTable converts uncompressed NBT to a table of its top-level tags, the form of the global `nbt` variable.
+// c.roots decides whether to read every top-level tag, or only the first and possibly keep the rest as `trailing`.
+func nbtToTable(b []byte, c *codec) (*lua.LTable, error) {
+	lTable := c.L.NewTable()
 	buf := bytes.NewReader(b)
+	c.src = b
 	for buf.Len() > 0 {
-		element, err := getTag(buf, L)
+		if c.roots != RootsStream && lTable.Len() > 0 {
+			break
+		}
+		element, err := getTag(buf, c)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		lTable.Append(element)
 	}
-	L.SetGlobal("nbt", lTable)
-	return nil
+	if c.roots == RootsKeepTrailing && buf.Len() > 0 {
+		lTable.RawSetString("trailing", lua.LString(b[len(b)-buf.Len():]))
+	}
+	return lTable, nil
 }
 
 // called by Nbt2Lua for each nbt tag; also called from getPayload for compound tags
-func getTag(r *bytes.Reader, L *lua.LState) (lua.LValue, error) {
+func getTag(r *bytes.Reader, c *codec) (lua.LValue, error) {
+	L := c.L
 	lTable := L.NewTable()
+	offset := c.base + len(c.src) - r.Len()
 	var tagType byte
-	err := binary.Read(r, byteOrder, &tagType)
+	err := binary.Read(r, c.order, &tagType)
 	if err != nil {
 		return lua.LNil, NbtParseError{"Reading TagType", err}
 	}
 	L.RawSet(lTable, lua.LString("tagType"), lua.LNumber(tagType))
+	if c.offsets {
+		L.RawSet(lTable, lua.LString("offset"), lua.LNumber(offset))
+	}
 	// do not try to fetch name for TagType 0 which is compound end tag
 	if tagType != 0 {
 		var err error
-		var nameLen int16
-		err = binary.Read(r, byteOrder, &nameLen)
+		var nameLen uint16
+		err = binary.Read(r, c.order, &nameLen)
 		if err != nil {
 			return lTable, NbtParseError{"Reading Name length", err}
 		}
 		name := make([]byte, nameLen)
-		err = binary.Read(r, byteOrder, &name)
+		err = binary.Read(r, c.order, &name)
 		if err != nil {
-			return lTable, NbtParseError{fmt.Sprintf("Reading Name - is UseJavaEncoding or UseBedrockEncoding set correctly? Name length decoded is %d", nameLen), err}
+			return lTable, NbtParseError{fmt.Sprintf("Reading Name - is the encoding set correctly? DetectFormat or detectnbt can tell. Name length decoded is %d", nameLen), err}
 		}
 		L.RawSet(lTable, lua.LString("name"), lua.LString(string(name[:])))
+		if c.lazy && (tagType == 9 || tagType == 10) {
+			return lTable, c.setLazy(lTable, r, tagType)
+		}
 	}
-	value, err := getPayload(r, tagType, L)
+	value, err := getPayload(r, tagType, c)
 	if err != nil {
 		return lTable, err
 	}
@@ -57,7 +88,8 @@ func getTag(r *bytes.Reader, L *lua.LState) (lua.LValue, error) {
 }
 
 // Gets the tag payload. Had to break this out from the main function to allow tag list recursion
-func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error) {
+func getPayload(r *bytes.Reader, tagType byte, c *codec) (lua.LValue, error) {
+	L := c.L
 	var err error
 	switch tagType {
 	case 0:
@@ -65,28 +97,28 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 		return lua.LNil, nil
 	case 1:
 		var i int8
-		err = binary.Read(r, byteOrder, &i)
+		err = binary.Read(r, c.order, &i)
 		if err != nil {
 			return nil, NbtParseError{"Reading int8", err}
 		}
 		return lua.LNumber(i), nil
 	case 2:
 		var i int16
-		err = binary.Read(r, byteOrder, &i)
+		err = binary.Read(r, c.order, &i)
 		if err != nil {
 			return nil, NbtParseError{"Reading int16", err}
 		}
 		return lua.LNumber(i), nil
 	case 3:
 		var i int32
-		err = binary.Read(r, byteOrder, &i)
+		err = binary.Read(r, c.order, &i)
 		if err != nil {
 			return nil, NbtParseError{"Reading int32", err}
 		}
 		return lua.LNumber(i), nil
 	case 4:
 		var i int64
-		err = binary.Read(r, byteOrder, &i)
+		err = binary.Read(r, c.order, &i)
 		if err != nil {
 			return nil, NbtParseError{"Reading int64", err}
 		}
@@ -98,32 +130,32 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 
 	case 5:
 		var f float32
-		err = binary.Read(r, byteOrder, &f)
+		err = binary.Read(r, c.order, &f)
 		if err != nil {
 			return nil, NbtParseError{"Reading float32", err}
 		}
-		return lua.LNumber(f), nil
+		return float32ToNumber(f), nil
 	case 6:
 		var f float64
-		err = binary.Read(r, byteOrder, &f)
+		err = binary.Read(r, c.order, &f)
 		if err != nil {
 			return nil, NbtParseError{"Reading float64", err}
 		}
-		if math.IsNaN(f) {
-			return lua.LNumber(math.NaN()), nil
-		} else {
-			return lua.LNumber(f), nil
-		}
+		// a NaN keeps its payload
+		return lua.LNumber(f), nil
 	case 7:
+		if c.compact {
+			return c.readTypedArray(r, 7)
+		}
 		lByteArray := L.NewTable()
 		var oneByte int8
 		var numRecords int32
-		err := binary.Read(r, byteOrder, &numRecords)
+		err := binary.Read(r, c.order, &numRecords)
 		if err != nil {
 			return nil, NbtParseError{"Reading byte array tag length", err}
 		}
 		for i := int32(1); i <= numRecords; i++ {
-			err = binary.Read(r, byteOrder, &oneByte)
+			err = binary.Read(r, c.order, &oneByte)
 			if err != nil {
 				return nil, NbtParseError{"Reading byte in byte array tag", err}
 			}
@@ -131,25 +163,29 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 		}
 		return lByteArray, nil
 	case 8:
-		var strLen int16
-		err := binary.Read(r, byteOrder, &strLen)
+		var strLen uint16
+		err := binary.Read(r, c.order, &strLen)
 		if err != nil {
 			return nil, NbtParseError{"Reading string tag length", err}
 		}
 		utf8String := make([]byte, strLen)
-		err = binary.Read(r, byteOrder, &utf8String)
+		err = binary.Read(r, c.order, &utf8String)
 		if err != nil {
 			return nil, NbtParseError{"Reading string tag data", err}
 		}
 		return lua.LString(utf8String[:]), nil
 	case 9:
+		if err = c.enter(); err != nil {
+			return nil, NbtParseError{"Reading list tag", err}
+		}
+		defer c.leave()
 		var tagListType byte
-		err = binary.Read(r, byteOrder, &tagListType)
+		err = binary.Read(r, c.order, &tagListType)
 		if err != nil {
 			return nil, NbtParseError{"Reading TagType", err}
 		}
 		var numRecords int32
-		err := binary.Read(r, byteOrder, &numRecords)
+		err := binary.Read(r, c.order, &numRecords)
 		if err != nil {
 			return nil, NbtParseError{"Reading list tag length", err}
 		}
@@ -158,7 +194,7 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 		lTagListArray := L.NewTable()
 		L.RawSet(lTagListTable, lua.LString("list"), lTagListArray)
 		for i := int32(1); i <= numRecords; i++ {
-			payload, err := getPayload(r, tagListType, L)
+			payload, err := getPayload(r, tagListType, c)
 			if err != nil {
 				return nil, NbtParseError{"Reading list tag item", err}
 			}
@@ -166,9 +202,13 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 		}
 		return lTagListTable, nil
 	case 10:
+		if err = c.enter(); err != nil {
+			return nil, NbtParseError{"Reading compound tag", err}
+		}
+		defer c.leave()
 		compound := L.NewTable()
 		var tagType byte
-		for err = binary.Read(r, byteOrder, &tagType); tagType != 0; err = binary.Read(r, byteOrder, &tagType) {
+		for err = binary.Read(r, c.order, &tagType); tagType != 0; err = binary.Read(r, c.order, &tagType) {
 			if err != nil {
 				return nil, NbtParseError{"compound: reading next tag type", err}
 			}
@@ -176,7 +216,7 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 			if err != nil {
 				return nil, NbtParseError{"seeking back one", err}
 			}
-			tag, err := getTag(r, L)
+			tag, err := getTag(r, c)
 			if err != nil {
 				return nil, NbtParseError{"compound: reading a child tag", err}
 			}
@@ -184,14 +224,17 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 		}
 		return compound, nil
 	case 11:
+		if c.compact {
+			return c.readTypedArray(r, 11)
+		}
 		intArray := L.NewTable()
 		var numRecords, oneInt int32
-		err := binary.Read(r, byteOrder, &numRecords)
+		err := binary.Read(r, c.order, &numRecords)
 		if err != nil {
 			return nil, NbtParseError{"Reading int array tag length", err}
 		}
 		for i := int32(1); i <= numRecords; i++ {
-			err := binary.Read(r, byteOrder, &oneInt)
+			err := binary.Read(r, c.order, &oneInt)
 			if err != nil {
 				return nil, NbtParseError{"Reading int in int array tag", err}
 			}
@@ -199,14 +242,18 @@ func getPayload(r *bytes.Reader, tagType byte, L *lua.LState) (lua.LValue, error
 		}
 		return intArray, nil
 	case 12:
+		if c.compact {
+			return c.readTypedArray(r, 12)
+		}
 		longArray := L.NewTable()
-		var numRecords, oneInt int64
-		err := binary.Read(r, byteOrder, &numRecords)
+		var numRecords int32
+		var oneInt int64
+		err := binary.Read(r, c.order, &numRecords)
 		if err != nil {
 			return nil, NbtParseError{"Reading long array tag length", err}
 		}
-		for i := int64(1); i <= numRecords; i++ {
-			err := binary.Read(r, byteOrder, &oneInt)
+		for i := int32(1); i <= numRecords; i++ {
+			err := binary.Read(r, c.order, &oneInt)
 			if err != nil {
 				return nil, NbtParseError{"Reading long in long array tag", err}
 			}
@@ -170,6 +170,32 @@ func TestLua2Nbt(t *testing.T) {
 	}
 }
 
+func TestLongArrayLength(t *testing.T) {
+	UseJavaEncoding()
+	// a long array's length is an int32, like the other arrays'; it's inside a compound so lazy decoding skips it
+	longs := []byte{12, 0, 1, 'l', 0, 0, 0, 2,
+		0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	b := append(append([]byte{10, 0, 0, 10, 0, 1, 'c'}, longs...), 0, 1, 0, 1, 'b', 5, 0)
+	for _, opts := range [][]Option{nil, {LazyDecoding()}, {CompactArrays()}} {
+		L := NewState(opts...)
+		if err := Nbt2Lua(b, L); err != nil {
+			t.Fatal(err)
+		}
+		err := L.DoString(`
+			local root = nbt[1].value
+			assert(root[2].value == 5)
+			local l = root[1].value[1].value
+			assert(#l == 2 and l[1].least == 1 and l[1].most == 0 and l[2].least == 2^32 - 1 and l[2].most == 2^32 - 1)`)
+		if err != nil {
+			t.Error(err)
+		}
+		if out, err := Lua2Nbt(L); err != nil || !bytes.Equal(out, b) {
+			t.Errorf("expected %v, got %v, %v", b, out, err)
+		}
+		L.Close()
+	}
+}
+
 /*
 // The script run often uses specific files from my computer
 func TestDevChecks(t *testing.T) {
@@ -184,3 +210,64 @@ func TestDevChecks(t *testing.T) {
 
 }
 */
+
+func TestRootModes(t *testing.T) {
+	UseBedrockEncoding()
+	// two byte tags "a" = 1 and "b" = 2, then sector padding
+	twoRoots := []byte{1, 1, 0, 'a', 1, 1, 1, 0, 'b', 2}
+	padded := append(append([]byte(nil), twoRoots[:5]...), 0xde, 0xad, 0, 0)
+
+	L := NewState()
+	defer L.Close()
+	if err := Nbt2Lua(twoRoots, L); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(nbt[1].offset == nil)`); err != nil {
+		t.Error("offsets recorded without TagOffsets: ", err)
+	}
+	L.DoString(`use_tag_offsets()`)
+	if err := Nbt2Lua(twoRoots, L); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(#nbt == 2 and nbt[1].offset == 0 and nbt[2].offset == 5 and nbt[2].value == 2)`); err != nil {
+		t.Error("stream: ", err)
+	}
+	if err := Nbt2Lua(padded, L); err == nil {
+		t.Error("stream: trailing garbage expected to fail")
+	}
+
+	if err := L.DoString(`use_root_mode("first")`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Nbt2Lua(padded, L); err != nil {
+		t.Fatal("first: ", err)
+	}
+	if out, err := Lua2Nbt(L); err != nil || !bytes.Equal(out, padded[:5]) {
+		t.Errorf("first: expected %v, got %v, %v", padded[:5], out, err)
+	}
+
+	if err := L.DoString(`use_root_mode("trailing")`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Nbt2Lua(padded, L); err != nil {
+		t.Fatal("trailing: ", err)
+	}
+	if err := L.DoString(`assert(#nbt == 1 and nbt.trailing == "\222\173\0\0")`); err != nil {
+		t.Error("trailing: ", err)
+	}
+	if out, err := Lua2Nbt(L); err != nil || !bytes.Equal(out, padded) {
+		t.Errorf("trailing: expected %v, got %v, %v", padded, out, err)
+	}
+
+	// offsets inside compounds count from the start of the data, also when decoded lazily
+	nested := []byte{10, 0, 0, 1, 1, 0, 'x', 7, 0}
+	for _, lazy := range []bool{false, true} {
+		getConfig(L).lazy = lazy
+		if err := Nbt2Lua(nested, L); err != nil {
+			t.Fatal(err)
+		}
+		if err := L.DoString(`assert(nbt[1].value[1].offset == 3)`); err != nil {
+			t.Errorf("lazy %v: %v", lazy, err)
+		}
+	}
+}
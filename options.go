@@ -0,0 +1,321 @@
+package nlua
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Key in the Lua registry under which an LState's config is kept
+const configRegistryKey = "nlua.config"
+
+// config holds the per-LState settings chosen with Option values passed to NewState
+type config struct {
+	// sandbox restricts the Lua standard library and confines file access to allowedDirs
+	sandbox     bool
+	allowedDirs []string
+	// lua vm memory limit in MB; 0 is no limit. It also caps the size of arrays nbt_array makes, which gopher-lua
+	// doesn't see until they are allocated
+	memoryLimitMb int
+	// the caller watches memoryLimitMb for several states, so this one doesn't
+	sharedMemoryLimit bool
+	// script execution stops with an error when ctx is done or timeout has passed since NewState
+	ctx     context.Context
+	timeout time.Duration
+	cancel  context.CancelFunc
+	// compound/list nesting limit for conversions; 0 is no limit
+	maxDepth int
+	// decode compounds and lists only when a script reads them
+	lazy bool
+	// decode byte, int and long arrays to Go-backed userdata
+	compact bool
+	// record each decoded tag's offset in the data
+	offsets bool
+	// the Bedrock worlds openworld opened and the script hasn't closed, the latest last
+	worlds []*BedrockWorld
+	// how many top-level tags to decode
+	roots RootMode
+	// the state's own encoding, so states in different goroutines can differ; nil follows UseJavaEncoding etc.
+	encoding *Encoding
+	// detect each loaded file's encoding, switching the state's encoding to it
+	autoEncoding bool
+	// directories searched by require before package.path's defaults
+	modulePath []string
+	// what loadnbt("-") reads and savenbt("-") writes; nil is os.Stdin and os.Stdout
+	stdin  io.Reader
+	stdout io.Writer
+	// how many previous versions savenbt keeps of a file it replaces
+	backups int
+	// savenbt reports what it would change instead of writing
+	dryRun bool
+	// savenbt checks the NBT decodes back to the nbt table before writing
+	verify bool
+	// the first loadnbt and savenbt failures, for LoadError and SaveError
+	loadErr error
+	saveErr error
+}
+
+// RootMode is how Nbt2Lua treats data after the first top-level (root) tag
+type RootMode int
+
+const (
+	// RootsStream decodes the input as a stream of concatenated root tags; anything unparsable is an error
+	RootsStream RootMode = iota
+	// RootsFirst decodes only the first root tag and ignores the rest, which won't be saved
+	RootsFirst
+	// RootsKeepTrailing decodes only the first root tag and keeps the rest as the string `nbt.trailing`, which
+	// Lua2Nbt writes back after the tags
+	RootsKeepTrailing
+)
+
+var rootModeNames = []string{"stream", "first", "trailing"}
+
+func (m RootMode) String() string {
+	if int(m) < len(rootModeNames) {
+		return rootModeNames[m]
+	}
+	return fmt.Sprintf("RootMode(%d)", int(m))
+}
+
+// ParseRootMode returns the RootMode named "stream", "first" or "trailing"
+func ParseRootMode(s string) (RootMode, error) {
+	for i, name := range rootModeNames {
+		if s == name {
+			return RootMode(i), nil
+		}
+	}
+	return RootsStream, fmt.Errorf("root mode '%s' is not one of stream, first or trailing", s)
+}
+
+// Option configures an LState created by NewState
+type Option func(*config)
+
+// Sandbox restricts scripts: os, io, debug, loadfile, dofile and require are removed or reduced to
+// harmless functions, and loadnbt/savenbt may only touch files within the given directories (and
+// their subdirectories). With no directories given, no file may be loaded or saved.
+func Sandbox(allowedDirs ...string) Option {
+	return func(c *config) {
+		c.sandbox = true
+		c.allowedDirs = append(c.allowedDirs, allowedDirs...)
+	}
+}
+
+// MemoryLimit sets the lua vm memory limit in MB, replacing the default of MemoryLimitMb; 0 is no limit.
+// The limit isn't per state: gopher-lua measures the memory of the whole process, and exits the process with status 3
+// when it is exceeded. Each state with a limit watches it until closed, so use one limit for all the states of a
+// process, and MemoryLimit(0) or SharedMemoryLimit for states made while another is watching.
+func MemoryLimit(mb int) Option {
+	return func(c *config) {
+		c.memoryLimitMb = mb
+	}
+}
+
+// SharedMemoryLimit leaves watching the memory limit to the caller, who watches it once for many states as
+// nbtlua -each does. The limit still caps the size of arrays nbt_array makes.
+func SharedMemoryLimit() Option {
+	return func(c *config) {
+		c.sharedMemoryLimit = true
+	}
+}
+
+// Context stops script execution with an error once ctx is cancelled or its deadline passes
+func Context(ctx context.Context) Option {
+	return func(c *config) {
+		c.ctx = ctx
+	}
+}
+
+// Timeout stops script execution with an error once d has passed since NewState; 0 is no limit
+func Timeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// MaxDepth sets how deeply compounds and lists may nest when converting either way, replacing the default of 512;
+// 0 is no limit
+func MaxDepth(n int) Option {
+	return func(c *config) {
+		c.maxDepth = n
+	}
+}
+
+// LazyDecoding makes Nbt2Lua leave compound and list payloads undecoded until a script first reads the tag's
+// value. Lua2Nbt writes tags whose value was never read back verbatim.
+func LazyDecoding() Option {
+	return func(c *config) {
+		c.lazy = true
+	}
+}
+
+// CompactArrays makes Nbt2Lua decode byte (7), int (11) and long (12) array values to userdata backed by a Go
+// slice instead of a lua table per array, with a {least, most} table per long. Lua2Nbt accepts either form.
+func CompactArrays() Option {
+	return func(c *config) {
+		c.compact = true
+	}
+}
+
+// TagOffsets makes Nbt2Lua record in each tag table the offset of the tag's first byte as `offset`. Offsets are
+// into the data Nbt2Lua decodes: after decompression and removing a Bedrock level.dat header, and for network NBT
+// into the equivalent little endian NBT, so they aren't positions in the file itself. Lua2Nbt ignores them.
+func TagOffsets() Option {
+	return func(c *config) {
+		c.offsets = true
+	}
+}
+
+// Roots sets how Nbt2Lua treats data after the first root tag; the default is RootsStream
+func Roots(mode RootMode) Option {
+	return func(c *config) {
+		c.roots = mode
+	}
+}
+
+// ModulePath adds directories for require to search, in order, before the default package.path, so
+// require "inventory" finds dir/inventory.lua or dir/inventory/init.lua. Entries containing '?' are added as
+// package.path templates as they are. Sandboxed states have no require, so this does nothing for them.
+func ModulePath(dirs ...string) Option {
+	return func(c *config) {
+		c.modulePath = append(c.modulePath, dirs...)
+	}
+}
+
+// Stdio makes loadnbt("-") read in and savenbt("-") write out instead of standard input and output, for programs
+// that serve NBT over other streams. Dry runs report to out too.
+func Stdio(in io.Reader, out io.Writer) Option {
+	return func(c *config) {
+		c.stdin = in
+		c.stdout = out
+	}
+}
+
+// Backups makes savenbt keep the previous contents of a file it replaces as file.bak, rotating n versions
+// through file.bak.1 up to file.bak.<n-1>; see WriteFile
+func Backups(n int) Option {
+	return func(c *config) {
+		c.backups = n
+	}
+}
+
+// DryRun makes savenbt write nothing. Instead it prints the changes saving would make to the file, as found by
+// DiffNbt, to standard output or the Stdio writer, and returns them to the script as a table of {kind, path, old, new} tables.
+func DryRun() Option {
+	return func(c *config) {
+		c.dryRun = true
+	}
+}
+
+// Verify makes savenbt check with VerifyNbt that what it is about to write decodes back to exactly the nbt table,
+// and refuse to write if it doesn't
+func Verify() Option {
+	return func(c *config) {
+		c.verify = true
+	}
+}
+
+// StateEncoding gives the LState its own encoding, e, instead of following the package-wide setting changed by
+// UseJavaEncoding and the like. Its use_*_encoding lua functions then change only its own encoding, so states
+// running in parallel don't interfere.
+func StateEncoding(e Encoding) Option {
+	return func(c *config) {
+		// a variable per state: setEncoding writes through the pointer
+		v := e
+		c.encoding = &v
+	}
+}
+
+// AutoEncoding makes loadnbt and LoadNbt detect each file's encoding with DetectEncoding, preferring the current
+// one when the data fits several, and switch to it so the file saves back the same way. It implies
+// StateEncoding, starting from the package-wide encoding unless StateEncoding is also given.
+func AutoEncoding() Option {
+	return func(c *config) {
+		c.autoEncoding = true
+		if c.encoding == nil {
+			e := encoding
+			c.encoding = &e
+		}
+	}
+}
+
+// currentEncoding is the encoding conversions use: the state's own, or else the package-wide one
+func (c *config) currentEncoding() Encoding {
+	if c.encoding != nil {
+		return *c.encoding
+	}
+	return encoding
+}
+
+// setEncoding changes the state's own encoding if it has one, or else the package-wide one
+func (c *config) setEncoding(e Encoding) {
+	if c.encoding != nil {
+		*c.encoding = e
+		return
+	}
+	encoding = e
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{memoryLimitMb: MemoryLimitMb, maxDepth: MaxNbtDepth}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// context combines the Context and Timeout options; nil when neither is set
+func (c *config) context() context.Context {
+	ctx := c.ctx
+	if c.timeout > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		// CloseState calls cancel; otherwise the timer releases the context's resources once it fires
+		ctx, c.cancel = context.WithTimeout(ctx, c.timeout)
+	}
+	return ctx
+}
+
+// setModulePath prepends c's module path to package.path
+func (c *config) setModulePath(L *lua.LState) {
+	pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable)
+	if c.sandbox || !ok || len(c.modulePath) == 0 {
+		return
+	}
+	var templates []string
+	for _, dir := range c.modulePath {
+		if strings.Contains(dir, "?") {
+			templates = append(templates, dir)
+		} else if dir != "" {
+			templates = append(templates, filepath.Join(dir, "?.lua"), filepath.Join(dir, "?", "init.lua"))
+		}
+	}
+	if path := lua.LVAsString(pkg.RawGetString("path")); path != "" {
+		templates = append(templates, path)
+	}
+	pkg.RawSetString("path", lua.LString(strings.Join(templates, ";")))
+}
+
+// stores c in L's registry so the lua functions injected by Nlua can find it
+func setConfig(L *lua.LState, c *config) {
+	ud := L.NewUserData()
+	ud.Value = c
+	L.G.Registry.RawSetString(configRegistryKey, ud)
+}
+
+// getConfig returns the config stored by NewState, or the defaults if L was created elsewhere and passed to Nlua
+func getConfig(L *lua.LState) *config {
+	if ud, ok := L.G.Registry.RawGetString(configRegistryKey).(*lua.LUserData); ok {
+		if c, ok := ud.Value.(*config); ok {
+			return c
+		}
+	}
+	c := newConfig(nil)
+	setConfig(L, c)
+	return c
+}
@@ -0,0 +1,134 @@
+package nlua
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxDepth(t *testing.T) {
+	// compound "" containing compound "" containing byte "" = 1
+	nested := []byte{10, 0, 0, 10, 0, 0, 1, 0, 0, 1, 0, 0}
+	UseBedrockEncoding()
+
+	L := NewState(MaxDepth(2))
+	defer L.Close()
+	if err := Nbt2Lua(nested, L); err != nil {
+		t.Error("depth 2 within limit of 2: ", err)
+	}
+	if _, err := Lua2Nbt(L); err != nil {
+		t.Error("writing depth 2 within limit of 2: ", err)
+	}
+
+	L1 := NewState(MaxDepth(1))
+	defer L1.Close()
+	if err := Nbt2Lua(nested, L1); err == nil {
+		t.Error("depth 2 expected to fail with limit of 1")
+	}
+
+	// a table that contains itself must not recurse forever
+	if err := L1.DoString(`
+		local c = { tagType = 10, name = "loop" }
+		c.value = { c }
+		nbt = { c }
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lua2Nbt(L1); err == nil {
+		t.Error("self-referencing compound expected to fail")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	L := NewState(Timeout(50 * time.Millisecond))
+	defer L.Close()
+	done := make(chan error)
+	go func() {
+		done <- L.DoString(`while true do end`)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("endless loop expected to stop with an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("endless loop not stopped by timeout")
+	}
+}
+
+func TestStateEncoding(t *testing.T) {
+	UseBedrockEncoding()
+	L := NewState(StateEncoding(JavaEncoding))
+	defer L.Close()
+	// int "" = 1, big endian
+	if err := Nbt2Lua([]byte{3, 0, 0, 0, 0, 0, 1}, L); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(nbt[1].value == 1); use_bedrock_encoding()`); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := Lua2Nbt(L); err != nil || b[3] != 1 {
+		t.Errorf("state encoding not changed by use_bedrock_encoding: % x, %v", b, err)
+	}
+	UseJavaEncoding()
+	defer UseBedrockEncoding()
+	if b, _ := Lua2Nbt(L); b[3] != 1 {
+		t.Error("state encoding changed by UseJavaEncoding")
+	}
+
+	// states made from one Option each have their own encoding
+	opt := StateEncoding(JavaEncoding)
+	a, b := NewState(opt), NewState(opt)
+	defer a.Close()
+	defer b.Close()
+	if err := a.DoString(`use_bedrock_encoding()`); err != nil {
+		t.Fatal(err)
+	}
+	if e := getConfig(b).currentEncoding(); e != JavaEncoding {
+		t.Errorf("changing one state's encoding changed another's to %v", e)
+	}
+}
+
+func TestModulePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nlua-modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "inventory.lua"), []byte(`return { slots = 36 }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	L := NewState(ModulePath(dir))
+	defer L.Close()
+	if err := L.DoString(`assert(require("inventory").slots == 36)`); err != nil {
+		t.Fatal(err)
+	}
+	sandboxed := NewState(ModulePath(dir), Sandbox())
+	defer sandboxed.Close()
+	if err := sandboxed.DoString(`assert(require == nil)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStdio(t *testing.T) {
+	// compound "" containing byte "" = 1, gzipped
+	raw := []byte{10, 0, 0, 1, 0, 0, 1, 0}
+	in, err := Compress(raw, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	L := NewState(StateEncoding(BedrockEncoding), Stdio(bytes.NewReader(in), &out), Sandbox())
+	defer L.Close()
+	if err := L.DoString(`loadnbt("-") nbt[1].value[1].value = 2 savenbt("-")`); err != nil {
+		t.Fatal(err)
+	}
+	// saved gzipped, as loaded
+	got, c, err := Decompress(out.Bytes())
+	if want := []byte{10, 0, 0, 1, 0, 0, 2, 0}; err != nil || c != Gzip || !bytes.Equal(got, want) {
+		t.Errorf("expected gzipped %v, got %v %v, %v", want, c, got, err)
+	}
+}
@@ -0,0 +1,389 @@
+package nlua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Paths name a tag within the global nbt like Java Edition's NBT paths: compound child names separated by dots,
+// with [n] for the zero-based n-th element of a list or array, as in Inventory[0].id. Names with dots,
+// brackets or spaces can be double quoted. Paths start inside the unnamed root compound, or, if the root
+// compound is named, at the document so the first step is the root's name.
+
+var tagTypeNames = []string{"end", "byte", "short", "int", "long", "float", "double", "byte_array", "string",
+	"list", "compound", "int_array", "long_array"}
+
+// tagTypeName returns the name of tag type t as used by ParseTagType
+func tagTypeName(t byte) string {
+	if int(t) < len(tagTypeNames) {
+		return tagTypeNames[t]
+	}
+	return fmt.Sprintf("tag %d", t)
+}
+
+// ParseTagType returns the tag type named like "int" or "byte_array", or given as a number
+func ParseTagType(s string) (byte, error) {
+	for i, name := range tagTypeNames {
+		if i > 0 && (s == name || s == strconv.Itoa(i)) {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tag type '%s'", s)
+}
+
+// pathStep is one step of a path: a child tag name, or an element index
+type pathStep struct {
+	name  string
+	index int
+	isIdx bool
+}
+
+func (s pathStep) String() string {
+	if s.isIdx {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	if s.name == "" || strings.ContainsAny(s.name, `.[]" `) {
+		return `"` + s.name + `"`
+	}
+	return s.name
+}
+
+func parsePath(path string) ([]pathStep, error) {
+	var steps []pathStep
+	for i := 0; i < len(path); {
+		switch c := path[i]; {
+		case c == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path '%s': unclosed [", path)
+			}
+			n, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("path '%s': bad index %s", path, path[i:i+end+1])
+			}
+			steps = append(steps, pathStep{index: n, isIdx: true})
+			i += end + 1
+		case c == '.' && len(steps) > 0:
+			i++
+		case c == '"':
+			end := strings.IndexByte(path[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("path '%s': unclosed quote", path)
+			}
+			steps = append(steps, pathStep{name: path[i+1 : i+1+end]})
+			i += end + 2
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path '%s': empty name", path)
+			}
+			steps = append(steps, pathStep{name: path[i : i+end]})
+			i += end
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return steps, nil
+}
+
+// step returns the value and tag type that s refers to in v, a value of tag type t
+func step(L *lua.LState, v lua.LValue, t byte, s pathStep) (lua.LValue, byte, error) {
+	if !s.isIdx {
+		compound, ok := v.(*lua.LTable)
+		if t != 10 || !ok {
+			return nil, 0, fmt.Errorf("can't get '%s' from a tag %d", s.name, t)
+		}
+		tag := findTag(compound, s.name)
+		if tag == nil {
+			return nil, 0, fmt.Errorf("no tag named '%s'", s.name)
+		}
+		return tagValue(L, tag), tagType(tag), nil
+	}
+	switch t {
+	case 9:
+		elements, listType := listOf(v)
+		if elements == nil {
+			return nil, 0, fmt.Errorf("the tag 9 value is not a list")
+		}
+		if s.index >= elements.Len() {
+			return nil, 0, fmt.Errorf("index %d is past the end of the list", s.index)
+		}
+		return elements.RawGetInt(s.index + 1), listType, nil
+	case 7, 11, 12:
+		a, err := arrayOf(v, t)
+		if err != nil {
+			return nil, 0, fmt.Errorf("the tag %d array: %v", t, err)
+		}
+		if s.index >= a.len() {
+			return nil, 0, fmt.Errorf("index %d is past the end of the array", s.index)
+		}
+		return a.toLua(L, a.get(s.index)), arrayElementType(t), nil
+	}
+	return nil, 0, fmt.Errorf("can't index a tag %d", t)
+}
+
+// walkPath follows steps from the root and returns the value and tag type reached
+func walkPath(L *lua.LState, steps []pathStep) (lua.LValue, byte, error) {
+	doc, ok := L.GetGlobal("nbt").(*lua.LTable)
+	if !ok {
+		return nil, 0, LuaNbtError{fmt.Sprintf("Global nbt type, expected %T, got %T", lua.LTable{}, L.GetGlobal("nbt")), nil}
+	}
+	var v lua.LValue = rootCompound(L, doc)
+	t := byte(10)
+	for i, s := range steps {
+		var err error
+		if v, t, err = step(L, v, t, s); err != nil {
+			return nil, 0, fmt.Errorf("at %s: %v", pathString(steps[:i+1]), err)
+		}
+	}
+	return v, t, nil
+}
+
+func pathString(steps []pathStep) string {
+	var b strings.Builder
+	for i, s := range steps {
+		if i > 0 && !s.isIdx {
+			b.WriteByte('.')
+		}
+		b.WriteString(s.String())
+	}
+	return b.String()
+}
+
+// GetPath returns the tag type and SNBT of the value at path in lua's global nbt table variable
+func GetPath(L *lua.LState, path string) (byte, string, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return 0, "", err
+	}
+	v, t, err := walkPath(L, steps)
+	if err != nil {
+		return 0, "", err
+	}
+	w := &snbtWriter{L: L, c: newCodec(L)}
+	if err := w.value(v, t); err != nil {
+		return 0, "", err
+	}
+	return t, w.b.String(), nil
+}
+
+// The SNBT suffixes of number tag types, either case
+var numberSuffixes = map[byte]string{1: "bB", 2: "sS", 3: "", 4: "lL", 5: "fF", 6: "dD"}
+
+// snbtAs reads s as a value of tag type t: a plain number for number types, with or without SNBT's suffix, the
+// string itself for strings, and SNBT for the rest
+func snbtAs(L *lua.LState, s string, t byte) (lua.LValue, error) {
+	p := &snbtParser{L: L, c: newCodec(L), s: s}
+	switch t {
+	case 1, 2, 3, 4, 5, 6:
+		if t == 1 && (s == "true" || s == "false") {
+			_, v, err := p.scalar(s)
+			return v, err
+		}
+		suffixes := numberSuffixes[t]
+		if len(s) > 1 && strings.IndexByte(suffixes, s[len(s)-1]) >= 0 {
+			s = s[:len(s)-1]
+		}
+		if t < 5 {
+			n, err := strconv.ParseInt(s, 10, integerBits(t))
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not a valid %s", s, tagTypeName(t))
+			}
+			if t == 4 {
+				return (&typedArray{tagType: 12}).toLua(L, n), nil
+			}
+			return lua.LNumber(n), nil
+		}
+		f, err := parseFloat(s, t)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid %s: %v", s, tagTypeName(t), err)
+		}
+		return lua.LNumber(f), nil
+	case 8:
+		return lua.LString(s), nil
+	}
+	got, v, err := p.value()
+	if err == nil && p.peek() != 0 {
+		err = p.errorf("unexpected data after the value")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if got != t {
+		return nil, fmt.Errorf("'%s' is a %s, not a %s", s, tagTypeName(got), tagTypeName(t))
+	}
+	return v, nil
+}
+
+// SetPath sets the value at path in lua's global nbt table variable to value, read as tag type t as by the
+// nbtlua set command. With t 0 an existing tag keeps its type, and a new one's type is inferred from value as
+// SNBT. A missing compound child is added; the compound holding it must exist.
+func SetPath(L *lua.LState, path string, value string, t byte) error {
+	steps, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	parent, parentType, err := walkPath(L, steps[:len(steps)-1])
+	if err != nil {
+		return err
+	}
+	last := steps[len(steps)-1]
+	_, currentType, lookupErr := step(L, parent, parentType, last)
+	if t == 0 && lookupErr == nil {
+		t = currentType
+	}
+	var v lua.LValue
+	if t == 0 {
+		p := &snbtParser{L: L, c: newCodec(L), s: value}
+		if t, v, err = p.value(); err == nil && p.peek() != 0 {
+			err = p.errorf("unexpected data after the value")
+		}
+	} else {
+		v, err = snbtAs(L, value, t)
+	}
+	if err != nil {
+		return fmt.Errorf("at %s: %v", path, err)
+	}
+	if !last.isIdx {
+		compound, ok := parent.(*lua.LTable)
+		if parentType != 10 || !ok {
+			return fmt.Errorf("at %s: can't set '%s' in a tag %d", path, last.name, parentType)
+		}
+		setTag(L, compound, t, last.name, v)
+		return nil
+	}
+	if lookupErr != nil {
+		return fmt.Errorf("at %s: %v", path, lookupErr)
+	}
+	if t != currentType {
+		return fmt.Errorf("at %s: can't put a %s in a list or array of %s", path, tagTypeName(t), tagTypeName(currentType))
+	}
+	switch parentType {
+	case 9:
+		elements, _ := listOf(parent)
+		elements.RawSetInt(last.index+1, v)
+	default:
+		if a := typedArrayOf(parent); a != nil {
+			n, _ := a.fromLua(v)
+			return a.set(last.index, n)
+		}
+		parent.(*lua.LTable).RawSetInt(last.index+1, v)
+	}
+	return nil
+}
+
+// DeletePath removes the tag, list element or array element at path in lua's global nbt table variable
+func DeletePath(L *lua.LState, path string) error {
+	steps, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	parent, parentType, err := walkPath(L, steps[:len(steps)-1])
+	if err != nil {
+		return err
+	}
+	last := steps[len(steps)-1]
+	if _, _, err := step(L, parent, parentType, last); err != nil {
+		return fmt.Errorf("at %s: %v", path, err)
+	}
+	if !last.isIdx {
+		removeTag(parent.(*lua.LTable), last.name)
+		return nil
+	}
+	if parentType == 9 {
+		elements, _ := listOf(parent)
+		elements.Remove(last.index + 1)
+		return nil
+	}
+	if a := typedArrayOf(parent); a != nil {
+		i := last.index
+		switch a.tagType {
+		case 7:
+			a.bytes = append(a.bytes[:i], a.bytes[i+1:]...)
+		case 11:
+			a.ints = append(a.ints[:i], a.ints[i+1:]...)
+		case 12:
+			a.longs = append(a.longs[:i], a.longs[i+1:]...)
+		}
+		return nil
+	}
+	parent.(*lua.LTable).Remove(last.index + 1)
+	return nil
+}
+
+// CompletePath returns the paths that continue partial by one step in lua's global nbt table variable: the names of
+// the children of the compound partial ends in, or the indices of its list or array, for REPL completion
+func CompletePath(L *lua.LState, partial string) []string {
+	cut := strings.LastIndexAny(partial, ".[")
+	parentPath, prefix := "", partial
+	if cut >= 0 {
+		parentPath, prefix = partial[:cut], partial[cut+1:]
+	}
+	var steps []pathStep
+	if parentPath != "" {
+		var err error
+		if steps, err = parsePath(parentPath); err != nil {
+			return nil
+		}
+	}
+	v, t, err := walkPath(L, steps)
+	if err != nil {
+		return nil
+	}
+	var found []string
+	switch {
+	case t == 10 && (cut < 0 || partial[cut] == '.'):
+		compound, _ := v.(*lua.LTable)
+		for i := 1; compound != nil && i <= compound.Len(); i++ {
+			tag, ok := compound.RawGetInt(i).(*lua.LTable)
+			if !ok || tagType(tag) == 0 {
+				continue
+			}
+			name := lua.LVAsString(tag.RawGetString("name"))
+			if strings.HasPrefix(name, strings.TrimPrefix(prefix, `"`)) {
+				found = append(found, partial[:cut+1]+pathStep{name: name}.String())
+			}
+		}
+	case cut >= 0 && partial[cut] == '[':
+		n := 0
+		if t == 9 {
+			if elements, _ := listOf(v); elements != nil {
+				n = elements.Len()
+			}
+		} else if t == 7 || t == 11 || t == 12 {
+			if a, err := arrayOf(v, t); err == nil {
+				n = a.len()
+			}
+		}
+		for i := 0; i < n; i++ {
+			if index := strconv.Itoa(i); strings.HasPrefix(index, prefix) {
+				found = append(found, partial[:cut+1]+index+"]")
+			}
+		}
+	}
+	return found
+}
+
+// get_path(path) returns the value at path in nbt, such as "Data.Player.Inventory[0]", and its tag type, or nil and
+// an error message if there's no such tag. Compound and list values are the tables in nbt, so changing them changes
+// nbt.
+func getPathLua(L *lua.LState) int {
+	steps, err := parsePath(L.CheckString(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	v, t, err := walkPath(L, steps)
+	if err != nil {
+		return pushError(L, "Error getting path", err)
+	}
+	L.Push(v)
+	L.Push(lua.LNumber(t))
+	return 2
+}
@@ -0,0 +1,136 @@
+package nlua
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestPaths(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(textDoc); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"Count": "1b", "Pos[1]": "-2d", `"display name".n`: "-7", "bytes[1]": "-1b", "Time": "4294967301L",
+	} {
+		if _, got, err := GetPath(L, path); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s, %v", path, want, got, err)
+		}
+	}
+	for _, bad := range []string{"missing", "Count.x", "Pos[3]", "Pos[", ".Count", "id[0]"} {
+		if _, _, err := GetPath(L, bad); err == nil {
+			t.Errorf("%s found", bad)
+		}
+	}
+
+	sets := []struct{ path, value, tagType, want string }{
+		{"Count", "5", "", "5b"},
+		{"Time", "-1", "", "-1L"},
+		{"Pos[0]", "4", "", "4d"},
+		{"bytes[0]", "7", "", "7b"},
+		{"new", "{a:[1s]}", "", "{a:[1s]}"},
+		{"new.b", "12", "float", "12f"},
+		{"id", "minecraft:dirt", "", `"minecraft:dirt"`},
+	}
+	for _, s := range sets {
+		var tt byte
+		if s.tagType != "" {
+			tt, _ = ParseTagType(s.tagType)
+		}
+		if err := SetPath(L, s.path, s.value, tt); err != nil {
+			t.Fatalf("setting %s: %v", s.path, err)
+		}
+		if _, got, _ := GetPath(L, s.path); got != s.want {
+			t.Errorf("%s: expected %s, got %s", s.path, s.want, got)
+		}
+	}
+	if err := SetPath(L, "Count", "300", 0); err == nil {
+		t.Error("out of range byte set")
+	}
+	if err := SetPath(L, "Pos[0]", "x", 8); err == nil {
+		t.Error("string set in a list of doubles")
+	}
+	for _, bad := range []string{"inf", "Infinity", "NaN", "1e999", "1e-50"} {
+		if err := SetPath(L, "f", bad, 0); err == nil {
+			t.Errorf("%s set as a float", bad)
+		}
+	}
+
+	if err := DeletePath(L, "Pos[0]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeletePath(L, "new.a"); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"Pos": "[-2d,3d]", "new": "{b:12f}"} {
+		if _, got, _ := GetPath(L, path); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+	if err := DeletePath(L, "missing"); err == nil {
+		t.Error("missing tag deleted")
+	}
+
+	// a list tag whose value isn't a list table
+	if err := L.DoString(`nbt = { { tagType = 10, name = "", value = { { tagType = 9, name = "l", value = 5 } } } }`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetPath(L, "l[0]"); err == nil || !strings.Contains(err.Error(), "not a list") {
+		t.Errorf("expected a not a list error, got %v", err)
+	}
+}
+
+func TestCompletePath(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(textDoc); err != nil {
+		t.Fatal(err)
+	}
+	for partial, want := range map[string]string{
+		"Co": "Count", `"display name".`: `"display name".n`, "Pos[": "Pos[0] Pos[1] Pos[2]", "missing.": "",
+	} {
+		if got := strings.Join(CompletePath(L, partial), " "); !strings.Contains(got, want) ||
+			(want == "") != (got == "") {
+			t.Errorf("%s: expected %s, got %s", partial, want, got)
+		}
+	}
+	if err := L.DoString(`v, t = get_path("Pos[1]")`); err != nil {
+		t.Fatal(err)
+	}
+	if v, tt := L.GetGlobal("v"), L.GetGlobal("t"); v != lua.LNumber(-2) || tt != lua.LNumber(6) {
+		t.Errorf("get_path: expected -2 6, got %v %v", v, tt)
+	}
+	if err := L.DoString(`local v, msg = get_path("Pos[9]") assert(v == nil and msg:find("past the end"), msg)`); err != nil {
+		t.Error(err)
+	}
+	for expr, want := range map[string]string{
+		`nbt[1].value[1]`: "Count (byte): 1b", `nbt[1].value[6].value`: "[1.5d,-2d,3d]", `"x"`: `"x"`, `2`: "2",
+	} {
+		if err := L.DoString("v = " + expr); err != nil {
+			t.Fatal(err)
+		}
+		if got := FormatValue(L, L.GetGlobal("v")); got != want {
+			t.Errorf("%s: expected %s, got %s", expr, want, got)
+		}
+	}
+	// an array that isn't valid for its type is shown with the reason rather than crashing
+	if err := L.DoString(`v = { tagType = 11, name = "a", value = { 2^40, 1 } }`); err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatValue(L, L.GetGlobal("v")); !strings.HasPrefix(got, "table: ") || !strings.Contains(got, "out of range") {
+		t.Errorf("invalid array: got %s", got)
+	}
+	// long values are cut short between runes
+	for _, name := range []string{"a", "ab"} {
+		if err := L.DoString(`v = { tagType = 8, name = "` + name + `", value = string.rep("\195\169", 3000) }`); err != nil {
+			t.Fatal(err)
+		}
+		if got := FormatValue(L, L.GetGlobal("v")); !utf8.ValidString(got) || !strings.Contains(got, "more bytes)") {
+			t.Errorf("long string named %s: got %s", name, got)
+		}
+	}
+}
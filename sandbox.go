@@ -0,0 +1,110 @@
+package nlua
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SandboxError is when a sandboxed script tries to reach a file outside its allowed directories, or standard
+// input or output as "-" without the Stdio option
+type SandboxError struct {
+	path string
+}
+
+func (e SandboxError) Error() string {
+	if e.path == "-" {
+		return "Sandbox: standard input and output are only reachable through the Stdio option"
+	}
+	return fmt.Sprintf("Sandbox: access to '%s' is outside the allowed directories", e.path)
+}
+
+// Standard library functions a sandboxed script may still call; everything else in these libraries is removed
+var sandboxOsFuncs = []string{"clock", "date", "difftime", "time"}
+
+// Base library functions that reach the filesystem or load modules
+var sandboxRemovedGlobals = []string{"dofile", "loadfile", "require", "module"}
+
+// openSandboxLibs opens only the standard libraries that cannot reach the host outside of nlua's own functions
+func openSandboxLibs(L *lua.LState) {
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range sandboxRemovedGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	// build a reduced os table from a full one so the implementations stay gopher-lua's
+	L.Push(L.NewFunction(lua.OpenOs))
+	L.Push(lua.LString(lua.OsLibName))
+	L.Call(1, 1)
+	fullOs := L.CheckTable(-1)
+	L.Pop(1)
+	os := L.NewTable()
+	for _, name := range sandboxOsFuncs {
+		os.RawSetString(name, fullOs.RawGetString(name))
+	}
+	L.SetGlobal(lua.OsLibName, os)
+}
+
+// allowedPath returns the cleaned absolute path if the config permits access to it
+func (c *config) allowedPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if !c.sandbox {
+		return abs, nil
+	}
+	resolved, err := resolveExisting(abs)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range c.allowedDirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if dir, err = filepath.EvalSymlinks(dir); err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return abs, nil
+		}
+	}
+	return "", SandboxError{path}
+}
+
+// resolveExisting follows symlinks in the longest existing prefix of path so a link can't point outside
+// an allowed directory; the non-existent remainder (e.g. a file about to be saved) is appended as-is
+func resolveExisting(path string) (string, error) {
+	var rest []string
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
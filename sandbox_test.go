@@ -0,0 +1,103 @@
+package nlua
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestSandbox(t *testing.T) {
+	allowed, err := ioutil.TempDir("", "nlua-allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(allowed)
+	outside, err := ioutil.TempDir("", "nlua-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	L := NewState(Sandbox(allowed))
+	defer L.Close()
+
+	for _, name := range []string{"io", "debug", "dofile", "loadfile", "require"} {
+		if lv := L.GetGlobal(name); lv != lua.LNil {
+			t.Errorf("%s expected nil in sandbox, got %v", name, lv)
+		}
+	}
+	if err := L.DoString(`assert(os.execute == nil and os.remove == nil and os.time ~= nil)`); err != nil {
+		t.Error("os table not reduced: ", err)
+	}
+
+	L.SetGlobal("allowed", lua.LString(filepath.Join(allowed, "ok.dat")))
+	L.SetGlobal("outside", lua.LString(filepath.Join(outside, "denied.dat")))
+	L.SetGlobal("escape", lua.LString(filepath.Join(allowed, "..", filepath.Base(outside), "denied.dat")))
+	err = L.DoString(`
+		nbt = { { tagType = 1, name = "b", value = 1 } }
+		savenbt(allowed)
+		savenbt(outside)
+		savenbt(escape)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(allowed, "ok.dat")); err != nil {
+		t.Error("save within allowed directory failed: ", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "denied.dat")); err == nil {
+		t.Error("save outside allowed directory was not blocked")
+	}
+
+	// a denied load returns nil and a message, leaves nbt alone and is remembered for LoadError
+	if err := ioutil.WriteFile(filepath.Join(outside, "denied.dat"), []byte{1, 0, 1, 'c', 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = L.DoString(`
+		local ok, msg = loadnbt(outside)
+		assert(ok == nil and msg:find("^Error reading file: "), msg)
+		assert(nbt[1].name == "b")
+		assert(loadnbt(allowed) == true)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if LoadError(L) == nil {
+		t.Error("denied load not reported by LoadError")
+	}
+
+	// "-" is not the host's standard input or output in a sandbox, only the Stdio streams
+	err = L.DoString(`
+		local ok, msg = loadnbt("-")
+		assert(ok == nil and msg:find("Stdio"), msg)
+		ok, msg = savenbt("-")
+		assert(ok == nil and msg:find("Stdio"), msg)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	piped := NewState(Sandbox(allowed), Stdio(bytes.NewReader([]byte{1, 1, 0, 'c', 2}), &out))
+	defer piped.Close()
+	err = piped.DoString(`
+		assert(loadnbt("-") == true and nbt[1].name == "c")
+		assert(savenbt("-") == true)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{1, 1, 0, 'c', 2}) {
+		t.Errorf("savenbt(\"-\") wrote %v to the Stdio writer", out.Bytes())
+	}
+
+	// symlinks can't be used to leave the allowed directory
+	if err := os.Symlink(outside, filepath.Join(allowed, "link")); err == nil {
+		if _, err := getConfig(L).allowedPath(filepath.Join(allowed, "link", "denied.dat")); err == nil {
+			t.Error("symlink out of allowed directory was not blocked")
+		}
+	}
+}
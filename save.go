@@ -0,0 +1,110 @@
+package nlua
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// backupName is the name of the nth most recent backup of path: path.bak, then path.bak.1, path.bak.2, ...
+func backupName(path string, n int) string {
+	if n == 0 {
+		return path + ".bak"
+	}
+	return fmt.Sprintf("%s.bak.%d", path, n)
+}
+
+// WriteFile replaces the file at path with b so that a crash or full disk leaves either the old or the new
+// contents, never a mix: b is written to a temporary file in the same directory, synced, and renamed over path.
+// With backups > 0 the previous contents are kept as path.bak, and older ones rotate through path.bak.1 up to
+// path.bak.<backups-1>.
+func WriteFile(path string, b []byte, backups int) error {
+	// replace a symlink's target, not the link
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	mode := os.FileMode(0644)
+	old, err := os.Stat(path)
+	if err == nil {
+		mode = old.Mode().Perm()
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if backups > 0 && old != nil && old.Mode().IsRegular() {
+		if err := backup(path, backups); err != nil {
+			return fmt.Errorf("backing up %s: %v", path, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable; directories can't be synced on some systems, which is no reason to fail
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// backup rotates the existing backups of path, dropping the oldest, and makes path's current contents path.bak
+func backup(path string, backups int) error {
+	if err := os.Remove(backupName(path, backups-1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := backups - 2; n >= 0; n-- {
+		if err := os.Rename(backupName(path, n), backupName(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// a hard link keeps the original file, untouched, until the rename replaces path
+	if err := os.Link(path, backupName(path, 0)); err == nil {
+		return nil
+	}
+	return copyFile(path, backupName(path, 0))
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,141 @@
+package nlua
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nlua-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "level.dat")
+	for _, s := range []string{"one", "two", "three", "four"} {
+		if err := WriteFile(path, []byte(s), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"level.dat": "four", "level.dat.bak": "three", "level.dat.bak.1": "two"} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s: expected %s, got %s, %v", name, want, got, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("expected 3 files, got %d", len(files))
+	}
+
+	// savenbt keeps one backup after use_backups(1)
+	L := NewState(StateEncoding(BedrockEncoding))
+	defer L.Close()
+	script := `use_backups(1) nbt = { { tagType = 1, name = "", value = 1 } } savenbt("` + filepath.ToSlash(path) + `")`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path + ".bak"); string(got) != "four" {
+		t.Errorf("expected backup four, got %s", got)
+	}
+	if got, _ := ioutil.ReadFile(path); len(got) != 4 {
+		t.Errorf("expected a 4 byte save, got %v", got)
+	}
+}
+
+func TestSaveBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nlua-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a Bedrock level.dat: storage version 10 and length header, then compound "" containing int "n" = 5
+	level := []byte{10, 0, 0, 0, 12, 0, 0, 0, 10, 0, 0, 3, 1, 0, 'n', 5, 0, 0, 0, 0}
+	java, err := Compress([]byte{10, 0, 0, 3, 0, 1, 'n', 0, 0, 0, 5, 0}, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"level.dat": level, "player.dat": java} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		L := NewState(StateEncoding(JavaEncoding), AutoEncoding())
+		defer L.Close()
+		L.SetGlobal("path", lua.LString(path))
+		if err := L.DoString(`loadnbt(path) use_java_encoding() savenbt() savenbt(path .. ".copy")`); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadFile(path)
+		plain, c, err := Decompress(got)
+		want, wantC, _ := Decompress(data)
+		if err != nil || c != wantC || !bytes.Equal(plain, want) {
+			t.Errorf("%s: expected %v %v, got %v %v, %v", name, wantC, want, c, plain, err)
+		}
+		// saving elsewhere writes plain NBT in the state's encoding
+		wantCopy := []byte{10, 0, 0, 3, 0, 1, 'n', 0, 0, 0, 5, 0}
+		if got, _ := ioutil.ReadFile(path + ".copy"); !bytes.Equal(got, wantCopy) {
+			t.Errorf("%s copy: expected %v, got %v", name, wantCopy, got)
+		}
+		// a dry run compares what the real save wrote with what it would write again
+		getConfig(L).dryRun = true
+		if err := L.DoString(`assert(#savenbt() == 0)`); err != nil {
+			t.Errorf("%s dry run: %v", name, err)
+		}
+	}
+}
+
+func TestSaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nlua-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	L := NewState(Sandbox(dir))
+	defer L.Close()
+	script := `nbt = { { tagType = 1, name = "", value = 1 } }
+		assert(savenbt() == nil)
+		local ok, msg = savenbt("/outside/level.dat")
+		assert(ok == nil and msg:find("Error writing file"), msg)`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveError(L); err == nil || !strings.Contains(err.Error(), "needs a path") {
+		t.Errorf("expected the first failed save, got %v", err)
+	}
+}
+
+func TestSaveEncodingConcurrently(t *testing.T) {
+	// states without their own encoding share the package-wide one, which saving in nbt.encoding must not change
+	UseJavaEncoding()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			L := NewState(MemoryLimit(0))
+			defer L.Close()
+			for j := 0; j < 50; j++ {
+				if err := L.DoString(`nbt = { encoding = "bedrock", { tagType = 3, name = "", value = 1 } }`); err != nil {
+					t.Error(err)
+					return
+				}
+				b, err := SaveNbt(L)
+				if err != nil || !bytes.Equal(b, []byte{3, 0, 0, 1, 0, 0, 0}) {
+					t.Errorf("expected little endian int, got %v, %v", b, err)
+					return
+				}
+				if b, err := Lua2Nbt(L); err != nil || !bytes.Equal(b, []byte{3, 0, 0, 0, 0, 0, 1}) {
+					t.Errorf("expected big endian int, got %v, %v", b, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,411 @@
+package nlua
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Schematic files as read into structure objects: MCEdit .schematic files of numeric block ids, and Sponge
+// .schem files (versions 1 to 3) of a named palette and varint-packed indices. Both order blocks by y, then z,
+// then x, and have no structure void.
+
+// schematicRoot returns the compound value holding a schematic's tags: the root tag's, which is usually named
+// "Schematic", or for Sponge version 3 the Schematic compound inside it
+func schematicRoot(L *lua.LState, doc *lua.LTable) *lua.LTable {
+	root := rootCompound(L, doc)
+	if first, ok := root.RawGetInt(1).(*lua.LTable); ok && root == doc && tagType(first) == 10 &&
+		first.RawGetString("name") == lua.LString("Schematic") {
+		root, _ = tagValue(L, first).(*lua.LTable)
+	}
+	if inner := findCompound(L, root, "Schematic"); inner != nil {
+		return inner
+	}
+	return root
+}
+
+// shortValue reads a short tag as unsigned, as schematic sizes are
+func shortValue(L *lua.LState, compound *lua.LTable, name string) int {
+	n, _ := findValue(L, compound, name, 2).(lua.LNumber)
+	return int(uint16(int16(n)))
+}
+
+func setShort(L *lua.LState, compound *lua.LTable, name string, n int) {
+	setTag(L, compound, 2, name, lua.LNumber(int16(uint16(n))))
+}
+
+func (s *structure) readSize(L *lua.LState, root *lua.LTable) error {
+	s.size = [3]int{shortValue(L, root, "Width"), shortValue(L, root, "Height"), shortValue(L, root, "Length")}
+	if s.size[0] == 0 || s.size[1] == 0 || s.size[2] == 0 {
+		return fmt.Errorf("no Width, Height and Length; not a schematic")
+	}
+	return nil
+}
+
+// gridPos is the position of the i-th block of a schematic
+func (s *structure) gridPos(i int) [3]int {
+	return [3]int{i % s.size[0], i / (s.size[0] * s.size[2]), i / s.size[0] % s.size[2]}
+}
+
+// withoutTags returns a copy of a compound value without the named tags
+func withoutTags(L *lua.LState, compound *lua.LTable, names ...string) *lua.LTable {
+	c := L.CreateTable(compound.Len(), 0)
+	compound.ForEach(func(_, v lua.LValue) {
+		if tag, ok := v.(*lua.LTable); ok {
+			for _, name := range names {
+				if tag.RawGetString("name") == lua.LString(name) {
+					return
+				}
+			}
+		}
+		c.Append(v)
+	})
+	return c
+}
+
+// readSchematic reads an MCEdit or Sponge schematic document, its root tag or the root tag's value
+func readSchematic(L *lua.LState, doc *lua.LTable) (*structure, error) {
+	root := schematicRoot(L, doc)
+	s := newStructure([3]int{})
+	s.doc = doc
+	if err := s.readSize(L, root); err != nil {
+		return nil, err
+	}
+	if findCompound(L, root, "Palette") != nil || findCompound(L, root, "Blocks") != nil {
+		return s, s.readSchem(L, root)
+	}
+	if findValue(L, root, "Blocks", 7) != lua.LNil {
+		return s, s.readSchematic(L, root)
+	}
+	return nil, fmt.Errorf("no Palette or Blocks; not a schematic")
+}
+
+func (s *structure) readSchem(L *lua.LState, root *lua.LTable) error {
+	s.format = "schem"
+	if v, ok := findValue(L, root, "Version", 3).(lua.LNumber); ok {
+		s.version = int(v)
+	}
+	if v, ok := findValue(L, root, "DataVersion", 3).(lua.LNumber); ok {
+		s.dataVersion = int(v)
+	}
+	offset, err := arrayOf(findValue(L, root, "Offset", 11), 11)
+	if err != nil {
+		return fmt.Errorf("Offset %v", err)
+	}
+	if offset.len() == 3 {
+		s.offset = [3]int{int(offset.ints[0]), int(offset.ints[1]), int(offset.ints[2])}
+	}
+	blocks := root
+	if s.version == 3 {
+		if blocks = findCompound(L, root, "Blocks"); blocks == nil {
+			return fmt.Errorf("no Blocks compound")
+		}
+	}
+	palette := findCompound(L, blocks, "Palette")
+	if palette == nil {
+		return fmt.Errorf("no Palette compound")
+	}
+	byIndex := map[int]int{}
+	palette.ForEach(func(_, v lua.LValue) {
+		tag, ok := v.(*lua.LTable)
+		if !ok || err != nil {
+			return
+		}
+		var b blockState
+		if b, err = parseBlockState(lua.LVAsString(tag.RawGetString("name"))); err == nil {
+			byIndex[int(lua.LVAsNumber(tagValue(L, tag)))] = s.stateIndex(b)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	dataName := "BlockData"
+	if s.version == 3 {
+		dataName = "Data"
+	}
+	a, err := arrayOf(findValue(L, blocks, dataName, 7), 7)
+	if err != nil {
+		return fmt.Errorf("%s %v", dataName, err)
+	}
+	data := a.bytes
+	for i, n := 0, 0; n < s.size[0]*s.size[1]*s.size[2]; n++ {
+		var v, shift uint
+		for {
+			if i >= len(data) {
+				return fmt.Errorf("%s ends after %d of %d blocks", dataName, n, s.size[0]*s.size[1]*s.size[2])
+			}
+			b := byte(data[i])
+			i++
+			v |= uint(b&0x7f) << shift
+			if b < 0x80 {
+				break
+			}
+			shift += 7
+		}
+		state, ok := byIndex[int(v)]
+		if !ok {
+			return fmt.Errorf("block %d has index %d, which isn't in the palette", n, v)
+		}
+		s.put(s.gridPos(n), state, nil)
+	}
+	// block entities and entities name their id "Id"; version 3 puts their data in a Data compound
+	readData := func(compound *lua.LTable) *lua.LTable {
+		id := findValue(L, compound, "Id", 8)
+		nbt := withoutTags(L, compound, "Pos", "Id", "Data")
+		if d := findCompound(L, compound, "Data"); d != nil && s.version == 3 {
+			nbt = withoutTags(L, d, "id")
+		}
+		if id != lua.LNil {
+			nbt.Insert(1, newTag(L, 8, "id", id))
+		}
+		return nbt
+	}
+	blockEntities, _ := findList(L, blocks, "BlockEntities")
+	if blockEntities == nil {
+		// version 1
+		blockEntities, _ = findList(L, blocks, "TileEntities")
+	}
+	for i := 1; blockEntities != nil && i <= blockEntities.Len(); i++ {
+		be, ok := blockEntities.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		pos, err := arrayOf(findValue(L, be, "Pos", 11), 11)
+		if err != nil {
+			return fmt.Errorf("block entity Pos %v", err)
+		}
+		if pos.len() != 3 {
+			continue
+		}
+		if b := s.get([3]int{int(pos.ints[0]), int(pos.ints[1]), int(pos.ints[2])}); b != nil {
+			b.nbt = readData(be)
+		}
+	}
+	entities, _ := findList(L, root, "Entities")
+	for i := 1; entities != nil && i <= entities.Len(); i++ {
+		entity, ok := entities.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		list, _ := findList(L, entity, "Pos")
+		pos := numbersOf(list)
+		if len(pos) != 3 {
+			continue
+		}
+		s.addEntity([3]float64{pos[0], pos[1], pos[2]}, readData(entity))
+	}
+	return nil
+}
+
+func (s *structure) readSchematic(L *lua.LState, root *lua.LTable) error {
+	s.format = "schematic"
+	blocks, err := arrayOf(findValue(L, root, "Blocks", 7), 7)
+	if err != nil {
+		return fmt.Errorf("Blocks %v", err)
+	}
+	blockData, err := arrayOf(findValue(L, root, "Data", 7), 7)
+	if err != nil {
+		return fmt.Errorf("Data %v", err)
+	}
+	ids, data := blocks.bytes, blockData.bytes
+	n := s.size[0] * s.size[1] * s.size[2]
+	if len(ids) != n || len(data) != n {
+		return fmt.Errorf("Blocks and Data should have %d elements, have %d and %d", n, len(ids), len(data))
+	}
+	unknown := 0
+	byId := map[[2]int]int{}
+	for i := range ids {
+		key := [2]int{int(uint8(ids[i])), int(data[i] & 15)}
+		state, ok := byId[key]
+		if !ok {
+			b, err := legacyBlockState(key[0], key[1])
+			if err != nil {
+				unknown++
+				b, _ = legacyBlockState(0, 0)
+			}
+			state = s.stateIndex(b)
+			byId[key] = state
+		}
+		s.put(s.gridPos(i), state, nil)
+	}
+	if unknown > 0 {
+		s.warnings = append(s.warnings, fmt.Sprintf("%d unknown block ids and data values read as air", unknown))
+	}
+	tileEntities, _ := findList(L, root, "TileEntities")
+	for i := 1; tileEntities != nil && i <= tileEntities.Len(); i++ {
+		te, ok := tileEntities.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		var pos [3]int
+		for k, name := range []string{"x", "y", "z"} {
+			v, _ := findValue(L, te, name, 3).(lua.LNumber)
+			pos[k] = int(v)
+		}
+		if b := s.get(pos); b != nil {
+			b.nbt = withoutTags(L, te, "x", "y", "z")
+		}
+	}
+	entities, _ := findList(L, root, "Entities")
+	for i := 1; entities != nil && i <= entities.Len(); i++ {
+		entity, ok := entities.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		list, _ := findList(L, entity, "Pos")
+		if pos := numbersOf(list); len(pos) == 3 {
+			s.addEntity([3]float64{pos[0], pos[1], pos[2]}, entity)
+		}
+	}
+	return nil
+}
+
+// gridStates returns the palette index of every block in schematic order, air where there is no block
+func (s *structure) gridStates() []int {
+	air := -1
+	states := make([]int, s.size[0]*s.size[1]*s.size[2])
+	for i := range states {
+		if b := s.get(s.gridPos(i)); b != nil {
+			states[i] = b.state
+			continue
+		}
+		if air < 0 {
+			air = s.stateIndex(blockState{name: "minecraft:air"})
+		}
+		states[i] = air
+	}
+	return states
+}
+
+func (s *structure) writeSchem(L *lua.LState, root *lua.LTable, version int) {
+	states := s.gridStates()
+	setTag(L, root, 3, "Version", lua.LNumber(version))
+	if version > 1 {
+		setTag(L, root, 3, "DataVersion", lua.LNumber(s.dataVersion))
+	}
+	setShort(L, root, "Width", s.size[0])
+	setShort(L, root, "Height", s.size[1])
+	setShort(L, root, "Length", s.size[2])
+	offset := &typedArray{tagType: 11, ints: []int32{int32(s.offset[0]), int32(s.offset[1]), int32(s.offset[2])}}
+	setTag(L, root, 11, "Offset", arrayValue(L, offset, findValue(L, root, "Offset", 11)))
+
+	blocks, dataName, blockEntitiesName := root, "BlockData", "BlockEntities"
+	if version == 1 {
+		blockEntitiesName = "TileEntities"
+	}
+	if version == 3 {
+		if blocks = findCompound(L, root, "Blocks"); blocks == nil {
+			blocks = L.NewTable()
+			root.Append(newTag(L, 10, "Blocks", blocks))
+		}
+		dataName = "Data"
+	} else {
+		setTag(L, root, 3, "PaletteMax", lua.LNumber(len(s.palettes[0])))
+	}
+	palette := L.CreateTable(len(s.palettes[0]), 0)
+	for i, b := range s.palettes[0] {
+		palette.Append(newTag(L, 3, b.String(), lua.LNumber(i)))
+	}
+	setTag(L, blocks, 10, "Palette", palette)
+	data := &typedArray{tagType: 7}
+	for _, state := range states {
+		v := uint(state)
+		for v >= 0x80 {
+			data.bytes = append(data.bytes, int8(byte(v)|0x80))
+			v >>= 7
+		}
+		data.bytes = append(data.bytes, int8(v))
+	}
+	setTag(L, blocks, 7, dataName, arrayValue(L, data, findValue(L, blocks, dataName, 7)))
+
+	// version 3 nests data in a Data compound, earlier versions put it beside Pos and Id
+	withData := func(nbt *lua.LTable, pos lua.LValue, posType byte) *lua.LTable {
+		compound := L.NewTable()
+		compound.Append(newTag(L, posType, "Pos", pos))
+		if id := findValue(L, nbt, "id", 8); id != lua.LNil {
+			compound.Append(newTag(L, 8, "Id", id))
+		}
+		if version == 3 {
+			compound.Append(newTag(L, 10, "Data", nbt))
+			return compound
+		}
+		withoutTags(L, nbt, "id").ForEach(func(_, v lua.LValue) { compound.Append(v) })
+		return compound
+	}
+	blockEntities := L.NewTable()
+	for _, b := range s.blocks {
+		if b.nbt != nil {
+			pos := &typedArray{tagType: 11, ints: []int32{int32(b.pos[0]), int32(b.pos[1]), int32(b.pos[2])}}
+			blockEntities.Append(withData(b.nbt, arrayValue(L, pos, lua.LNil), 11))
+		}
+	}
+	setTag(L, blocks, 9, blockEntitiesName, newList(L, 10, blockEntities))
+	entities := L.NewTable()
+	for _, e := range s.entities {
+		nbt := e.nbt
+		if nbt == nil {
+			nbt = L.NewTable()
+		}
+		entities.Append(withData(nbt, numberList(L, 6, e.pos[0], e.pos[1], e.pos[2]), 9))
+	}
+	setTag(L, root, 9, "Entities", newList(L, 10, entities))
+}
+
+func (s *structure) writeSchematic(L *lua.LState, root *lua.LTable) {
+	states := s.gridStates()
+	setShort(L, root, "Width", s.size[0])
+	setShort(L, root, "Height", s.size[1])
+	setShort(L, root, "Length", s.size[2])
+	setTag(L, root, 8, "Materials", lua.LString("Alpha"))
+	ids := &typedArray{tagType: 7, bytes: make([]int8, len(states))}
+	data := &typedArray{tagType: 7, bytes: make([]int8, len(states))}
+	byState := map[int][2]int{}
+	unknown := 0
+	for i, state := range states {
+		id, ok := byState[state]
+		if !ok {
+			var err error
+			if id[0], id[1], err = legacyId(s.palettes[0][state]); err != nil {
+				unknown++
+			}
+			byState[state] = id
+		}
+		ids.bytes[i], data.bytes[i] = int8(id[0]), int8(id[1])
+	}
+	if unknown > 0 {
+		s.warnings = append(s.warnings, fmt.Sprintf("%d block states with no block id written as air", unknown))
+	}
+	setTag(L, root, 7, "Blocks", arrayValue(L, ids, findValue(L, root, "Blocks", 7)))
+	setTag(L, root, 7, "Data", arrayValue(L, data, findValue(L, root, "Data", 7)))
+	tileEntities := L.NewTable()
+	for _, b := range s.blocks {
+		if b.nbt != nil {
+			te := withoutTags(L, b.nbt, "x", "y", "z")
+			for k, name := range []string{"x", "y", "z"} {
+				te.Append(newTag(L, 3, name, lua.LNumber(b.pos[k])))
+			}
+			tileEntities.Append(te)
+		}
+	}
+	setTag(L, root, 9, "TileEntities", newList(L, 10, tileEntities))
+	entities := L.NewTable()
+	for _, e := range s.entities {
+		entity := L.NewTable()
+		if e.nbt != nil {
+			entity = withoutTags(L, e.nbt, "Pos")
+		}
+		entity.Append(newTag(L, 9, "Pos", numberList(L, 6, e.pos[0], e.pos[1], e.pos[2])))
+		entities.Append(entity)
+	}
+	setTag(L, root, 9, "Entities", newList(L, 10, entities))
+}
+
+// schematic(doc) reads an MCEdit .schematic or Sponge .schem document, its root tag or the root tag's value
+// into a structure object, followed by a warning if it has unknown blocks
+func newSchematicLua(L *lua.LState) int {
+	s, err := readSchematic(L, L.CheckTable(1))
+	if err != nil {
+		return pushError(L, "Error reading schematic", err)
+	}
+	return pushStructure(L, s) + pushWarnings(L, s.warnings)
+}
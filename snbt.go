@@ -0,0 +1,525 @@
+package nlua
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SNBT is the text form of NBT used in Java Edition commands, like {Count:1b,id:"minecraft:stone"}. It has no
+// root tag names, so they are lost converting to SNBT and empty converting from it. Each top-level tag is one
+// line.
+
+// Unquoted strings may only contain these characters
+var snbtUnquoted = regexp.MustCompile(`^[0-9A-Za-z_\-.+]+$`)
+
+// Number forms of unquoted values, as Java Edition reads them; anything else unquoted is a string
+var (
+	snbtInteger = regexp.MustCompile(`^([-+]?(?:0|[1-9][0-9]*))([bBsSlL]?)$`)
+	snbtFloat   = regexp.MustCompile(`^([-+]?(?:[0-9]+[.]?|[0-9]*[.][0-9]+)(?:[eE][-+]?[0-9]+)?)([fFdD])$`)
+	snbtDouble  = regexp.MustCompile(`^[-+]?(?:[0-9]+[.]|[0-9]*[.][0-9]+)(?:[eE][-+]?[0-9]+)?$`)
+)
+
+// Integer suffixes and the tag types they make, and array type letters, as in [I;1,2]
+var (
+	snbtIntegerTypes = map[string]byte{"": 3, "b": 1, "s": 2, "l": 4}
+	snbtArrayTypes   = map[byte]byte{'B': 7, 'I': 11, 'L': 12}
+	snbtArrayPrefix  = map[byte]string{7: "[B;", 11: "[I;", 12: "[L;"}
+	snbtArraySuffix  = map[byte]string{7: "b", 11: "", 12: "L"}
+)
+
+// Lua2Snbt converts lua's global nbt table variable to SNBT, one line per top-level tag
+func Lua2Snbt(L *lua.LState) ([]byte, error) {
+	doc, ok := L.GetGlobal("nbt").(*lua.LTable)
+	if !ok {
+		return nil, LuaNbtError{fmt.Sprintf("Global nbt type, expected %T, got %T", lua.LTable{}, L.GetGlobal("nbt")), nil}
+	}
+	if doc.RawGetString("trailing") != lua.LNil {
+		return nil, LuaNbtError{"trailing data can't be written as SNBT", nil}
+	}
+	w := &snbtWriter{L: L, c: newCodec(L)}
+	for i := 1; i <= doc.Len(); i++ {
+		tag, ok := doc.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		if err := w.value(tagValue(L, tag), tagType(tag)); err != nil {
+			return nil, err
+		}
+		w.b.WriteByte('\n')
+	}
+	return w.b.Bytes(), nil
+}
+
+type snbtWriter struct {
+	L *lua.LState
+	c *codec
+	b bytes.Buffer
+}
+
+// snbtString quotes s unless it can be written bare; bare strings that would read back as numbers or booleans
+// are quoted too
+func snbtString(s string, key bool) string {
+	if snbtUnquoted.MatchString(s) && (key || !snbtIsTyped(s)) {
+		return s
+	}
+	q := `"`
+	if strings.Contains(s, `"`) && !strings.Contains(s, "'") {
+		q = "'"
+	}
+	return q + strings.NewReplacer(`\`, `\\`, q, `\`+q).Replace(s) + q
+}
+
+func snbtIsTyped(s string) bool {
+	return s == "true" || s == "false" || snbtInteger.MatchString(s) || snbtFloat.MatchString(s) || snbtDouble.MatchString(s)
+}
+
+func (w *snbtWriter) number(v lua.LValue, t byte) (float64, error) {
+	n, ok := v.(lua.LNumber)
+	if !ok {
+		return 0, LuaNbtError{fmt.Sprintf("Tag %d value field '%v' not a number", t, v), nil}
+	}
+	f := float64(n)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, LuaNbtError{fmt.Sprintf("%v can't be written as SNBT", f), nil}
+	}
+	return f, nil
+}
+
+func (w *snbtWriter) integer(v lua.LValue, t byte, min, max float64, suffix string) error {
+	f, err := w.number(v, t)
+	if err != nil {
+		return err
+	}
+	if f != math.Trunc(f) || f < min || f > max {
+		return LuaNbtError{fmt.Sprintf("%v is not a valid tag %d value", f, t), nil}
+	}
+	w.b.WriteString(strconv.FormatInt(int64(f), 10) + suffix)
+	return nil
+}
+
+func (w *snbtWriter) value(v lua.LValue, t byte) error {
+	switch t {
+	case 1:
+		return w.integer(v, t, math.MinInt8, math.MaxInt8, "b")
+	case 2:
+		return w.integer(v, t, math.MinInt16, math.MaxInt16, "s")
+	case 3:
+		return w.integer(v, t, math.MinInt32, math.MaxInt32, "")
+	case 4:
+		n, err := (&typedArray{tagType: 12}).fromLua(v)
+		if err != nil {
+			return LuaNbtError{"Tag 4 Long value", err}
+		}
+		w.b.WriteString(strconv.FormatInt(n, 10) + "L")
+	case 5, 6:
+		f, err := w.number(v, t)
+		if err != nil {
+			return err
+		}
+		if t == 5 {
+			w.b.WriteString(strconv.FormatFloat(f, 'g', -1, 32) + "f")
+		} else {
+			w.b.WriteString(strconv.FormatFloat(f, 'g', -1, 64) + "d")
+		}
+	case 7, 11, 12:
+		a, err := arrayOf(v, t)
+		if err != nil {
+			return LuaNbtError{fmt.Sprintf("Tag %d array value", t), err}
+		}
+		w.b.WriteString(snbtArrayPrefix[t])
+		suffix := snbtArraySuffix[t]
+		for i := 0; i < a.len(); i++ {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			w.b.WriteString(strconv.FormatInt(a.get(i), 10) + suffix)
+		}
+		w.b.WriteByte(']')
+	case 8:
+		s, ok := v.(lua.LString)
+		if !ok {
+			return LuaNbtError{fmt.Sprintf("Tag 8 String value field '%v' not a string", v), nil}
+		}
+		w.b.WriteString(snbtString(string(s), false))
+	case 9:
+		list, ok := v.(*lua.LTable)
+		if !ok {
+			return LuaNbtError{fmt.Sprintf("Tag 9 List value field '%v' not a table", v), nil}
+		}
+		if err := w.c.enter(); err != nil {
+			return LuaNbtError{"Writing list tag", err}
+		}
+		defer w.c.leave()
+		listType, _ := list.RawGetString("tagListType").(lua.LNumber)
+		elements, _ := list.RawGetString("list").(*lua.LTable)
+		w.b.WriteByte('[')
+		for i := 1; elements != nil && i <= elements.Len(); i++ {
+			if i > 1 {
+				w.b.WriteByte(',')
+			}
+			if err := w.value(elements.RawGetInt(i), byte(listType)); err != nil {
+				return err
+			}
+		}
+		w.b.WriteByte(']')
+	case 10:
+		compound, ok := v.(*lua.LTable)
+		if !ok {
+			return LuaNbtError{fmt.Sprintf("Tag 10 Compound value field '%v' not a table", v), nil}
+		}
+		if err := w.c.enter(); err != nil {
+			return LuaNbtError{"Writing compound tag", err}
+		}
+		defer w.c.leave()
+		w.b.WriteByte('{')
+		first := true
+		for i := 1; i <= compound.Len(); i++ {
+			tag, ok := compound.RawGetInt(i).(*lua.LTable)
+			if !ok || tagType(tag) == 0 {
+				continue
+			}
+			if !first {
+				w.b.WriteByte(',')
+			}
+			first = false
+			w.b.WriteString(snbtString(lua.LVAsString(tag.RawGetString("name")), true) + ":")
+			if err := w.value(tagValue(w.L, tag), tagType(tag)); err != nil {
+				return err
+			}
+		}
+		w.b.WriteByte('}')
+	default:
+		return LuaNbtError{fmt.Sprintf("TagType %d not recognized", t), nil}
+	}
+	return nil
+}
+
+// Snbt2Lua converts SNBT, one or more top-level values separated by white space, to the global `nbt` variable
+// of a github.com/yuin/gopher-lua LState. Each value becomes a top-level tag with an empty name.
+func Snbt2Lua(b []byte, L *lua.LState) error {
+	p := &snbtParser{L: L, c: newCodec(L), s: string(b)}
+	doc := L.NewTable()
+	for p.skipSpace(); p.i < len(p.s); p.skipSpace() {
+		t, v, err := p.value()
+		if err != nil {
+			return err
+		}
+		doc.Append(newTag(L, t, "", v))
+	}
+	L.SetGlobal("nbt", doc)
+	return nil
+}
+
+type snbtParser struct {
+	L *lua.LState
+	c *codec
+	s string
+	i int
+}
+
+func (p *snbtParser) errorf(format string, a ...interface{}) error {
+	return NbtParseError{fmt.Sprintf("SNBT at offset %d", p.i), fmt.Errorf(format, a...)}
+}
+
+func (p *snbtParser) skipSpace() {
+	for p.i < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+// peek skips white space and returns the next character, or 0 at the end
+func (p *snbtParser) peek() byte {
+	p.skipSpace()
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+	return 0
+}
+
+func (p *snbtParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected '%c'", c)
+	}
+	p.i++
+	return nil
+}
+
+// str reads a quoted or unquoted string and reports whether it was quoted
+func (p *snbtParser) str() (string, bool, error) {
+	q := p.peek()
+	if q != '"' && q != '\'' {
+		start := p.i
+		for p.i < len(p.s) && snbtUnquoted.MatchString(p.s[p.i:p.i+1]) {
+			p.i++
+		}
+		if p.i == start {
+			return "", false, p.errorf("expected a value")
+		}
+		return p.s[start:p.i], false, nil
+	}
+	var b strings.Builder
+	for p.i++; p.i < len(p.s); p.i++ {
+		switch c := p.s[p.i]; {
+		case c == q:
+			p.i++
+			return b.String(), true, nil
+		case c == '\\' && p.i+1 < len(p.s):
+			p.i++
+			switch e := p.s[p.i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'u':
+				// exactly four hex digits, as in Java
+				if p.i+4 >= len(p.s) {
+					return "", true, p.errorf("\\u needs four hex digits")
+				}
+				r, err := strconv.ParseUint(p.s[p.i+1:p.i+5], 16, 16)
+				if err != nil {
+					return "", true, p.errorf("\\u needs four hex digits")
+				}
+				b.WriteRune(rune(r))
+				p.i += 4
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", true, p.errorf("unterminated string")
+}
+
+func (p *snbtParser) value() (byte, lua.LValue, error) {
+	switch p.peek() {
+	case '{':
+		return p.compound()
+	case '[':
+		return p.list()
+	}
+	s, quoted, err := p.str()
+	if err != nil || quoted {
+		return 8, lua.LString(s), err
+	}
+	return p.scalar(s)
+}
+
+// scalar reads an unquoted value as a number, boolean byte or string
+func (p *snbtParser) scalar(s string) (byte, lua.LValue, error) {
+	if m := snbtInteger.FindStringSubmatch(s); m != nil {
+		t := snbtIntegerTypes[strings.ToLower(m[2])]
+		n, err := strconv.ParseInt(m[1], 10, integerBits(t))
+		if err != nil {
+			return 0, nil, p.errorf("%s is out of range", s)
+		}
+		if t == 4 {
+			return 4, (&typedArray{tagType: 12}).toLua(p.L, n), nil
+		}
+		return t, lua.LNumber(n), nil
+	}
+	if m := snbtFloat.FindStringSubmatch(s); m != nil {
+		if strings.ToLower(m[2]) == "f" {
+			f, err := parseFloat(m[1], 5)
+			if err != nil {
+				return 0, nil, p.errorf("%s: %v", s, err)
+			}
+			return 5, lua.LNumber(f), nil
+		}
+		s = m[1]
+	} else if !snbtDouble.MatchString(s) {
+		switch s {
+		case "true":
+			return 1, lua.LNumber(1), nil
+		case "false":
+			return 1, lua.LNumber(0), nil
+		}
+		return 8, lua.LString(s), nil
+	}
+	f, err := parseFloat(s, 6)
+	if err != nil {
+		return 0, nil, p.errorf("%s: %v", s, err)
+	}
+	return 6, lua.LNumber(f), nil
+}
+
+// parseFloat reads a number for a float (5) or double (6) tag, which must be finite and, unless it is zero, not so
+// small it rounds to zero
+func parseFloat(s string, t byte) (float64, error) {
+	bits := 64
+	if t == 5 {
+		bits = 32
+	}
+	f, err := strconv.ParseFloat(s, bits)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("not a finite number in range for a tag %d", t)
+	}
+	mantissa := strings.IndexAny(s, "eE")
+	if mantissa < 0 {
+		mantissa = len(s)
+	}
+	if f == 0 && strings.ContainsAny(s[:mantissa], "123456789") {
+		return 0, fmt.Errorf("too small for a tag %d", t)
+	}
+	return f, nil
+}
+
+func (p *snbtParser) compound() (byte, lua.LValue, error) {
+	if err := p.c.enter(); err != nil {
+		return 0, nil, p.errorf("%v", err)
+	}
+	defer p.c.leave()
+	p.i++
+	compound := p.L.NewTable()
+	for p.peek() != '}' {
+		if compound.Len() > 0 {
+			if err := p.expect(','); err != nil {
+				return 0, nil, err
+			}
+		}
+		name, _, err := p.str()
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := p.expect(':'); err != nil {
+			return 0, nil, err
+		}
+		t, v, err := p.value()
+		if err != nil {
+			return 0, nil, err
+		}
+		compound.Append(newTag(p.L, t, name, v))
+	}
+	p.i++
+	return 10, compound, nil
+}
+
+func (p *snbtParser) list() (byte, lua.LValue, error) {
+	if err := p.c.enter(); err != nil {
+		return 0, nil, p.errorf("%v", err)
+	}
+	defer p.c.leave()
+	p.i++
+	if p.i+1 < len(p.s) && p.s[p.i+1] == ';' {
+		if t, ok := snbtArrayTypes[p.s[p.i]]; ok {
+			p.i += 2
+			return p.array(t)
+		}
+	}
+	var listType byte
+	elements := p.L.NewTable()
+	for p.peek() != ']' {
+		if elements.Len() > 0 {
+			if err := p.expect(','); err != nil {
+				return 0, nil, err
+			}
+		}
+		t, v, err := p.value()
+		if err != nil {
+			return 0, nil, err
+		}
+		if elements.Len() > 0 && t != listType {
+			return 0, nil, p.errorf("list of tag %d can't hold tag %d", listType, t)
+		}
+		listType = t
+		elements.Append(v)
+	}
+	p.i++
+	return 9, newList(p.L, listType, elements), nil
+}
+
+func (p *snbtParser) array(t byte) (byte, lua.LValue, error) {
+	a, _ := newTypedArray(t, 0)
+	for p.peek() != ']' {
+		if a.len() > 0 {
+			if err := p.expect(','); err != nil {
+				return 0, nil, err
+			}
+		}
+		s, quoted, err := p.str()
+		if err != nil {
+			return 0, nil, err
+		}
+		et, v, err := p.scalar(s)
+		if err != nil {
+			return 0, nil, err
+		}
+		if quoted || et != arrayElementType(t) {
+			return 0, nil, p.errorf("'%s' is not a valid element of a tag %d array", s, t)
+		}
+		n, _ := a.fromLua(v)
+		a.set(a.len(), n)
+	}
+	p.i++
+	return t, arrayValue(p.L, a, lua.LNil), nil
+}
+
+// Longest FormatValue result before it is cut short
+const maxFormatLength = 4000
+
+// FormatValue describes a lua value for display, as the nbtlua REPL prints expression results: tags as their name,
+// type and SNBT value, tag values and documents as SNBT, and anything else as tostring does. A tag or value that
+// can't be written as SNBT is shown as tostring does, followed by why.
+func FormatValue(L *lua.LState, v lua.LValue) string {
+	w := &snbtWriter{L: L, c: newCodec(L)}
+	var err error
+	prefix := ""
+	switch t := v.(type) {
+	case *lua.LUserData:
+		if a := typedArrayOf(t); a != nil {
+			err = w.value(t, a.tagType)
+		} else {
+			return L.ToStringMeta(v).String()
+		}
+	case *lua.LTable:
+		switch {
+		case t.RawGetString("tagType") != lua.LNil:
+			prefix = fmt.Sprintf("%s (%s): ", snbtString(lua.LVAsString(t.RawGetString("name")), true),
+				tagTypeName(tagType(t)))
+			err = w.value(tagValue(L, t), tagType(t))
+		case t.RawGetString("tagListType") != lua.LNil:
+			err = w.value(t, 9)
+		case isTagTable(t):
+			err = w.value(t, 10)
+		default:
+			return L.ToStringMeta(v).String()
+		}
+	case lua.LString:
+		return fmt.Sprintf("%q", string(t))
+	default:
+		return L.ToStringMeta(v).String()
+	}
+	if err != nil {
+		// not valid as a tag, such as an array with an element out of range for it
+		return fmt.Sprintf("%s (%v)", L.ToStringMeta(v).String(), err)
+	}
+	s := prefix + w.b.String()
+	if len(s) > maxFormatLength {
+		// cut at the start of a rune, not in the middle of one
+		n := maxFormatLength
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n] + fmt.Sprintf("... (%d more bytes)", len(s)-n)
+	}
+	return s
+}
+
+// isTagTable reports whether t is a non-empty compound value or document: a sequence of tag tables
+func isTagTable(t *lua.LTable) bool {
+	for i := 1; i <= t.Len(); i++ {
+		if tag, ok := t.RawGetInt(i).(*lua.LTable); !ok || tag.RawGetString("tagType") == lua.LNil {
+			return false
+		}
+	}
+	return t.Len() > 0
+}
@@ -0,0 +1,100 @@
+package nlua
+
+import (
+	"bytes"
+	"testing"
+)
+
+const textDoc = `
+	nbt = { { tagType = 10, name = "", value = {
+		{ tagType = 1, name = "Count", value = 1 },
+		{ tagType = 4, name = "Time", value = { least = 5, most = 1 } },
+		{ tagType = 5, name = "f", value = 0.5 },
+		{ tagType = 8, name = "id", value = "minecraft:stone" },
+		{ tagType = 8, name = "quoted", value = "say \"1b\"" },
+		{ tagType = 9, name = "Pos", value = { tagListType = 6, list = { 1.5, -2, 3 } } },
+		{ tagType = 9, name = "none", value = { tagListType = 0, list = {} } },
+		{ tagType = 10, name = "display name", value = { { tagType = 3, name = "n", value = -7 } } },
+		{ tagType = 7, name = "bytes", value = { 1, -1 } },
+		{ tagType = 12, name = "longs", value = { { least = 1, most = 0 } } },
+	} } }`
+
+func TestSnbt(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(textDoc); err != nil {
+		t.Fatal(err)
+	}
+	want, err := Lua2Nbt(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snbt, err := Lua2Snbt(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expected = `{Count:1b,Time:4294967301L,f:0.5f,id:"minecraft:stone",quoted:'say "1b"',Pos:[1.5d,-2d,3d],none:[],` +
+		`"display name":{n:-7},bytes:[B;1b,-1b],longs:[L;1L]}` + "\n"
+	if string(snbt) != expected {
+		t.Fatalf("expected %s, got %s", expected, snbt)
+	}
+	if err := Snbt2Lua(snbt, L); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("SNBT round trip changed the NBT: %v", err)
+	}
+
+	err = Snbt2Lua([]byte(`{a: true, b: 1.0, c: 2e3f, d: 3s, e: stone, f: [I; 1, 2]} [1, 2]`), L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = L.DoString(`
+		local c = nbt[1].value
+		assert(#nbt == 2 and nbt[2].tagType == 9 and nbt[2].value.tagListType == 3)
+		assert(c[1].tagType == 1 and c[1].value == 1)
+		assert(c[2].tagType == 6 and c[3].tagType == 5 and c[3].value == 2000)
+		assert(c[4].tagType == 2 and c[5].tagType == 8 and c[5].value == "stone")
+		assert(c[6].tagType == 11 and #c[6].value == 2)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{`{a:1,}`, `[1, 2b]`, `{a:"open}`, `[B;1,2]`, `{a:300b}`, `{a:"\u12"}`, `{a:"\u12g4"}`,
+		`{a:1e999d}`, `{a:1e39f}`, `{a:1e-50f}`} {
+		if err := Snbt2Lua([]byte(bad), L); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+	if err := Snbt2Lua([]byte(`{a:"\u00e9\u0041"}`), L); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(nbt[1].value[1].value == "\195\169A")`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJson(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(textDoc); err != nil {
+		t.Fatal(err)
+	}
+	want, err := Lua2Nbt(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := Lua2Json(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Json2Lua(j, L); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Lua2Nbt(L); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("JSON round trip changed the NBT: %v", err)
+	}
+	if err := Json2Lua([]byte(`[{"tagType": 7, "name": "", "value": [1000]}]`), L); err == nil {
+		t.Error("out of range byte accepted")
+	}
+}
@@ -0,0 +1,735 @@
+package nlua
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const structureTypeName = "structure"
+
+// Data version written to new structures, 1.20.1
+const defaultDataVersion = 3465
+
+// structure is a grid of blocks with a palette, block entities and entities, as in a Java Edition structure
+// file (the .nbt files saved by structure blocks)
+type structure struct {
+	// doc is the document the structure was read from, or nil for a new one; writing it back replaces its
+	// structure tags
+	doc *lua.LTable
+	// format is the kind of file doc is: "structure", "schem" or "schematic" (see schematic.go), or
+	// "mcstructure" (see mcstructure.go)
+	format      string
+	version     int
+	dataVersion int
+	offset      [3]int
+	size        [3]int
+	// most structures have one palette; shipwrecks and the like have several variants of the same length
+	palettes [][]blockState
+	blocks   []structureBlock
+	entities []structureEntity
+	// at maps a position to its index in blocks
+	at map[[3]int]int
+	// layer2 holds the palette indices of Bedrock Edition's second block layer, usually water in waterlogged
+	// blocks, by position
+	layer2 map[[3]int]int
+	// blockVersion is the version of Bedrock Edition block states
+	blockVersion int
+	// warnings says what the last read or write couldn't convert, such as unknown block ids read as air
+	warnings []string
+}
+
+type structureBlock struct {
+	pos [3]int
+	// state is a palette index, or -1 once the block is removed
+	state int
+	// nbt is the block entity compound value, or nil
+	nbt *lua.LTable
+}
+
+type structureEntity struct {
+	pos      [3]float64
+	blockPos [3]int
+	nbt      *lua.LTable
+}
+
+// newStructure returns an empty structure of the given size
+func newStructure(size [3]int) *structure {
+	return &structure{
+		format:      "structure",
+		dataVersion: defaultDataVersion,
+		size:        size,
+		palettes:    [][]blockState{nil},
+		at:          map[[3]int]int{},
+		layer2:      map[[3]int]int{},
+	}
+}
+
+// numbersOf returns the elements of a list of numbers
+func numbersOf(list *lua.LTable) []float64 {
+	var n []float64
+	if list != nil {
+		for i := 1; i <= list.Len(); i++ {
+			v, _ := list.RawGetInt(i).(lua.LNumber)
+			n = append(n, float64(v))
+		}
+	}
+	return n
+}
+
+// intTriple reads a list of three numbers such as a size or position
+func intTriple(L *lua.LState, compound *lua.LTable, name string) ([3]int, bool) {
+	list, _ := findList(L, compound, name)
+	n := numbersOf(list)
+	if len(n) != 3 {
+		return [3]int{}, false
+	}
+	return [3]int{int(n[0]), int(n[1]), int(n[2])}, true
+}
+
+// numberList returns a list tag value of numbers of type t
+func numberList(L *lua.LState, t byte, numbers ...float64) *lua.LTable {
+	elements := L.CreateTable(len(numbers), 0)
+	for _, n := range numbers {
+		elements.Append(lua.LNumber(n))
+	}
+	return newList(L, t, elements)
+}
+
+// readStructure reads a Java Edition structure document, its root tag or the root tag's value
+func readStructure(L *lua.LState, doc *lua.LTable) (*structure, error) {
+	root := rootCompound(L, doc)
+	s := newStructure([3]int{})
+	s.doc, s.palettes = doc, nil
+	if v, ok := findValue(L, root, "DataVersion", 3).(lua.LNumber); ok {
+		s.dataVersion = int(v)
+	}
+	var ok bool
+	if s.size, ok = intTriple(L, root, "size"); !ok {
+		return nil, fmt.Errorf("no size list of 3 ints; not a structure")
+	}
+	readPalette := func(list *lua.LTable) []blockState {
+		var palette []blockState
+		for i := 1; list != nil && i <= list.Len(); i++ {
+			entry, _ := list.RawGetInt(i).(*lua.LTable)
+			if entry == nil {
+				entry = L.NewTable()
+			}
+			palette = append(palette, javaBlockState(L, entry))
+		}
+		return palette
+	}
+	if palette, _ := findList(L, root, "palette"); palette != nil {
+		s.palettes = [][]blockState{readPalette(palette)}
+	} else if palettes, _ := findList(L, root, "palettes"); palettes != nil {
+		for i := 1; i <= palettes.Len(); i++ {
+			p, _ := palettes.RawGetInt(i).(*lua.LTable)
+			var list *lua.LTable
+			if p != nil {
+				list, _ = p.RawGetString("list").(*lua.LTable)
+			}
+			s.palettes = append(s.palettes, readPalette(list))
+		}
+	}
+	if len(s.palettes) == 0 {
+		return nil, fmt.Errorf("no palette or palettes list; not a structure")
+	}
+	for _, p := range s.palettes[1:] {
+		if len(p) != len(s.palettes[0]) {
+			return nil, fmt.Errorf("palettes differ in length")
+		}
+	}
+	blocks, _ := findList(L, root, "blocks")
+	for i := 1; blocks != nil && i <= blocks.Len(); i++ {
+		block, ok := blocks.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		pos, ok := intTriple(L, block, "pos")
+		state, isNumber := findValue(L, block, "state", 3).(lua.LNumber)
+		if !ok || !isNumber || int(state) < 0 || int(state) >= len(s.palettes[0]) {
+			return nil, fmt.Errorf("block %d has no pos or a bad state", i)
+		}
+		s.put(pos, int(state), findCompound(L, block, "nbt"))
+	}
+	entities, _ := findList(L, root, "entities")
+	for i := 1; entities != nil && i <= entities.Len(); i++ {
+		entity, ok := entities.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		var e structureEntity
+		list, _ := findList(L, entity, "pos")
+		if pos := numbersOf(list); len(pos) == 3 {
+			copy(e.pos[:], pos)
+		}
+		e.blockPos, _ = intTriple(L, entity, "blockPos")
+		e.nbt = findCompound(L, entity, "nbt")
+		s.entities = append(s.entities, e)
+	}
+	return s, nil
+}
+
+// put sets the block at pos to palette index state, replacing any block already there
+func (s *structure) put(pos [3]int, state int, nbt *lua.LTable) {
+	if i, ok := s.at[pos]; ok {
+		s.blocks[i].state = state
+		s.blocks[i].nbt = nbt
+		return
+	}
+	s.at[pos] = len(s.blocks)
+	s.blocks = append(s.blocks, structureBlock{pos, state, nbt})
+}
+
+// get returns the block at pos, or nil for none (structure void) or outside the structure
+func (s *structure) get(pos [3]int) *structureBlock {
+	if i, ok := s.at[pos]; ok && s.blocks[i].state >= 0 {
+		return &s.blocks[i]
+	}
+	return nil
+}
+
+func (s *structure) inside(pos [3]int) bool {
+	for i := range pos {
+		if pos[i] < 0 || pos[i] >= s.size[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stateIndex returns the palette index of b, adding it to every palette if needed
+func (s *structure) stateIndex(b blockState) int {
+	want := b.String()
+	for i := range s.palettes[0] {
+		same := true
+		for _, p := range s.palettes {
+			same = same && p[i].String() == want
+		}
+		if same {
+			return i
+		}
+	}
+	for k := range s.palettes {
+		s.palettes[k] = append(s.palettes[k], b)
+	}
+	return len(s.palettes[0]) - 1
+}
+
+// addEntity adds an entity at an exact position
+func (s *structure) addEntity(pos [3]float64, nbt *lua.LTable) {
+	e := structureEntity{pos: pos, nbt: nbt}
+	for i := range pos {
+		e.blockPos[i] = int(math.Floor(pos[i]))
+	}
+	s.entities = append(s.entities, e)
+}
+
+func (s *structure) remove(pos [3]int) bool {
+	if b := s.get(pos); b != nil {
+		b.state = -1
+		b.nbt = nil
+		return true
+	}
+	return false
+}
+
+// transform moves every block and entity with the position functions and changes each palette entry with the
+// state function; size is the new size
+func (s *structure) transform(size [3]int, blockPos func([3]int) [3]int, pos func([3]float64) [3]float64,
+	state func(blockState) blockState, yaw func(float64) float64, L *lua.LState) {
+	for k := range s.palettes {
+		for i := range s.palettes[k] {
+			s.palettes[k][i] = state(s.palettes[k][i])
+		}
+	}
+	s.at = map[[3]int]int{}
+	for i := range s.blocks {
+		s.blocks[i].pos = blockPos(s.blocks[i].pos)
+		if s.blocks[i].state >= 0 {
+			s.at[s.blocks[i].pos] = i
+		}
+	}
+	layer2 := map[[3]int]int{}
+	for p, state := range s.layer2 {
+		layer2[blockPos(p)] = state
+	}
+	s.layer2 = layer2
+	for i := range s.entities {
+		e := &s.entities[i]
+		e.pos = pos(e.pos)
+		e.blockPos = blockPos(e.blockPos)
+		if e.nbt == nil {
+			continue
+		}
+		// the entity's facing is its yaw, the first element of its Rotation list of floats
+		if rotation, t := findList(L, e.nbt, "Rotation"); rotation != nil && t == 5 {
+			if r, ok := rotation.RawGetInt(1).(lua.LNumber); ok {
+				rotation.RawSetInt(1, lua.LNumber(math.Mod(yaw(float64(r))+360, 360)))
+			}
+		}
+	}
+	s.size = size
+}
+
+// rotate turns the structure clockwise, seen from above, by turns quarter turns
+func (s *structure) rotate(L *lua.LState, turns int) {
+	for turns &= 3; turns > 0; turns-- {
+		sz := s.size[2]
+		s.transform([3]int{s.size[2], s.size[1], s.size[0]},
+			func(p [3]int) [3]int { return [3]int{sz - 1 - p[2], p[1], p[0]} },
+			func(p [3]float64) [3]float64 { return [3]float64{float64(sz) - p[2], p[1], p[0]} },
+			func(b blockState) blockState { return b.rotated(1) },
+			func(yaw float64) float64 { return yaw + 90 }, L)
+	}
+}
+
+// mirror flips the structure across axis "x" (east and west swap) or "z" (north and south swap)
+func (s *structure) mirror(L *lua.LState, axis string) {
+	k, yaw := 0, func(yaw float64) float64 { return -yaw }
+	if axis == "z" {
+		k, yaw = 2, func(yaw float64) float64 { return 180 - yaw }
+	}
+	n := s.size[k]
+	s.transform(s.size,
+		func(p [3]int) [3]int { p[k] = n - 1 - p[k]; return p },
+		func(p [3]float64) [3]float64 { p[k] = float64(n) - p[k]; return p },
+		func(b blockState) blockState { return b.mirrored(axis) }, yaw, L)
+}
+
+// translate moves every block and entity by d, growing the size to fit; it fails if anything would end up at
+// a negative position
+func (s *structure) translate(L *lua.LState, d [3]int) error {
+	size := s.size
+	check := func(p [3]int) error {
+		for i := range p {
+			if p[i]+d[i] < 0 {
+				return fmt.Errorf("translating %v by %v leaves the structure", p, d)
+			}
+			if p[i]+d[i] >= size[i] {
+				size[i] = p[i] + d[i] + 1
+			}
+		}
+		return nil
+	}
+	for _, b := range s.blocks {
+		if b.state < 0 {
+			continue
+		}
+		if err := check(b.pos); err != nil {
+			return err
+		}
+	}
+	for p := range s.layer2 {
+		if err := check(p); err != nil {
+			return err
+		}
+	}
+	for _, e := range s.entities {
+		if err := check(e.blockPos); err != nil {
+			return err
+		}
+	}
+	s.transform(size,
+		func(p [3]int) [3]int { return [3]int{p[0] + d[0], p[1] + d[1], p[2] + d[2]} },
+		func(p [3]float64) [3]float64 {
+			return [3]float64{p[0] + float64(d[0]), p[1] + float64(d[1]), p[2] + float64(d[2])}
+		},
+		func(b blockState) blockState { return b },
+		func(yaw float64) float64 { return yaw }, L)
+	return nil
+}
+
+// compact drops removed blocks and unused palette entries, renumbering the rest
+func (s *structure) compact() {
+	used := make([]bool, len(s.palettes[0]))
+	blocks := s.blocks[:0]
+	for _, b := range s.blocks {
+		if b.state >= 0 {
+			used[b.state] = true
+			blocks = append(blocks, b)
+		}
+	}
+	s.blocks = blocks
+	for _, state := range s.layer2 {
+		used[state] = true
+	}
+	renumber := make([]int, len(used))
+	n := 0
+	for i, u := range used {
+		renumber[i] = n
+		if u {
+			for k := range s.palettes {
+				s.palettes[k][n] = s.palettes[k][i]
+			}
+			n++
+		}
+	}
+	for k := range s.palettes {
+		s.palettes[k] = s.palettes[k][:n]
+	}
+	s.at = map[[3]int]int{}
+	for i := range s.blocks {
+		s.blocks[i].state = renumber[s.blocks[i].state]
+		s.at[s.blocks[i].pos] = i
+	}
+	for p, state := range s.layer2 {
+		s.layer2[p] = renumber[state]
+	}
+}
+
+// write stores s as format in the document it was read from if that has the same format and version (0 for
+// any), and in a new document otherwise, and returns the document
+func (s *structure) write(L *lua.LState, format string, version int) (*lua.LTable, error) {
+	if format == "" {
+		format = s.format
+	}
+	var doc *lua.LTable
+	if format == s.format && (version == 0 || version == s.version) {
+		doc, version = s.doc, s.version
+	}
+	newDoc := func(name string) *lua.LTable {
+		if doc == nil {
+			doc = L.NewTable()
+			doc.Append(newTag(L, 10, name, L.NewTable()))
+			if format == s.format && s.doc == nil {
+				s.doc = doc
+			}
+		}
+		return rootCompound(L, doc)
+	}
+	s.compact()
+	s.warnings = nil
+	t := s.forFormat(format)
+	switch format {
+	case "structure":
+		t.writeStructure(L, newDoc(""))
+	case "mcstructure":
+		t.writeMcstructure(L, newDoc(""))
+	case "schem":
+		if version == 0 {
+			version = 3
+		}
+		if version < 1 || version > 3 {
+			return nil, fmt.Errorf("no Sponge schematic version %d", version)
+		}
+		var root *lua.LTable
+		if version < 3 {
+			root = schematicRoot(L, newDoc("Schematic"))
+		} else if root = findCompound(L, newDoc(""), "Schematic"); root == nil {
+			root = L.NewTable()
+			rootCompound(L, doc).Append(newTag(L, 10, "Schematic", root))
+		}
+		t.writeSchem(L, root, version)
+	case "schematic":
+		t.writeSchematic(L, schematicRoot(L, newDoc("Schematic")))
+	default:
+		return nil, fmt.Errorf("unknown format '%s'; expected structure, schem, schematic or mcstructure", format)
+	}
+	if t != s {
+		s.warnings = t.warnings
+	}
+	return doc, nil
+}
+
+// writeStructure stores s as Java Edition structure tags in root, a compound value, keeping root's other tags
+func (s *structure) writeStructure(L *lua.LState, root *lua.LTable) {
+	if findTag(root, "DataVersion") == nil {
+		root.Append(newTag(L, 3, "DataVersion", lua.LNumber(s.dataVersion)))
+	}
+	setTag(L, root, 9, "size", numberList(L, 3, float64(s.size[0]), float64(s.size[1]), float64(s.size[2])))
+	paletteList := func(palette []blockState) *lua.LTable {
+		entries := L.CreateTable(len(palette), 0)
+		for _, b := range palette {
+			entries.Append(b.javaCompound(L))
+		}
+		return newList(L, 10, entries)
+	}
+	if len(s.palettes) == 1 {
+		removeTag(root, "palettes")
+		setTag(L, root, 9, "palette", paletteList(s.palettes[0]))
+	} else {
+		removeTag(root, "palette")
+		palettes := L.CreateTable(len(s.palettes), 0)
+		for _, p := range s.palettes {
+			palettes.Append(paletteList(p))
+		}
+		setTag(L, root, 9, "palettes", newList(L, 9, palettes))
+	}
+	blocks := L.CreateTable(len(s.blocks), 0)
+	for _, b := range s.blocks {
+		block := L.NewTable()
+		block.Append(newTag(L, 9, "pos", numberList(L, 3, float64(b.pos[0]), float64(b.pos[1]), float64(b.pos[2]))))
+		block.Append(newTag(L, 3, "state", lua.LNumber(b.state)))
+		if b.nbt != nil {
+			block.Append(newTag(L, 10, "nbt", b.nbt))
+		}
+		blocks.Append(block)
+	}
+	setTag(L, root, 9, "blocks", newList(L, 10, blocks))
+	entities := L.CreateTable(len(s.entities), 0)
+	for _, e := range s.entities {
+		entity := L.NewTable()
+		entity.Append(newTag(L, 9, "pos", numberList(L, 6, e.pos[0], e.pos[1], e.pos[2])))
+		entity.Append(newTag(L, 9, "blockPos", numberList(L, 3, float64(e.blockPos[0]), float64(e.blockPos[1]), float64(e.blockPos[2]))))
+		if e.nbt != nil {
+			entity.Append(newTag(L, 10, "nbt", e.nbt))
+		} else {
+			entity.Append(newTag(L, 10, "nbt", L.NewTable()))
+		}
+		entities.Append(entity)
+	}
+	setTag(L, root, 9, "entities", newList(L, 10, entities))
+}
+
+func structureMetatable(L *lua.LState) *lua.LTable {
+	if mt, ok := L.GetTypeMetatable(structureTypeName).(*lua.LTable); ok {
+		return mt
+	}
+	mt := L.NewTypeMetatable(structureTypeName)
+	mt.RawSetString("__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"size":          structureSize,
+		"get":           structureGet,
+		"set":           structureSet,
+		"remove":        structureRemove,
+		"blocks":        structureBlocks,
+		"entities":      structureEntities,
+		"add_entity":    structureAddEntity,
+		"remove_entity": structureRemoveEntity,
+		"rotate":        structureRotate,
+		"mirror":        structureMirror,
+		"translate":     structureTranslate,
+		"write":         structureWrite,
+	}))
+	return mt
+}
+
+func pushStructure(L *lua.LState, s *structure) int {
+	ud := L.NewUserData()
+	ud.Value = s
+	ud.Metatable = structureMetatable(L)
+	L.Push(ud)
+	return 1
+}
+
+// pushWarnings pushes warnings joined into one string and returns 1, or returns 0 if there are none
+func pushWarnings(L *lua.LState, warnings []string) int {
+	if len(warnings) == 0 {
+		return 0
+	}
+	L.Push(lua.LString(strings.Join(warnings, "; ")))
+	return 1
+}
+
+func checkStructure(L *lua.LState) *structure {
+	if ud, ok := L.Get(1).(*lua.LUserData); ok {
+		if s, ok := ud.Value.(*structure); ok {
+			return s
+		}
+	}
+	L.ArgError(1, structureTypeName+" expected")
+	return nil
+}
+
+// checkPos reads x, y, z from stack position n on
+func checkPos(L *lua.LState, n int) [3]int {
+	return [3]int{L.CheckInt(n), L.CheckInt(n + 1), L.CheckInt(n + 2)}
+}
+
+// structure(doc) reads a Java structure document, its root tag or the root tag's value into a structure
+// object; structure(x, y, z) makes an empty one of that size
+func newStructureLua(L *lua.LState) int {
+	if L.Get(1).Type() == lua.LTNumber {
+		return pushStructure(L, newStructure(checkPos(L, 1)))
+	}
+	s, err := readStructure(L, L.CheckTable(1))
+	if err != nil {
+		return pushError(L, "Error reading structure", err)
+	}
+	return pushStructure(L, s)
+}
+
+// s:size() returns the x, y and z size
+func structureSize(L *lua.LState) int {
+	s := checkStructure(L)
+	for _, n := range s.size {
+		L.Push(lua.LNumber(n))
+	}
+	return 3
+}
+
+// checkLayer reads an optional block layer, 1 (the default) or 2
+func checkLayer(L *lua.LState, n int) int {
+	layer := L.OptInt(n, 1)
+	if layer != 1 && layer != 2 {
+		L.ArgError(n, "layer 1 or 2 expected")
+	}
+	return layer
+}
+
+// s:get(x, y, z, layer) returns the block state string and block entity compound value of a block, or nil where
+// there is no block; layer 2 is Bedrock Edition's second layer
+func structureGet(L *lua.LState) int {
+	s := checkStructure(L)
+	pos := checkPos(L, 2)
+	if checkLayer(L, 5) == 2 {
+		if state, ok := s.layer2[pos]; ok {
+			L.Push(lua.LString(s.palettes[0][state].String()))
+			return 1
+		}
+		return 0
+	}
+	b := s.get(pos)
+	if b == nil {
+		return 0
+	}
+	L.Push(lua.LString(s.palettes[0][b.state].String()))
+	if b.nbt == nil {
+		return 1
+	}
+	L.Push(b.nbt)
+	return 2
+}
+
+// s:set(x, y, z, state, nbt, layer) sets a block to a block state string, with an optional block entity compound
+// value; layer 2 is Bedrock Edition's second layer, which has no block entities
+func structureSet(L *lua.LState) int {
+	s := checkStructure(L)
+	pos := checkPos(L, 2)
+	if !s.inside(pos) {
+		L.ArgError(2, fmt.Sprintf("%v is outside the structure's size %v", pos, s.size))
+	}
+	b, err := parseBlockState(L.CheckString(5))
+	if err != nil {
+		L.ArgError(5, err.Error())
+	}
+	var nbt *lua.LTable
+	if L.Get(6) != lua.LNil {
+		nbt = L.CheckTable(6)
+	}
+	if checkLayer(L, 7) == 2 {
+		s.layer2[pos] = s.stateIndex(b)
+		return 0
+	}
+	s.put(pos, s.stateIndex(b), nbt)
+	return 0
+}
+
+// s:remove(x, y, z, layer) removes a block, leaving structure void; returns true if there was a block
+func structureRemove(L *lua.LState) int {
+	s := checkStructure(L)
+	pos := checkPos(L, 2)
+	if checkLayer(L, 5) == 2 {
+		_, ok := s.layer2[pos]
+		delete(s.layer2, pos)
+		L.Push(lua.LBool(ok))
+		return 1
+	}
+	L.Push(lua.LBool(s.remove(pos)))
+	return 1
+}
+
+// s:blocks() returns a table of every block as {x, y, z, state, nbt, layer2} tables
+func structureBlocks(L *lua.LState) int {
+	s := checkStructure(L)
+	t := L.CreateTable(len(s.blocks), 0)
+	for _, b := range s.blocks {
+		if b.state < 0 {
+			continue
+		}
+		block := L.CreateTable(0, 5)
+		block.RawSetString("x", lua.LNumber(b.pos[0]))
+		block.RawSetString("y", lua.LNumber(b.pos[1]))
+		block.RawSetString("z", lua.LNumber(b.pos[2]))
+		block.RawSetString("state", lua.LString(s.palettes[0][b.state].String()))
+		if b.nbt != nil {
+			block.RawSetString("nbt", b.nbt)
+		}
+		if state, ok := s.layer2[b.pos]; ok {
+			block.RawSetString("layer2", lua.LString(s.palettes[0][state].String()))
+		}
+		t.Append(block)
+	}
+	L.Push(t)
+	return 1
+}
+
+// s:entities() returns a table of every entity as {x, y, z, nbt} tables, x, y and z being its exact position
+func structureEntities(L *lua.LState) int {
+	s := checkStructure(L)
+	t := L.CreateTable(len(s.entities), 0)
+	for _, e := range s.entities {
+		entity := L.CreateTable(0, 4)
+		entity.RawSetString("x", lua.LNumber(e.pos[0]))
+		entity.RawSetString("y", lua.LNumber(e.pos[1]))
+		entity.RawSetString("z", lua.LNumber(e.pos[2]))
+		if e.nbt != nil {
+			entity.RawSetString("nbt", e.nbt)
+		}
+		t.Append(entity)
+	}
+	L.Push(t)
+	return 1
+}
+
+// s:add_entity(x, y, z, nbt) adds an entity at an exact position with a compound value of its data
+func structureAddEntity(L *lua.LState) int {
+	s := checkStructure(L)
+	pos := [3]float64{float64(L.CheckNumber(2)), float64(L.CheckNumber(3)), float64(L.CheckNumber(4))}
+	s.addEntity(pos, L.CheckTable(5))
+	return 0
+}
+
+// s:remove_entity(i) removes the i-th entity as listed by s:entities()
+func structureRemoveEntity(L *lua.LState) int {
+	s := checkStructure(L)
+	i := L.CheckInt(2)
+	if i < 1 || i > len(s.entities) {
+		L.ArgError(2, "no such entity")
+	}
+	s.entities = append(s.entities[:i-1], s.entities[i:]...)
+	return 0
+}
+
+// s:rotate(turns) turns the structure clockwise, seen from above, by turns quarter turns, default 1
+func structureRotate(L *lua.LState) int {
+	s := checkStructure(L)
+	s.rotate(L, L.OptInt(2, 1))
+	return 0
+}
+
+// s:mirror(axis) flips the structure across "x" (east and west swap) or "z" (north and south swap)
+func structureMirror(L *lua.LState) int {
+	s := checkStructure(L)
+	axis := L.CheckString(2)
+	if axis != "x" && axis != "z" {
+		L.ArgError(2, `"x" or "z" expected`)
+	}
+	s.mirror(L, axis)
+	return 0
+}
+
+// s:translate(dx, dy, dz) moves everything, growing the size to fit
+func structureTranslate(L *lua.LState) int {
+	s := checkStructure(L)
+	if err := s.translate(L, checkPos(L, 2)); err != nil {
+		return pushError(L, "Error translating structure", err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// s:write(format, version) stores the structure back into the document it was read from and returns the
+// document, or returns a new document if format or version differ from the original's, followed by a warning
+// if anything couldn't be converted
+func structureWrite(L *lua.LState) int {
+	s := checkStructure(L)
+	doc, err := s.write(L, L.OptString(2, ""), L.OptInt(3, 0))
+	if err != nil {
+		return pushError(L, "Error writing structure", err)
+	}
+	L.Push(doc)
+	return 1 + pushWarnings(L, s.warnings)
+}
@@ -0,0 +1,255 @@
+package nlua
+
+import "testing"
+
+func TestStructure(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+		nbt = { { tagType = 10, name = "", value = {
+			{ tagType = 3, name = "DataVersion", value = 3465 },
+			{ tagType = 9, name = "size", value = { tagListType = 3, list = { 3, 1, 2 } } },
+			{ tagType = 9, name = "palette", value = { tagListType = 10, list = {
+				{ { tagType = 8, name = "Name", value = "minecraft:stone" } },
+				{ { tagType = 8, name = "Name", value = "minecraft:oak_stairs" },
+				  { tagType = 10, name = "Properties", value = {
+					{ tagType = 8, name = "facing", value = "north" },
+					{ tagType = 8, name = "shape", value = "inner_left" },
+				  } } },
+			} } },
+			{ tagType = 9, name = "blocks", value = { tagListType = 10, list = {
+				{ { tagType = 9, name = "pos", value = { tagListType = 3, list = { 0, 0, 0 } } },
+				  { tagType = 3, name = "state", value = 0 } },
+				{ { tagType = 9, name = "pos", value = { tagListType = 3, list = { 2, 0, 1 } } },
+				  { tagType = 3, name = "state", value = 1 } },
+			} } },
+			{ tagType = 9, name = "entities", value = { tagListType = 10, list = {} } },
+		} } }
+
+		local s = structure(nbt)
+		assert(s:get(0, 0, 0) == "minecraft:stone")
+		assert(s:get(1, 0, 0) == nil)
+		assert(#s:blocks() == 2)
+
+		s:set(1, 0, 0, "chest[facing=south]", { { tagType = 8, name = "id", value = "minecraft:chest" } })
+		local state, be = s:get(1, 0, 0)
+		assert(state == "minecraft:chest[facing=south]" and be[1].value == "minecraft:chest")
+		assert(s:remove(0, 0, 0) and not s:remove(0, 0, 0))
+		s:add_entity(0.5, 0, 0.5, { { tagType = 9, name = "Rotation", value = { tagListType = 5, list = { 0, 0 } } } })
+
+		-- a quarter turn clockwise: the 3x2 footprint becomes 2x3, north becomes east
+		s:rotate(1)
+		local x, y, z = s:size()
+		assert(x == 2 and y == 1 and z == 3)
+		assert(s:get(0, 0, 2) == "minecraft:oak_stairs[facing=east,shape=inner_left]", s:get(0, 0, 2))
+		assert(s:get(1, 0, 1) == "minecraft:chest[facing=west]")
+		local e = s:entities()[1]
+		assert(e.x == 1.5 and e.z == 0.5 and e.nbt[1].value.list[1] == 90)
+
+		s:mirror("x")
+		assert(s:get(1, 0, 2) == "minecraft:oak_stairs[facing=west,shape=inner_right]")
+		assert(s:get(0, 0, 1) == "minecraft:chest[facing=east]")
+
+		assert(s:translate(0, 2, 0))
+		x, y, z = s:size()
+		assert(y == 3 and s:get(0, 2, 1) == "minecraft:chest[facing=east]")
+		local ok, msg = s:translate(0, -3, 0)
+		assert(ok == nil and msg:find("^Error translating structure: "), msg)
+
+		s:write()
+		local bad
+		bad, msg = structure({})
+		assert(bad == nil and msg:find("^Error reading structure: "), msg)
+		local s2 = structure(nbt)
+		assert(#s2:blocks() == 2 and #s2:entities() == 1)
+		assert(s2:get(1, 2, 2) == "minecraft:oak_stairs[facing=west,shape=inner_right]")
+		-- the removed stone is dropped from the palette
+		local palette = nbt[1].value[3].value.list
+		assert(nbt[1].value[3].name == "palette" and #palette == 2)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lua2Nbt(L); err != nil {
+		t.Error("written structure doesn't convert: ", err)
+	}
+}
+
+func TestBlockStateRotation(t *testing.T) {
+	cases := []struct{ in, rotated, mirroredZ string }{
+		{"rail[shape=north_south]", "minecraft:rail[shape=east_west]", "minecraft:rail[shape=north_south]"},
+		{"rail[shape=south_east]", "minecraft:rail[shape=south_west]", "minecraft:rail[shape=north_east]"},
+		{"rail[shape=ascending_north]", "minecraft:rail[shape=ascending_east]", "minecraft:rail[shape=ascending_south]"},
+		{"oak_fence[east=true,north=false]", "minecraft:oak_fence[east=false,south=true]", "minecraft:oak_fence[east=true,south=false]"},
+		{"oak_log[axis=x]", "minecraft:oak_log[axis=z]", "minecraft:oak_log[axis=x]"},
+		{"oak_sign[rotation=2]", "minecraft:oak_sign[rotation=6]", "minecraft:oak_sign[rotation=6]"},
+		{"oak_door[facing=east,hinge=left]", "minecraft:oak_door[facing=south,hinge=left]", "minecraft:oak_door[facing=east,hinge=right]"},
+		{"jigsaw[orientation=north_up]", "minecraft:jigsaw[orientation=east_up]", "minecraft:jigsaw[orientation=south_up]"},
+	}
+	for _, c := range cases {
+		b, err := parseBlockState(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.rotated(1).String(); got != c.rotated {
+			t.Errorf("%s rotated: expected %s, got %s", c.in, c.rotated, got)
+		}
+		if got := b.mirrored("z").String(); got != c.mirroredZ {
+			t.Errorf("%s mirrored: expected %s, got %s", c.in, c.mirroredZ, got)
+		}
+	}
+}
+
+func TestSchematic(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+		-- Sponge version 2, 2 x 1 x 2
+		nbt = { { tagType = 10, name = "Schematic", value = {
+			{ tagType = 3, name = "Version", value = 2 },
+			{ tagType = 3, name = "DataVersion", value = 3465 },
+			{ tagType = 2, name = "Width", value = 2 },
+			{ tagType = 2, name = "Height", value = 1 },
+			{ tagType = 2, name = "Length", value = 2 },
+			{ tagType = 3, name = "PaletteMax", value = 2 },
+			{ tagType = 10, name = "Palette", value = {
+				{ tagType = 3, name = "minecraft:air", value = 0 },
+				{ tagType = 3, name = "minecraft:stone", value = 1 },
+			} },
+			{ tagType = 7, name = "BlockData", value = { 0, 1, 1, 0 } },
+			{ tagType = 9, name = "BlockEntities", value = { tagListType = 10, list = {} } },
+		} } }
+
+		local s = schematic(nbt)
+		assert(s:get(1, 0, 0) == "minecraft:stone" and s:get(0, 0, 1) == "minecraft:stone")
+		assert(s:get(0, 0, 0) == "minecraft:air")
+		s:set(1, 0, 1, "chest", { { tagType = 8, name = "id", value = "minecraft:chest" } })
+		assert(s:write() == nbt)
+		s = schematic(nbt)
+		local state, be = s:get(1, 0, 1)
+		assert(state == "minecraft:chest" and be[1].value == "minecraft:chest")
+
+		-- conversions: to a structure, to MCEdit and back, and a big palette through Sponge version 3
+		local st = structure(s:write("structure"))
+		assert(#st:blocks() == 4 and st:get(1, 0, 0) == "minecraft:stone")
+		local old = schematic(s:write("schematic"))
+		assert(old:get(1, 0, 0) == "minecraft:stone" and old:get(1, 0, 1) == "minecraft:chest")
+
+		local big = structure(20, 1, 20)
+		for i = 0, 199 do
+			big:set(i % 20, 0, math.floor(i / 20), "minecraft:block_" .. i)
+		end
+		local doc = big:write("schem")
+		assert(doc[1].name == "" and doc[1].value[1].name == "Schematic")
+		local back = schematic(doc)
+		for i = 0, 199 do
+			assert(back:get(i % 20, 0, math.floor(i / 20)) == "minecraft:block_" .. i)
+		end
+		assert(back:get(0, 0, 19) == "minecraft:air")
+		local _, warning = big:write("schematic")
+		assert(warning == "200 block states with no block id written as air", warning)
+		assert(select("#", big:write("schem")) == 1)
+		local bad, msg = schematic({})
+		assert(bad == nil and msg:find("^Error reading schematic: "), msg)
+		nbt = doc
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lua2Nbt(L); err != nil {
+		t.Error("written schematic doesn't convert: ", err)
+	}
+}
+
+func TestLegacyBlocks(t *testing.T) {
+	for _, c := range []struct {
+		id, data int
+		state    string
+	}{
+		{1, 3, "minecraft:diorite"},
+		{35, 14, "minecraft:red_wool"},
+		{17, 6, "minecraft:birch_log[axis=x]"},
+		{44, 11, "minecraft:cobblestone_slab[type=top]"},
+		{162, 1, "minecraft:dark_oak_log[axis=y]"},
+		{234, 0, "minecraft:black_shulker_box"},
+	} {
+		b, err := legacyBlockState(c.id, c.data)
+		if err != nil || b.String() != c.state {
+			t.Errorf("%d:%d: expected %s, got %s, %v", c.id, c.data, c.state, b, err)
+			continue
+		}
+		if id, data, err := legacyId(b); err != nil || id != c.id || data != c.data {
+			t.Errorf("%s: expected %d:%d, got %d:%d, %v", c.state, c.id, c.data, id, data, err)
+		}
+	}
+}
+
+func TestMcstructure(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+		local function state(name, states)
+			return { { tagType = 8, name = "name", value = name },
+				{ tagType = 10, name = "states", value = states or {} },
+				{ tagType = 3, name = "version", value = 18090528 } }
+		end
+		-- 2 x 1 x 1: stone, then stairs with water in the second layer
+		nbt = { { tagType = 10, name = "", value = {
+			{ tagType = 3, name = "format_version", value = 1 },
+			{ tagType = 9, name = "size", value = { tagListType = 3, list = { 2, 1, 1 } } },
+			{ tagType = 10, name = "structure", value = {
+				{ tagType = 9, name = "block_indices", value = { tagListType = 9, list = {
+					{ tagListType = 3, list = { 0, 2 } },
+					{ tagListType = 3, list = { -1, 1 } },
+				} } },
+				{ tagType = 9, name = "entities", value = { tagListType = 10, list = {} } },
+				{ tagType = 10, name = "palette", value = {
+					{ tagType = 10, name = "default", value = {
+						{ tagType = 9, name = "block_palette", value = { tagListType = 10, list = {
+							state("minecraft:stone"),
+							state("minecraft:water", { { tagType = 3, name = "liquid_depth", value = 0 } }),
+							state("minecraft:oak_stairs", {
+								{ tagType = 1, name = "upside_down_bit", value = 1 },
+								{ tagType = 3, name = "weirdo_direction", value = 3 },
+							}),
+						} } },
+						{ tagType = 10, name = "block_position_data", value = {} },
+					} },
+				} },
+			} },
+			{ tagType = 9, name = "structure_world_origin", value = { tagListType = 3, list = { 0, 64, 0 } } },
+		} } }
+
+		local s = mcstructure(nbt)
+		assert(s:get(0, 0, 0) == "minecraft:stone")
+		assert(s:get(1, 0, 0) == "minecraft:oak_stairs[upside_down_bit=true,weirdo_direction=3]")
+		assert(s:get(1, 0, 0, 2) == "minecraft:water[liquid_depth=0]")
+		assert(s:get(0, 0, 0, 2) == nil)
+
+		-- Java Edition: waterlogged instead of the second layer, facing and half instead of Bedrock's states
+		local java = structure(s:write("structure"))
+		assert(java:get(1, 0, 0) == "minecraft:oak_stairs[facing=north,half=top,waterlogged=true]", java:get(1, 0, 0))
+		local back = mcstructure(java:write("mcstructure"))
+		assert(back:get(1, 0, 0) == "minecraft:oak_stairs[upside_down_bit=true,weirdo_direction=3]")
+		assert(back:get(1, 0, 0, 2) == "minecraft:water[liquid_depth=0]")
+
+		s:set(0, 0, 0, "minecraft:chest[minecraft:cardinal_direction=south]",
+			{ { tagType = 8, name = "id", value = "Chest" }, { tagType = 3, name = "y", value = 0 } })
+		s:remove(1, 0, 0, 2)
+		assert(s:write() == nbt)
+		s = mcstructure(nbt)
+		local chest, be = s:get(0, 0, 0)
+		assert(chest == "minecraft:chest[minecraft:cardinal_direction=south]" and be[2].value == 64)
+		assert(s:get(1, 0, 0, 2) == nil)
+		local _, warning = s:write("structure")
+		assert(warning == "1 block entities and entities not converted between editions", warning)
+		local bad, msg = mcstructure({})
+		assert(bad == nil and msg:find("^Error reading mcstructure: "), msg)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lua2Nbt(L); err != nil {
+		t.Error("written mcstructure doesn't convert: ", err)
+	}
+}
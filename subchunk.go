@@ -0,0 +1,313 @@
+package nlua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Number of blocks in a subchunk: 16 * 16 * 16
+const subChunkBlocks = 4096
+
+// Bits per block index that Bedrock block storages may use
+var storageBitSizes = []int{1, 2, 3, 4, 5, 6, 8, 16}
+
+// SubChunk is a decoded Bedrock SubChunkPrefix record: one or more block storage layers, the second usually
+// holding water in waterlogged blocks
+type SubChunk struct {
+	// record format version: 1, 8 or 9
+	Version byte
+	// y index of the subchunk, only stored by version 9
+	Y        int8
+	Storages []BlockStorage
+}
+
+// BlockStorage is one layer of a subchunk: a palette index for every block and the palette of block states
+type BlockStorage struct {
+	// Indices are in Bedrock's x, z, y order: index (x << 8) | (z << 4) | y
+	Indices []uint16
+	// each palette entry is a little endian NBT compound tag, as stored
+	Palette [][]byte
+}
+
+// DecodeSubChunk decodes the value of a ChunkSubChunkPrefix record
+func DecodeSubChunk(b []byte) (*SubChunk, error) {
+	r := bytes.NewReader(b)
+	s := &SubChunk{}
+	var err error
+	if s.Version, err = r.ReadByte(); err != nil {
+		return nil, NbtParseError{"Reading subchunk version", err}
+	}
+	numStorages := byte(1)
+	switch s.Version {
+	case 1:
+	case 8, 9:
+		if numStorages, err = r.ReadByte(); err != nil {
+			return nil, NbtParseError{"Reading subchunk storage count", err}
+		}
+		if s.Version == 9 {
+			var y byte
+			if y, err = r.ReadByte(); err != nil {
+				return nil, NbtParseError{"Reading subchunk y index", err}
+			}
+			s.Y = int8(y)
+		}
+	default:
+		return nil, NbtParseError{fmt.Sprintf("Subchunk version %d not supported", s.Version), nil}
+	}
+	for i := byte(0); i < numStorages; i++ {
+		storage, err := decodeBlockStorage(r, b)
+		if err != nil {
+			return nil, NbtParseError{fmt.Sprintf("Reading subchunk block storage %d", i), err}
+		}
+		s.Storages = append(s.Storages, storage)
+	}
+	return s, nil
+}
+
+// validBitSize reports whether bits is one of storageBitSizes, or 0 for a storage with a single block state
+func validBitSize(bits int) bool {
+	if bits == 0 {
+		return true
+	}
+	for _, size := range storageBitSizes {
+		if size == bits {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeBlockStorage(r *bytes.Reader, b []byte) (BlockStorage, error) {
+	var storage BlockStorage
+	header, err := r.ReadByte()
+	if err != nil {
+		return storage, err
+	}
+	if header&1 != 0 {
+		return storage, fmt.Errorf("runtime id palettes are only used over the network")
+	}
+	bits := int(header >> 1)
+	if !validBitSize(bits) {
+		return storage, fmt.Errorf("%d bits per block is not a valid block storage size", bits)
+	}
+	storage.Indices = make([]uint16, subChunkBlocks)
+	paletteSize := int32(1)
+	if bits != 0 {
+		perWord := 32 / bits
+		words := make([]uint32, (subChunkBlocks+perWord-1)/perWord)
+		if err = binary.Read(r, binary.LittleEndian, words); err != nil {
+			return storage, err
+		}
+		mask := uint32(1)<<uint(bits) - 1
+		for i := range storage.Indices {
+			storage.Indices[i] = uint16(words[i/perWord] >> uint((i%perWord)*bits) & mask)
+		}
+		if err = binary.Read(r, binary.LittleEndian, &paletteSize); err != nil {
+			return storage, err
+		}
+	}
+	c := &codec{order: binary.LittleEndian, maxDepth: MaxNbtDepth}
+	for i := int32(0); i < paletteSize; i++ {
+		start := len(b) - r.Len()
+		var tagType byte
+		var nameLen uint16
+		if tagType, err = r.ReadByte(); err == nil {
+			err = binary.Read(r, binary.LittleEndian, &nameLen)
+		}
+		if err == nil {
+			_, err = r.Seek(int64(nameLen), io.SeekCurrent)
+		}
+		if err == nil {
+			err = c.skipPayload(r, tagType)
+		}
+		if err != nil {
+			return storage, fmt.Errorf("palette entry %d: %s", i, err.Error())
+		}
+		storage.Palette = append(storage.Palette, b[start:len(b)-r.Len()])
+	}
+	for i, index := range storage.Indices {
+		if int(index) >= len(storage.Palette) {
+			return storage, fmt.Errorf("block %d has palette index %d but the palette has %d entries", i, index, len(storage.Palette))
+		}
+	}
+	return storage, nil
+}
+
+// Encode returns the subchunk as a ChunkSubChunkPrefix record value, packing indices as tightly as the palette allows
+func (s *SubChunk) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(s.Version)
+	switch s.Version {
+	case 1:
+		if len(s.Storages) != 1 {
+			return nil, fmt.Errorf("subchunk version 1 has exactly one block storage, not %d", len(s.Storages))
+		}
+	case 8, 9:
+		buf.WriteByte(byte(len(s.Storages)))
+		if s.Version == 9 {
+			buf.WriteByte(byte(s.Y))
+		}
+	default:
+		return nil, fmt.Errorf("subchunk version %d not supported", s.Version)
+	}
+	for i, storage := range s.Storages {
+		if err := storage.encode(&buf); err != nil {
+			return nil, fmt.Errorf("block storage %d: %s", i, err.Error())
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (storage BlockStorage) encode(buf *bytes.Buffer) error {
+	if len(storage.Indices) != subChunkBlocks {
+		return fmt.Errorf("%d block indices instead of %d", len(storage.Indices), subChunkBlocks)
+	}
+	if len(storage.Palette) == 0 {
+		return fmt.Errorf("empty palette")
+	}
+	bits := 0
+	for _, size := range storageBitSizes {
+		if len(storage.Palette) <= 1<<uint(size) {
+			bits = size
+			break
+		}
+	}
+	if bits == 0 {
+		return fmt.Errorf("palette of %d entries is too large", len(storage.Palette))
+	}
+	perWord := 32 / bits
+	words := make([]uint32, (subChunkBlocks+perWord-1)/perWord)
+	for i, index := range storage.Indices {
+		if int(index) >= len(storage.Palette) {
+			return fmt.Errorf("block %d has palette index %d but the palette has %d entries", i, index, len(storage.Palette))
+		}
+		words[i/perWord] |= uint32(index) << uint((i%perWord)*bits)
+	}
+	buf.WriteByte(byte(bits << 1))
+	binary.Write(buf, binary.LittleEndian, words)
+	binary.Write(buf, binary.LittleEndian, int32(len(storage.Palette)))
+	for _, entry := range storage.Palette {
+		buf.Write(entry)
+	}
+	return nil
+}
+
+// decode_subchunk(value) returns a raw subchunk record as a table of version, y and storages, where each storage
+// has a palette, a table of compound tags like nbt, and blocks, an int nbtarray of 4096 1-based palette positions
+// indexed with subchunk_index(x, y, z)
+func decodeSubChunk(L *lua.LState) int {
+	s, err := DecodeSubChunk([]byte(L.CheckString(1)))
+	if err != nil {
+		return pushError(L, "Error decoding subchunk", err)
+	}
+	t := L.NewTable()
+	t.RawSetString("version", lua.LNumber(s.Version))
+	t.RawSetString("y", lua.LNumber(s.Y))
+	storages := L.NewTable()
+	for _, storage := range s.Storages {
+		palette, err := nbtToTable(bytes.Join(storage.Palette, nil), newBedrockCodec(L))
+		if err != nil {
+			return pushError(L, "Error decoding subchunk palette", err)
+		}
+		blocks, _ := newTypedArray(11, subChunkBlocks)
+		for i, index := range storage.Indices {
+			blocks.ints[i] = int32(index) + 1
+		}
+		st := L.NewTable()
+		st.RawSetString("palette", palette)
+		st.RawSetString("blocks", newTypedArrayUserData(L, blocks))
+		storages.Append(st)
+	}
+	t.RawSetString("storages", storages)
+	L.Push(t)
+	return 1
+}
+
+// encode_subchunk(t) is the reverse of decode_subchunk, returning the raw record value as a string; blocks may
+// also be a plain table
+func encodeSubChunk(L *lua.LState) int {
+	t := L.CheckTable(1)
+	s := &SubChunk{Version: 8}
+	if v, ok := t.RawGetString("version").(lua.LNumber); ok {
+		s.Version = byte(v)
+	}
+	if y, ok := t.RawGetString("y").(lua.LNumber); ok {
+		s.Y = int8(y)
+	}
+	storages, ok := t.RawGetString("storages").(*lua.LTable)
+	if !ok {
+		L.ArgError(1, "storages table expected")
+	}
+	for i := 1; i <= storages.Len(); i++ {
+		st, ok := storages.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			L.ArgError(1, fmt.Sprintf("storage %d is not a table", i))
+		}
+		var storage BlockStorage
+		palette, ok := st.RawGetString("palette").(*lua.LTable)
+		if !ok {
+			L.ArgError(1, fmt.Sprintf("storage %d palette is not a table", i))
+		}
+		for k := 1; k <= palette.Len(); k++ {
+			var buf bytes.Buffer
+			tag, ok := palette.RawGetInt(k).(*lua.LTable)
+			if !ok {
+				L.ArgError(1, fmt.Sprintf("storage %d palette entry %d is not a tag table", i, k))
+			}
+			if err := writeTag(&buf, tag, newBedrockCodec(L)); err != nil {
+				L.ArgError(1, fmt.Sprintf("storage %d palette entry %d: %s", i, k, err.Error()))
+			}
+			storage.Palette = append(storage.Palette, buf.Bytes())
+		}
+		blocks := st.RawGetString("blocks")
+		a := typedArrayOf(blocks)
+		if a == nil {
+			if bt, ok := blocks.(*lua.LTable); ok {
+				a, _ = newTypedArray(11, 0)
+				for k := 1; k <= bt.Len(); k++ {
+					n, err := a.fromLua(bt.RawGetInt(k))
+					if err == nil {
+						err = a.set(k-1, n)
+					}
+					if err != nil {
+						L.ArgError(1, fmt.Sprintf("storage %d block %d: %s", i, k, err.Error()))
+					}
+				}
+			} else {
+				L.ArgError(1, fmt.Sprintf("storage %d blocks is not an array", i))
+			}
+		}
+		storage.Indices = make([]uint16, a.len())
+		for k := range storage.Indices {
+			n := a.get(k)
+			if n < 1 || n > int64(len(storage.Palette)) {
+				L.ArgError(1, fmt.Sprintf("storage %d block %d refers to palette entry %d of %d", i, k+1, n, len(storage.Palette)))
+			}
+			storage.Indices[k] = uint16(n - 1)
+		}
+		s.Storages = append(s.Storages, storage)
+	}
+	b, err := s.Encode()
+	if err != nil {
+		return pushError(L, "Error encoding subchunk", err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// subchunk_index(x, y, z) returns the position in a decoded subchunk's blocks of the block at x, y, z (each 0-15)
+func subChunkIndex(L *lua.LState) int {
+	var xyz [3]int
+	for i := range xyz {
+		if xyz[i] = L.CheckInt(i + 1); xyz[i] < 0 || xyz[i] > 15 {
+			L.ArgError(i+1, fmt.Sprintf("0-15 expected, got %d", xyz[i]))
+		}
+	}
+	x, y, z := xyz[0], xyz[1], xyz[2]
+	L.Push(lua.LNumber(x<<8 | z<<4 | y + 1))
+	return 1
+}
@@ -0,0 +1,106 @@
+package nlua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// blockStateNbt returns a little endian Bedrock palette entry compound with a name and no states
+func blockStateNbt(name string) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{10, 0, 0, 8, 4, 0})
+	buf.WriteString("name")
+	binary.Write(&buf, binary.LittleEndian, int16(len(name)))
+	buf.WriteString(name)
+	buf.Write([]byte{10, 6, 0})
+	buf.WriteString("states")
+	buf.Write([]byte{0, 0})
+	return buf.Bytes()
+}
+
+func TestSubChunk(t *testing.T) {
+	var palette [][]byte
+	for _, name := range []string{"air", "stone", "dirt", "grass", "sand"} {
+		palette = append(palette, blockStateNbt("minecraft:"+name))
+	}
+	indices := make([]uint16, subChunkBlocks)
+	for i := range indices {
+		indices[i] = uint16(i % len(palette))
+	}
+	s := &SubChunk{Version: 9, Y: -4, Storages: []BlockStorage{
+		{indices, palette},
+		{make([]uint16, subChunkBlocks), palette[:1]},
+	}}
+	b, err := s.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version, storage count, y, then 5 entries need 3 bits: 10 per word, 410 words
+	if b[0] != 9 || b[1] != 2 || int8(b[2]) != -4 || b[3] != 3<<1 {
+		t.Errorf("unexpected header %v", b[:4])
+	}
+	decoded, err := DecodeSubChunk(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, s) {
+		t.Error("decoded subchunk differs from encoded one")
+	}
+
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("raw", lua.LString(b))
+	err = L.DoString(`
+		local s = decode_subchunk(raw)
+		assert(s.version == 9 and s.y == -4 and #s.storages == 2)
+		local layer = s.storages[1]
+		assert(#layer.palette == 5 and layer.palette[2].value[1].value == "minecraft:stone")
+		assert(#layer.blocks == 4096 and layer.blocks[1] == 1 and layer.blocks[2] == 2)
+		-- replace the block at x 0, y 1, z 0 with a new palette entry
+		local glass = { tagType = 10, name = "", value = {
+			{ tagType = 8, name = "name", value = "minecraft:glass" },
+			{ tagType = 10, name = "states", value = {} },
+		} }
+		layer.palette[#layer.palette + 1] = glass
+		layer.blocks[subchunk_index(0, 1, 0)] = #layer.palette
+		assert(subchunk_index(15, 15, 15) == 4096)
+		assert(not pcall(subchunk_index, 16, 0, 0) and not pcall(subchunk_index, 0, -1, 0))
+		raw = encode_subchunk(s)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = DecodeSubChunk([]byte(L.GetGlobal("raw").(lua.LString)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := decoded.Storages[0]
+	if len(st.Palette) != 6 || !bytes.Equal(st.Palette[5], blockStateNbt("minecraft:glass")) {
+		t.Errorf("new palette entry not encoded: %v", st.Palette)
+	}
+	if st.Indices[1] != 5 || st.Indices[2] != 2 {
+		t.Errorf("indices expected 5, 2, got %d, %d", st.Indices[1], st.Indices[2])
+	}
+}
+
+func TestCorruptSubChunk(t *testing.T) {
+	// 7 and 33 bits aren't storage sizes; 33 would otherwise fit no blocks in a word
+	for _, bits := range []byte{7, 33, 127} {
+		if _, err := DecodeSubChunk([]byte{8, 1, bits << 1, 0, 0, 0, 0}); err == nil {
+			t.Errorf("%d bits: expected an error", bits)
+		}
+	}
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+		local s, msg = decode_subchunk("\8\1\14\0\0\0\0")
+		assert(s == nil and msg:find("^Error decoding subchunk: "), msg)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,186 @@
+package nlua
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Helpers for reading and building the lua table form of tags from Go
+
+// newTag returns a tag table
+func newTag(L *lua.LState, tagType byte, name string, value lua.LValue) *lua.LTable {
+	tag := L.CreateTable(0, 3)
+	tag.RawSetString("tagType", lua.LNumber(tagType))
+	tag.RawSetString("name", lua.LString(name))
+	tag.RawSetString("value", value)
+	return tag
+}
+
+// tagType returns a tag table's type, or 0 if it has none
+func tagType(tag *lua.LTable) byte {
+	if n, ok := tag.RawGetString("tagType").(lua.LNumber); ok {
+		return byte(n)
+	}
+	return 0
+}
+
+// arrayElementType returns the tag type of the elements of array tag type t: byte, int or long
+func arrayElementType(t byte) byte {
+	switch t {
+	case 7:
+		return 1
+	case 11:
+		return 3
+	}
+	return 4
+}
+
+// arrayElementSize returns the size in bytes of the elements of array tag type t
+func arrayElementSize(t byte) int64 {
+	switch t {
+	case 7:
+		return 1
+	case 11:
+		return 4
+	}
+	return 8
+}
+
+// integerBits returns the size in bits of integer tag type t
+func integerBits(t byte) int {
+	switch t {
+	case 1:
+		return 8
+	case 2:
+		return 16
+	case 3:
+		return 32
+	}
+	return 64
+}
+
+// tagValue returns a tag table's value, reading it through a lazy tag's metatable
+func tagValue(L *lua.LState, tag *lua.LTable) lua.LValue {
+	return L.GetField(tag, "value")
+}
+
+// findTag returns the child tag named name in a compound value table, or nil
+func findTag(compound *lua.LTable, name string) *lua.LTable {
+	var found *lua.LTable
+	compound.ForEach(func(_, v lua.LValue) {
+		if tag, ok := v.(*lua.LTable); ok && found == nil && tag.RawGetString("name") == lua.LString(name) {
+			found = tag
+		}
+	})
+	return found
+}
+
+// findValue returns the value of the child tag named name and of type tagType in a compound value table, or LNil
+func findValue(L *lua.LState, compound *lua.LTable, name string, t byte) lua.LValue {
+	if tag := findTag(compound, name); tag != nil && tagType(tag) == t {
+		return tagValue(L, tag)
+	}
+	return lua.LNil
+}
+
+// findCompound returns the value table of the compound tag named name in a compound value table, or nil
+func findCompound(L *lua.LState, compound *lua.LTable, name string) *lua.LTable {
+	t, _ := findValue(L, compound, name, 10).(*lua.LTable)
+	return t
+}
+
+// findList returns the element table and element type of the list tag named name in a compound value table,
+// or nil
+func findList(L *lua.LState, compound *lua.LTable, name string) (*lua.LTable, byte) {
+	if list, ok := findValue(L, compound, name, 9).(*lua.LTable); ok {
+		elements, _ := list.RawGetString("list").(*lua.LTable)
+		listType, _ := list.RawGetString("tagListType").(lua.LNumber)
+		return elements, byte(listType)
+	}
+	return nil, 0
+}
+
+// setTag replaces the value of the child tag named name in a compound value table, adding the tag if missing
+func setTag(L *lua.LState, compound *lua.LTable, t byte, name string, value lua.LValue) {
+	if tag := findTag(compound, name); tag != nil {
+		tag.RawSetString("tagType", lua.LNumber(t))
+		tag.RawSetString("value", value)
+		tag.Metatable = lua.LNil
+		return
+	}
+	compound.Append(newTag(L, t, name, value))
+}
+
+// removeTag removes the child tag named name from a compound value table, keeping the remaining tags in order
+func removeTag(compound *lua.LTable, name string) bool {
+	for i := 1; i <= compound.Len(); i++ {
+		if tag, ok := compound.RawGetInt(i).(*lua.LTable); ok && tag.RawGetString("name") == lua.LString(name) {
+			compound.Remove(i)
+			return true
+		}
+	}
+	return false
+}
+
+// newList returns a list tag value table of the given element type and elements
+func newList(L *lua.LState, listType byte, elements *lua.LTable) *lua.LTable {
+	list := L.CreateTable(0, 2)
+	list.RawSetString("tagListType", lua.LNumber(listType))
+	list.RawSetString("list", elements)
+	return list
+}
+
+// rootCompound accepts a document (a table of top-level tags like the global nbt), a compound tag, or a compound
+// value table, and returns the compound value table
+func rootCompound(L *lua.LState, t *lua.LTable) *lua.LTable {
+	if tagType(t) == 10 {
+		if value, ok := tagValue(L, t).(*lua.LTable); ok {
+			return value
+		}
+	}
+	if first, ok := t.RawGetInt(1).(*lua.LTable); ok && tagType(first) == 10 && first.RawGetString("name") == lua.LString("") {
+		if value, ok := tagValue(L, first).(*lua.LTable); ok {
+			return value
+		}
+	}
+	return t
+}
+
+// arrayOf returns an array value of type t, either compact or a table, as a typed array; tables are copied, and an
+// element that isn't an integer in range for the type is an error. Anything else is an empty array.
+func arrayOf(v lua.LValue, t byte) (*typedArray, error) {
+	if a := typedArrayOf(v); a != nil && a.tagType == t {
+		return a, nil
+	}
+	a, _ := newTypedArray(t, 0)
+	if tbl, ok := v.(*lua.LTable); ok {
+		for i := 1; i <= tbl.Len(); i++ {
+			n, err := a.fromLua(tbl.RawGetInt(i))
+			if err == nil {
+				err = a.set(i-1, n)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", i, err)
+			}
+		}
+	}
+	return a, nil
+}
+
+// arrayValue returns a as an array value in the representation of like: compact if like is compact
+func arrayValue(L *lua.LState, a *typedArray, like lua.LValue) lua.LValue {
+	if typedArrayOf(like) != nil || getConfig(L).compact {
+		return newTypedArrayUserData(L, a)
+	}
+	t := L.CreateTable(a.len(), 0)
+	for i := 0; i < a.len(); i++ {
+		t.Append(a.toLua(L, a.get(i)))
+	}
+	return t
+}
+
+// longsValue returns longs as a long array value in the representation of like: compact if like is compact
+func longsValue(L *lua.LState, longs []int64, like lua.LValue) lua.LValue {
+	return arrayValue(L, &typedArray{tagType: 12, longs: longs}, like)
+}
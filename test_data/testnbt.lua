@@ -112,5 +112,5 @@ nbt[#nbt+1] = {
 }
 
 -- sha1 signatures of the nbt output of the above
-sha1bedrock = { 183, 26, 31, 26, 110, 33, 191, 178, 15, 197, 19, 165, 71, 31, 223, 242, 206, 152, 249, 212, }
-sha1java = { 137, 230, 39, 223, 1, 53, 121, 63, 213, 86, 196, 239, 214, 171, 194, 132, 222, 16, 188, 97, }
+sha1bedrock = { 135, 62, 115, 238, 15, 84, 96, 50, 29, 248, 248, 182, 28, 195, 167, 143, 242, 100, 89, 48, }
+sha1java = { 181, 239, 43, 7, 75, 249, 115, 232, 1, 77, 205, 99, 97, 188, 197, 120, 69, 12, 0, 55, }
@@ -0,0 +1,207 @@
+package nlua
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// UUID is an entity or player UUID. Java Edition stores them as int arrays of four ints since 1.16, as
+// UUIDMost and UUIDLeast longs before that, and as hyphenated strings in some places such as owner tags.
+type UUID [16]byte
+
+// ParseUUID reads a UUID written as 32 hex digits with or without the usual hyphens
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	h := strings.Replace(s, "-", "", -1)
+	if len(h) != 32 {
+		return u, fmt.Errorf("'%s' is not a UUID", s)
+	}
+	if _, err := hex.Decode(u[:], []byte(h)); err != nil {
+		return u, fmt.Errorf("'%s' is not a UUID", s)
+	}
+	return u, nil
+}
+
+// String returns the canonical lower case hyphenated form, like 069a79f4-44e9-4726-a5be-fca90e38aaf5
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// UUIDFromInts returns the UUID of an int array, most significant int first
+func UUIDFromInts(ints [4]int32) UUID {
+	var u UUID
+	for i, n := range ints {
+		binary.BigEndian.PutUint32(u[i*4:], uint32(n))
+	}
+	return u
+}
+
+// Ints returns u as an int array, most significant int first
+func (u UUID) Ints() [4]int32 {
+	var ints [4]int32
+	for i := range ints {
+		ints[i] = int32(binary.BigEndian.Uint32(u[i*4:]))
+	}
+	return ints
+}
+
+// UUIDFromLongs returns the UUID of a UUIDMost, UUIDLeast pair
+func UUIDFromLongs(most, least int64) UUID {
+	var u UUID
+	binary.BigEndian.PutUint64(u[:8], uint64(most))
+	binary.BigEndian.PutUint64(u[8:], uint64(least))
+	return u
+}
+
+// Longs returns u as a UUIDMost, UUIDLeast pair
+func (u UUID) Longs() (most, least int64) {
+	return int64(binary.BigEndian.Uint64(u[:8])), int64(binary.BigEndian.Uint64(u[8:]))
+}
+
+// uuidOfValue reads a UUID from an int array value of 4 ints or a string
+func uuidOfValue(v lua.LValue) (UUID, bool) {
+	if s, ok := v.(lua.LString); ok {
+		u, err := ParseUUID(string(s))
+		return u, err == nil
+	}
+	if a := typedArrayOf(v); a != nil && a.tagType != 11 {
+		return UUID{}, false
+	}
+	if a, err := arrayOf(v, 11); err == nil && a.len() == 4 {
+		return UUIDFromInts([4]int32{a.ints[0], a.ints[1], a.ints[2], a.ints[3]}), true
+	}
+	return UUID{}, false
+}
+
+// checkUUID reads a UUID from a string, an int array value, a UUID tag, or two longs, most then least, from
+// stack position n on
+func checkUUID(L *lua.LState, n int) UUID {
+	v := L.Get(n)
+	if tag, ok := v.(*lua.LTable); ok && (tagType(tag) == 11 || tagType(tag) == 8) {
+		v = tagValue(L, tag)
+	}
+	if L.GetTop() > n {
+		longs := &typedArray{tagType: 12}
+		most, errMost := longs.fromLua(v)
+		least, errLeast := longs.fromLua(L.Get(n + 1))
+		if errMost == nil && errLeast == nil {
+			return UUIDFromLongs(most, least)
+		}
+	}
+	u, ok := uuidOfValue(v)
+	if !ok {
+		L.ArgError(n, "UUID string, int array of 4 or two longs expected")
+	}
+	return u
+}
+
+// walkUUIDs calls f with each compound value (or top-level table of tags) under t and the name of each tag in it
+// holding a UUID: an int array of 4 ints, a string UUID, or a pair of longs named like UUIDMost and UUIDLeast,
+// which is named without the Most or Least
+func walkUUIDs(L *lua.LState, t *lua.LTable, f func(compound *lua.LTable, name string, u UUID)) {
+	t.ForEach(func(_, v lua.LValue) {
+		tag, ok := v.(*lua.LTable)
+		if !ok {
+			return
+		}
+		name := lua.LVAsString(tag.RawGetString("name"))
+		switch tagType(tag) {
+		case 8, 11:
+			if u, ok := uuidOfValue(tagValue(L, tag)); ok {
+				f(t, name, u)
+			}
+		case 4:
+			if strings.HasSuffix(name, "Most") {
+				prefix := strings.TrimSuffix(name, "Most")
+				longs := &typedArray{tagType: 12}
+				most, err := longs.fromLua(tagValue(L, tag))
+				if least := findValue(L, t, prefix+"Least", 4); err == nil && least != lua.LNil {
+					if n, err := longs.fromLua(least); err == nil {
+						f(t, prefix, UUIDFromLongs(most, n))
+					}
+				}
+			}
+		case 10:
+			if value, ok := tagValue(L, tag).(*lua.LTable); ok {
+				walkUUIDs(L, value, f)
+			}
+		case 9:
+			if list, ok := tagValue(L, tag).(*lua.LTable); ok {
+				walkListUUIDs(L, list, f)
+			}
+		}
+	})
+}
+
+func walkListUUIDs(L *lua.LState, list *lua.LTable, f func(compound *lua.LTable, name string, u UUID)) {
+	elements, _ := list.RawGetString("list").(*lua.LTable)
+	if elements == nil {
+		return
+	}
+	listType, _ := list.RawGetString("tagListType").(lua.LNumber)
+	elements.ForEach(func(_, v lua.LValue) {
+		if e, ok := v.(*lua.LTable); ok {
+			switch listType {
+			case 10:
+				walkUUIDs(L, e, f)
+			case 9:
+				walkListUUIDs(L, e, f)
+			}
+		}
+	})
+}
+
+// uuid_string(v) returns the hyphenated UUID of a string, an int array value or tag, or, as
+// uuid_string(most, least), of two longs
+func uuidString(L *lua.LState) int {
+	L.Push(lua.LString(checkUUID(L, 1).String()))
+	return 1
+}
+
+// uuid_ints(uuid) returns a UUID as an int array value of 4 ints, for tags like UUID since Java Edition 1.16
+func uuidInts(L *lua.LState) int {
+	ints := checkUUID(L, 1).Ints()
+	L.Push(arrayValue(L, &typedArray{tagType: 11, ints: ints[:]}, lua.LNil))
+	return 1
+}
+
+// uuid_longs(uuid) returns a UUID as two long values, most and least significant, for UUIDMost and UUIDLeast
+func uuidLongs(L *lua.LState) int {
+	most, least := checkUUID(L, 1).Longs()
+	longs := &typedArray{tagType: 12}
+	L.Push(longs.toLua(L, most))
+	L.Push(longs.toLua(L, least))
+	return 2
+}
+
+// find_uuid(doc, uuid) returns a table of {compound, name} tables, one for each tag anywhere in doc holding
+// uuid: compound is the compound value holding the tag and name is the tag's name, without Most or Least for
+// long pairs. With uuid omitted, every UUID found is listed, with a uuid field.
+func findUUID(L *lua.LState) int {
+	doc := L.CheckTable(1)
+	var want *UUID
+	if L.GetTop() >= 2 {
+		u := checkUUID(L, 2)
+		want = &u
+	}
+	found := L.NewTable()
+	walkUUIDs(L, doc, func(compound *lua.LTable, name string, u UUID) {
+		if want != nil && u != *want {
+			return
+		}
+		match := L.CreateTable(0, 3)
+		match.RawSetString("compound", compound)
+		match.RawSetString("name", lua.LString(name))
+		if want == nil {
+			match.RawSetString("uuid", lua.LString(u.String()))
+		}
+		found.Append(match)
+	})
+	L.Push(found)
+	return 1
+}
@@ -0,0 +1,53 @@
+package nlua
+
+import "testing"
+
+func TestUUID(t *testing.T) {
+	const s = "069a79f4-44e9-4726-a5be-fca90e38aaf5"
+	u, err := ParseUUID("069A79F444E94726A5BEFCA90E38AAF5")
+	if err != nil || u.String() != s {
+		t.Fatalf("expected %s, got %s, %v", s, u, err)
+	}
+	if ints := u.Ints(); UUIDFromInts(ints) != u || ints[0] != 0x069a79f4 || ints[2] != -1514210135 {
+		t.Errorf("ints %v don't round trip", ints)
+	}
+	if most, least := u.Longs(); UUIDFromLongs(most, least) != u {
+		t.Errorf("longs %d, %d don't round trip", most, least)
+	}
+	if _, err := ParseUUID("069a79f4-44e9-4726-a5be"); err == nil {
+		t.Error("short UUID accepted")
+	}
+
+	L := NewState()
+	defer L.Close()
+	err = L.DoString(`
+		local s = "069a79f4-44e9-4726-a5be-fca90e38aaf5"
+		local ints = uuid_ints(s)
+		assert(#ints == 4 and ints[1] == 110787060)
+		local most, least = uuid_longs(s)
+		assert(uuid_string(ints) == s and uuid_string(most, least) == s)
+		assert(uuid_string("069A79F444E94726A5BEFCA90E38AAF5") == s)
+
+		nbt = { { tagType = 10, name = "", value = {
+			{ tagType = 9, name = "Entities", value = { tagListType = 10, list = {
+				{ { tagType = 8, name = "id", value = "minecraft:wolf" },
+				  { tagType = 11, name = "UUID", value = uuid_ints("11111111-2222-3333-4444-555555555555") },
+				  { tagType = 11, name = "Owner", value = ints } },
+				{ { tagType = 8, name = "id", value = "minecraft:horse" },
+				  { tagType = 4, name = "UUIDMost", value = most },
+				  { tagType = 4, name = "UUIDLeast", value = least } },
+				{ { tagType = 8, name = "id", value = "minecraft:cat" },
+				  { tagType = 8, name = "OwnerUUID", value = s } },
+			} } },
+		} } }
+		local found = find_uuid(nbt, s)
+		assert(#found == 3)
+		assert(found[1].name == "Owner" and found[1].compound[1].value == "minecraft:wolf")
+		assert(found[2].name == "UUID" and found[2].compound[1].value == "minecraft:horse")
+		assert(found[3].name == "OwnerUUID")
+		assert(#find_uuid(nbt) == 4 and find_uuid(nbt)[1].uuid == "11111111-2222-3333-4444-555555555555")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
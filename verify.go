@@ -0,0 +1,198 @@
+package nlua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// VerifyNbt checks that b, made by Lua2Nbt(L), decodes back to exactly lua's global nbt table variable: the same
+// tags in the same order, with the same names, types and values. Numbers that aren't integers or are out of range,
+// NaN payloads a float can't hold and list elements the count doesn't cover are all mismatches. Float tag values
+// only need to match once rounded to a float. Tags left undecoded by lazy decoding are copied byte for byte and
+// not checked.
+func VerifyNbt(L *lua.LState, b []byte) error {
+	return verifyNbt(L, b, getConfig(L).currentEncoding())
+}
+
+// verifyNbt is VerifyNbt for b in encoding e instead of the state's
+func verifyNbt(L *lua.LState, b []byte, e Encoding) error {
+	cfg := getConfig(L)
+	doc, ok := L.GetGlobal("nbt").(*lua.LTable)
+	if !ok {
+		return LuaNbtError{fmt.Sprintf("Global nbt type, expected %T, got %T", lua.LTable{}, L.GetGlobal("nbt")), nil}
+	}
+	roots := RootsStream
+	if _, ok := doc.RawGetString("trailing").(lua.LString); ok {
+		roots = RootsKeepTrailing
+	}
+	scratch := NewState(StateEncoding(e), MemoryLimit(0), MaxDepth(cfg.maxDepth), Roots(roots))
+	defer scratch.Close()
+	if err := Nbt2Lua(b, scratch); err != nil {
+		return LuaNbtError{"Verifying: the saved NBT doesn't decode", err}
+	}
+	got := scratch.GetGlobal("nbt").(*lua.LTable)
+	v := &verifier{L: L, scratch: scratch}
+	if err := v.tags(nil, doc, got); err != nil {
+		return err
+	}
+	if want, got := doc.RawGetString("trailing"), got.RawGetString("trailing"); roots == RootsKeepTrailing && want != got {
+		return LuaNbtError{"Verifying: trailing data changed", nil}
+	}
+	return nil
+}
+
+// verifier compares the tables of the LState being saved with those decoded from the saved bytes in scratch
+type verifier struct {
+	L       *lua.LState
+	scratch *lua.LState
+}
+
+func (v *verifier) mismatch(path []pathStep, want, got lua.LValue) error {
+	return LuaNbtError{fmt.Sprintf("Verifying%s: saving %s reads back as %s", where(path), describe(want),
+		describe(got)), nil}
+}
+
+// where is the path of a mismatch to show after "Verifying"
+func where(path []pathStep) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return " " + pathString(path)
+}
+
+// describe shows a value in a mismatch, with a NaN's bits
+func describe(v lua.LValue) string {
+	if n, ok := v.(lua.LNumber); ok {
+		if math.IsNaN(float64(n)) {
+			return fmt.Sprintf("NaN(%#x)", math.Float64bits(float64(n)))
+		}
+		return strconv.FormatFloat(float64(n), 'g', -1, 64)
+	}
+	if s, ok := v.(lua.LString); ok {
+		return strconv.Quote(string(s))
+	}
+	return v.Type().String()
+}
+
+// tags compares the tags of a document or compound value table, in the order Lua2Nbt writes them, with the
+// decoded ones
+func (v *verifier) tags(path []pathStep, want, got *lua.LTable) error {
+	var tags []*lua.LTable
+	want.ForEach(func(_, t lua.LValue) {
+		if tag, ok := t.(*lua.LTable); ok && tagType(tag) != 0 {
+			tags = append(tags, tag)
+		}
+	})
+	if len(tags) != got.Len() {
+		return LuaNbtError{fmt.Sprintf("Verifying%s: saving %d tags reads back as %d", where(path), len(tags),
+			got.Len()), nil}
+	}
+	for i, tag := range tags {
+		g := got.RawGetInt(i + 1).(*lua.LTable)
+		name := lua.LVAsString(tag.RawGetString("name"))
+		childPath := path
+		if len(path) > 0 || name != "" {
+			childPath = append(path, pathStep{name: name})
+		}
+		if g.RawGetString("name") != tag.RawGetString("name") || tagType(g) != tagType(tag) {
+			return LuaNbtError{fmt.Sprintf("Verifying%s: saving tag %d '%s' reads back as tag %d '%s'",
+				where(childPath), tagType(tag), name, tagType(g), lua.LVAsString(g.RawGetString("name"))), nil}
+		}
+		if tag.RawGetString("value") == lua.LNil && lazyPayloadOf(tag) != nil {
+			continue
+		}
+		if err := v.value(childPath, tagValue(v.L, tag), tagValue(v.scratch, g), tagType(tag)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// value compares a value of tag type t with the decoded one
+func (v *verifier) value(path []pathStep, want, got lua.LValue, t byte) error {
+	switch t {
+	case 1, 2, 3, 8:
+		if want != got {
+			return v.mismatch(path, want, got)
+		}
+	case 4:
+		w, _ := want.(*lua.LTable)
+		g, _ := got.(*lua.LTable)
+		if w == nil || g == nil {
+			return v.mismatch(path, want, got)
+		}
+		wl, err := longOf(w)
+		if err != nil {
+			return err
+		}
+		if gl, _ := longOf(g); wl != gl {
+			return LuaNbtError{fmt.Sprintf("Verifying%s: saving %d reads back as %d", where(path), wl, gl), nil}
+		}
+	case 5, 6:
+		g := got.(lua.LNumber)
+		w, ok := want.(lua.LNumber)
+		if !ok {
+			// a value that isn't a number is saved as NaN
+			if !math.IsNaN(float64(g)) {
+				return v.mismatch(path, want, got)
+			}
+			return nil
+		}
+		rounded := w
+		if t == 5 {
+			rounded = float32ToNumber(numberToFloat32(w))
+			if math.IsNaN(float64(w)) && math.Float64bits(float64(w)) != math.Float64bits(float64(rounded)) {
+				return v.mismatch(path, want, rounded)
+			}
+		}
+		if math.Float64bits(float64(rounded)) != math.Float64bits(float64(g)) {
+			return v.mismatch(path, want, got)
+		}
+	case 7, 11, 12:
+		elementType := arrayElementType(t)
+		g, ok := got.(*lua.LTable)
+		n, element := v.elements(want)
+		if !ok || n != g.Len() {
+			return LuaNbtError{fmt.Sprintf("Verifying%s: the array reads back with a different length", where(path)), nil}
+		}
+		for i := 0; i < n; i++ {
+			if err := v.value(append(path, pathStep{index: i, isIdx: true}), element(i), g.RawGetInt(i+1), elementType); err != nil {
+				return err
+			}
+		}
+	case 9:
+		wantElems, wantType := listOf(want)
+		gotElems, gotType := listOf(got)
+		if wantElems == nil || gotElems == nil || wantType != gotType || wantElems.Len() != gotElems.Len() {
+			return LuaNbtError{fmt.Sprintf("Verifying%s: the list reads back with a different type or length", where(path)), nil}
+		}
+		for i := 1; i <= wantElems.Len(); i++ {
+			if err := v.value(append(path, pathStep{index: i - 1, isIdx: true}), wantElems.RawGetInt(i), gotElems.RawGetInt(i), wantType); err != nil {
+				return err
+			}
+		}
+	case 10:
+		w, _ := want.(*lua.LTable)
+		g, _ := got.(*lua.LTable)
+		if w == nil || g == nil {
+			return v.mismatch(path, want, got)
+		}
+		return v.tags(path, w, g)
+	}
+	return nil
+}
+
+// elements returns the length of an array value, compact or a table, and a function getting its elements
+func (v *verifier) elements(array lua.LValue) (int, func(int) lua.LValue) {
+	if a := typedArrayOf(array); a != nil {
+		return a.len(), func(i int) lua.LValue { return a.toLua(v.L, a.get(i)) }
+	}
+	t, _ := array.(*lua.LTable)
+	if t == nil {
+		return 0, nil
+	}
+	return t.Len(), func(i int) lua.LValue { return t.RawGetInt(i + 1) }
+}
@@ -0,0 +1,127 @@
+package nlua
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestWriteChecks(t *testing.T) {
+	L := NewState(StateEncoding(JavaEncoding))
+	defer L.Close()
+	for _, value := range []string{
+		`{ tagType = 1, name = "", value = 1.5 }`,
+		`{ tagType = 3, name = "", value = 0/0 }`,
+		`{ tagType = 7, name = "", value = { 1, -200 } }`,
+		`{ tagType = 7, name = "", value = { 1, 2.5 } }`,
+		`{ tagType = 11, name = "", value = { 1, 2^40 } }`,
+		`{ tagType = 11, name = "", value = { 1, nil, 3 } }`,
+		`{ tagType = 9, name = "", value = { tagListType = 3, list = { 1, 2, x = 3 } } }`,
+		`{ tagType = 9, name = "", value = { list = { 1, 2 } } }`,
+		`{ tagType = 9, name = "", value = { tagListType = "3", list = { 1, 2 } } }`,
+		`{ tagType = 9, name = "", value = { tagListType = 13, list = {} } }`,
+		`{ tagType = 4, name = "", value = { least = 2^32, most = 0 } }`,
+		`{ tagType = 12, name = "", value = { { least = 0.5, most = 0 } } }`,
+	} {
+		if err := L.DoString("nbt = { " + value + " }"); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := Lua2Nbt(L); err == nil {
+			t.Errorf("%s: expected an error, wrote %v", value, b)
+		}
+	}
+	if err := L.DoString(`nbt = { { tagType = 4, name = "", value = { least = -1, most = -1 } } }`); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := Lua2Nbt(L); err != nil || b[len(b)-1] != 0xff || b[len(b)-8] != 0xff {
+		t.Errorf("expected -1 long, got %v, %v", b, err)
+	}
+}
+
+func TestVerifyNbt(t *testing.T) {
+	L := NewState(StateEncoding(JavaEncoding), CompactArrays())
+	defer L.Close()
+	if err := L.DoString(textDoc + `
+		table.insert(nbt[1].value, { tagType = 5, name = "nan", value = 0/0 })
+		table.insert(nbt[1].value, { tagType = 11, name = "ints", value = nbt_array(11, { 1, -2 }) })`); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Lua2Nbt(L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyNbt(L, b); err != nil {
+		t.Fatal(err)
+	}
+	// NaN payloads survive loading and saving
+	nan := math.Float32frombits(0x7fa00001)
+	doc := L.NewTable()
+	doc.Append(newTag(L, 5, "", float32ToNumber(nan)))
+	L.SetGlobal("nbt", doc)
+	if b, err = Lua2Nbt(L); err != nil || VerifyNbt(L, b) != nil {
+		t.Fatalf("NaN payload: %v, %v", err, VerifyNbt(L, b))
+	}
+	if err := Nbt2Lua(b, L); err != nil {
+		t.Fatal(err)
+	}
+	tag := L.GetGlobal("nbt").(*lua.LTable).RawGetInt(1).(*lua.LTable)
+	if f := numberToFloat32(tag.RawGetString("value").(lua.LNumber)); math.Float32bits(f) != 0x7fa00001 {
+		t.Errorf("expected NaN 0x7fa00001, got %#x", math.Float32bits(f))
+	}
+	// but a payload too long for a float doesn't
+	tag.RawSetString("value", lua.LNumber(math.Float64frombits(0x7ff8000000000001)))
+	if b, err = Lua2Nbt(L); err != nil || VerifyNbt(L, b) == nil {
+		t.Errorf("lost NaN payload verified: %v", err)
+	}
+	// and a mismatch stops savenbt writing
+	dir, err := ioutil.TempDir("", "nlua-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nan.dat")
+	L.SetGlobal("path", lua.LString(path))
+	if err := L.DoString(`use_verify() savenbt(path)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("savenbt wrote a mismatch")
+	}
+}
+
+func TestLongStrings(t *testing.T) {
+	for _, opts := range [][]Option{nil, {LazyDecoding()}} {
+		L := NewState(append(opts, StateEncoding(JavaEncoding))...)
+		long := strings.Repeat("x", 40000)
+		doc := L.NewTable()
+		compound := L.NewTable()
+		compound.Append(newTag(L, 8, long, lua.LString(long)))
+		doc.Append(newTag(L, 10, "", compound))
+		L.SetGlobal("nbt", doc)
+		b, err := Lua2Nbt(L)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyNbt(L, b); err != nil {
+			t.Fatal(err)
+		}
+		if err := Nbt2Lua(b, L); err != nil {
+			t.Fatal(err)
+		}
+		tag := rootCompound(L, L.GetGlobal("nbt").(*lua.LTable)).RawGetInt(1).(*lua.LTable)
+		if tag.RawGetString("name") != lua.LString(long) || tagValue(L, tag) != lua.LString(long) {
+			t.Error("expected the 40000 byte name and string back")
+		}
+		compound.Append(newTag(L, 8, long+long, lua.LString("")))
+		L.SetGlobal("nbt", doc)
+		if _, err := Lua2Nbt(L); err == nil {
+			t.Error("expected an error for an 80000 byte name")
+		}
+		L.Close()
+	}
+}